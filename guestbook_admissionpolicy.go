@@ -0,0 +1,192 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	webappv1alpha1 "github.com/yourusername/guestbook-operator/api/v1alpha1"
+)
+
+// admissionPolicyName names both the ValidatingAdmissionPolicy and its binding
+const admissionPolicyName = "guestbook-operator.webapp.example.com"
+
+// admissionPolicyValidations carry the validating webhook's spec checks
+// over to CEL. Policies can't read other objects, so the policy is weaker
+// than the webhook in exactly two places, pinned down by TestAdmissionPolicy:
+//   - an external backend's connection Secret isn't checked for its keys
+//   - a backend type change is admitted whenever the migration annotation is
+//     set, where the webhook also requires the named
+//     GuestBookBackendMigration to be switching this GuestBook to that type
+var admissionPolicyValidations = []admissionregistrationv1.Validation{
+	{
+		Expression: "!has(object.spec.autoscaling) || !has(object.spec.replicas)",
+		Message:    "spec.replicas must not be set together with spec.autoscaling; remove spec.replicas, or remove spec.autoscaling to run a fixed number of replicas",
+	},
+	{
+		Expression: "!has(object.spec.autoscaling) || !has(object.spec.autoscaling.minReplicas) || object.spec.autoscaling.minReplicas <= object.spec.autoscaling.maxReplicas",
+		Message:    "spec.autoscaling.minReplicas must not be greater than spec.autoscaling.maxReplicas",
+	},
+	{
+		Expression: "!has(object.spec.podDisruptionBudget) || !has(object.spec.podDisruptionBudget.minAvailable) || " +
+			"variables.requiredAvailable < variables.minReplicas",
+		MessageExpression: "'spec.podDisruptionBudget.minAvailable must be less than the replica count (' + string(variables.minReplicas) + '), otherwise no pod can be evicted and node drains would hang'",
+	},
+	{
+		Expression: "!has(object.spec.podDisruptionBudget) || !has(object.spec.podDisruptionBudget.maxUnavailable) || !(string(object.spec.podDisruptionBudget.maxUnavailable) in ['0', '0%'])",
+		Message:    "spec.podDisruptionBudget.maxUnavailable must be greater than zero, otherwise no pod can be evicted and node drains would hang",
+	},
+	{
+		Expression: "!has(object.spec.ingress) || variables.ingressEnabled || (!has(object.spec.ingress.host) && !has(object.spec.ingress.tlsSecretName))",
+		Message:    "spec.ingress.host and spec.ingress.tlsSecretName require spec.ingress.enabled",
+	},
+	{
+		Expression: "!has(object.spec.ingress) || !has(object.spec.ingress.tlsSecretName) || has(object.spec.ingress.host)",
+		Message:    "spec.ingress.host is required when spec.ingress.tlsSecretName is set",
+	},
+	{
+		Expression: "!has(object.spec.service) || !has(object.spec.service.loadBalancerSourceRanges) || object.spec.service.type == 'LoadBalancer'",
+		Message:    "spec.service.loadBalancerSourceRanges only applies when spec.service.type is LoadBalancer",
+	},
+	{
+		Expression: "!has(object.spec.persistence) || !has(object.spec.persistence.finalBackup) || !object.spec.persistence.finalBackup || " +
+			"(has(object.spec.persistence.enabled) && object.spec.persistence.enabled)",
+		Message: "spec.persistence.finalBackup requires spec.persistence.enabled",
+	},
+	{
+		Expression: "!variables.backendChanged || " +
+			"(has(object.metadata.annotations) && '" + webappv1alpha1.BackendMigrationAnnotation + "' in object.metadata.annotations)",
+		Message: "spec.backend.type is immutable, since the new backend would start without the existing entries; create a GuestBookBackendMigration instead",
+	},
+}
+
+// admissionPolicyVariables are shared by the validations above
+var admissionPolicyVariables = []admissionregistrationv1.Variable{
+	{
+		// The fewest replicas the GuestBook may run
+		Name: "minReplicas",
+		Expression: "has(object.spec.autoscaling) ? (has(object.spec.autoscaling.minReplicas) ? object.spec.autoscaling.minReplicas : 1) : " +
+			"(has(object.spec.replicas) ? object.spec.replicas : 1)",
+	},
+	{
+		// The replicas minAvailable keeps available, with percentages rounded
+		// up as the disruption controller does. Values that aren't a number
+		// or a percentage are left to the PodDisruptionBudget's own checks.
+		Name: "requiredAvailable",
+		Expression: "type(object.spec.podDisruptionBudget.minAvailable) == int ? object.spec.podDisruptionBudget.minAvailable : " +
+			"(string(object.spec.podDisruptionBudget.minAvailable).matches('^[0-9]+%$') ? " +
+			"(int(string(object.spec.podDisruptionBudget.minAvailable).replace('%', '')) * variables.minReplicas + 99) / 100 : 0)",
+	},
+	{
+		// spec.backend.type defaults to inMemory
+		Name: "backendChanged",
+		Expression: "request.operation == 'UPDATE' && " +
+			"(has(object.spec.backend) && has(object.spec.backend.type) ? object.spec.backend.type : 'inMemory') != " +
+			"(has(oldObject.spec.backend) && has(oldObject.spec.backend.type) ? oldObject.spec.backend.type : 'inMemory')",
+	},
+	{
+		Name:       "ingressEnabled",
+		Expression: "has(object.spec.ingress) && has(object.spec.ingress.enabled) && object.spec.ingress.enabled",
+	},
+}
+
+// AdmissionPolicyInstaller installs a ValidatingAdmissionPolicy and binding
+// that enforce the webhook's spec checks inside the API server, for clusters
+// that turn the admission webhooks off or want to skip the round trip. The
+// conversion webhook is still needed: GuestBooks are stored at v1. See
+// admissionPolicyValidations for where the policy falls short of the webhook.
+type AdmissionPolicyInstaller struct {
+	Client client.Client
+}
+
+// +kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=validatingadmissionpolicies;validatingadmissionpolicybindings,verbs=get;create;update;patch
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, so only the
+// leader writes the policy
+func (i *AdmissionPolicyInstaller) NeedLeaderElection() bool {
+	return true
+}
+
+// Start applies the policy and its binding once and returns
+func (i *AdmissionPolicyInstaller) Start(ctx context.Context) error {
+	log := log.FromContext(ctx)
+
+	for _, obj := range []client.Object{admissionPolicy(), admissionPolicyBinding()} {
+		if err := i.Client.Patch(ctx, obj, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership); err != nil {
+			return fmt.Errorf("applying %s %s: %w", obj.GetObjectKind().GroupVersionKind().Kind, obj.GetName(), err)
+		}
+		log.Info("Applied admission policy", "kind", obj.GetObjectKind().GroupVersionKind().Kind, "name", obj.GetName())
+	}
+	return nil
+}
+
+// admissionPolicy returns the ValidatingAdmissionPolicy for GuestBooks. It
+// matches v1alpha1 only; requests for other versions are converted to it.
+func admissionPolicy() *admissionregistrationv1.ValidatingAdmissionPolicy {
+	return &admissionregistrationv1.ValidatingAdmissionPolicy{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: admissionregistrationv1.SchemeGroupVersion.String(),
+			Kind:       "ValidatingAdmissionPolicy",
+		},
+		ObjectMeta: metav1.ObjectMeta{Name: admissionPolicyName},
+		Spec: admissionregistrationv1.ValidatingAdmissionPolicySpec{
+			FailurePolicy: ptr.To(admissionregistrationv1.Fail),
+			MatchConstraints: &admissionregistrationv1.MatchResources{
+				MatchPolicy: ptr.To(admissionregistrationv1.Equivalent),
+				ResourceRules: []admissionregistrationv1.NamedRuleWithOperations{{
+					RuleWithOperations: admissionregistrationv1.RuleWithOperations{
+						Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+						Rule: admissionregistrationv1.Rule{
+							APIGroups:   []string{webappv1alpha1.GroupVersion.Group},
+							APIVersions: []string{webappv1alpha1.GroupVersion.Version},
+							Resources:   []string{"guestbooks"},
+						},
+					},
+				}},
+			},
+			// A GuestBook without a spec has nothing to check
+			MatchConditions: []admissionregistrationv1.MatchCondition{{
+				Name:       "has-spec",
+				Expression: "has(object.spec)",
+			}},
+			Variables:   admissionPolicyVariables,
+			Validations: admissionPolicyValidations,
+		},
+	}
+}
+
+// admissionPolicyBinding enforces the policy in every namespace
+func admissionPolicyBinding() *admissionregistrationv1.ValidatingAdmissionPolicyBinding {
+	return &admissionregistrationv1.ValidatingAdmissionPolicyBinding{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: admissionregistrationv1.SchemeGroupVersion.String(),
+			Kind:       "ValidatingAdmissionPolicyBinding",
+		},
+		ObjectMeta: metav1.ObjectMeta{Name: admissionPolicyName},
+		Spec: admissionregistrationv1.ValidatingAdmissionPolicyBindingSpec{
+			PolicyName:        admissionPolicyName,
+			ValidationActions: []admissionregistrationv1.ValidationAction{admissionregistrationv1.Deny},
+		},
+	}
+}
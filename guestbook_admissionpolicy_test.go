@@ -0,0 +1,180 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/ext"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/utils/ptr"
+
+	webappv1alpha1 "github.com/yourusername/guestbook-operator/api/v1alpha1"
+)
+
+// policyAdmits evaluates the admission policy the way the API server does:
+// variables are only an error once a validation reads them, and a
+// validation that fails to evaluate denies the request
+func policyAdmits(t *testing.T, oldGB, gb *webappv1alpha1.GuestBook) bool {
+	t.Helper()
+	env, err := cel.NewEnv(ext.Strings(),
+		cel.Variable("object", cel.DynType),
+		cel.Variable("oldObject", cel.DynType),
+		cel.Variable("request", cel.DynType),
+		cel.Variable("variables", cel.MapType(cel.StringType, cel.DynType)),
+	)
+	if err != nil {
+		t.Fatalf("creating CEL environment: %v", err)
+	}
+	eval := func(expression string, activation map[string]interface{}) (interface{}, error) {
+		ast, issues := env.Compile(expression)
+		if issues.Err() != nil {
+			t.Fatalf("compiling %q: %v", expression, issues.Err())
+		}
+		program, err := env.Program(ast)
+		if err != nil {
+			t.Fatalf("planning %q: %v", expression, err)
+		}
+		out, _, err := program.Eval(activation)
+		if err != nil {
+			return nil, err
+		}
+		return out.Value(), nil
+	}
+
+	object, err := runtime.DefaultUnstructuredConverter.ToUnstructured(gb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	activation := map[string]interface{}{
+		"object":    object,
+		"oldObject": nil,
+		"request":   map[string]interface{}{"operation": "CREATE"},
+	}
+	if oldGB != nil {
+		if activation["oldObject"], err = runtime.DefaultUnstructuredConverter.ToUnstructured(oldGB); err != nil {
+			t.Fatal(err)
+		}
+		activation["request"] = map[string]interface{}{"operation": "UPDATE"}
+	}
+
+	variables := map[string]interface{}{}
+	activation["variables"] = variables
+	for _, v := range admissionPolicyVariables {
+		if value, err := eval(v.Expression, activation); err == nil {
+			variables[v.Name] = value
+		}
+	}
+	for _, v := range admissionPolicyValidations {
+		if out, err := eval(v.Expression, activation); err != nil || out != true {
+			return false
+		}
+	}
+	return true
+}
+
+// webhookAdmits runs the validating webhook without a client, as the policy
+// can't read other objects either
+func webhookAdmits(oldGB, gb *webappv1alpha1.GuestBook) bool {
+	validator := &webappv1alpha1.GuestBookCustomValidator{}
+	var err error
+	if oldGB == nil {
+		_, err = validator.ValidateCreate(context.Background(), gb)
+	} else {
+		_, err = validator.ValidateUpdate(context.Background(), oldGB, gb)
+	}
+	return err == nil
+}
+
+// policyGuestBook returns a valid GuestBook with mutate applied
+func policyGuestBook(mutate func(*webappv1alpha1.GuestBook)) *webappv1alpha1.GuestBook {
+	gb := &webappv1alpha1.GuestBook{}
+	gb.Name = "guestbook"
+	gb.Namespace = "default"
+	gb.Spec.Replicas = ptr.To[int32](2)
+	gb.Spec.Backend.Type = webappv1alpha1.BackendInMemory
+	if mutate != nil {
+		mutate(gb)
+	}
+	return gb
+}
+
+func TestAdmissionPolicy(t *testing.T) {
+	minAvailable := func(v intstr.IntOrString) func(*webappv1alpha1.GuestBook) {
+		return func(gb *webappv1alpha1.GuestBook) {
+			gb.Spec.PodDisruptionBudget = &webappv1alpha1.PodDisruptionBudgetSpec{MinAvailable: &v}
+		}
+	}
+	toRedis := func(gb *webappv1alpha1.GuestBook) { gb.Spec.Backend.Type = webappv1alpha1.BackendRedis }
+
+	tests := []struct {
+		name    string
+		old     *webappv1alpha1.GuestBook
+		gb      *webappv1alpha1.GuestBook
+		webhook bool
+		policy  bool
+	}{
+		{name: "valid", gb: policyGuestBook(nil), webhook: true, policy: true},
+		{name: "replicas with autoscaling", gb: policyGuestBook(func(gb *webappv1alpha1.GuestBook) {
+			gb.Spec.Autoscaling = &webappv1alpha1.AutoscalingSpec{MaxReplicas: 3}
+		})},
+		{name: "minReplicas above maxReplicas", gb: policyGuestBook(func(gb *webappv1alpha1.GuestBook) {
+			gb.Spec.Replicas = nil
+			gb.Spec.Autoscaling = &webappv1alpha1.AutoscalingSpec{MinReplicas: ptr.To[int32](4), MaxReplicas: 3}
+		})},
+		{name: "minAvailable below replicas", gb: policyGuestBook(minAvailable(intstr.FromInt32(1))), webhook: true, policy: true},
+		{name: "minAvailable equal to replicas", gb: policyGuestBook(minAvailable(intstr.FromInt32(2)))},
+		{name: "minAvailable percentage rounding down", gb: policyGuestBook(minAvailable(intstr.FromString("50%"))), webhook: true, policy: true},
+		// 60% of 2 replicas rounds up to both of them
+		{name: "minAvailable percentage rounding up", gb: policyGuestBook(minAvailable(intstr.FromString("60%")))},
+		{name: "minAvailable 100%", gb: policyGuestBook(minAvailable(intstr.FromString("100%")))},
+		{name: "maxUnavailable zero", gb: policyGuestBook(func(gb *webappv1alpha1.GuestBook) {
+			gb.Spec.PodDisruptionBudget = &webappv1alpha1.PodDisruptionBudgetSpec{MaxUnavailable: ptr.To(intstr.FromString("0%"))}
+		})},
+		{name: "ingress host without ingress", gb: policyGuestBook(func(gb *webappv1alpha1.GuestBook) {
+			gb.Spec.Ingress.Host = "guestbook.example.com"
+		})},
+		{name: "ingress TLS without host", gb: policyGuestBook(func(gb *webappv1alpha1.GuestBook) {
+			gb.Spec.Ingress.Enabled = true
+			gb.Spec.Ingress.TLSSecretName = "tls"
+		})},
+		{name: "finalBackup without persistence", gb: policyGuestBook(func(gb *webappv1alpha1.GuestBook) {
+			gb.Spec.Persistence.FinalBackup = true
+		})},
+		{name: "backend type change", old: policyGuestBook(nil), gb: policyGuestBook(toRedis)},
+		// The webhook looks the migration up and finds it isn't switching;
+		// the policy can only see the annotation
+		{name: "backend type change with migration annotation", old: policyGuestBook(nil), gb: policyGuestBook(func(gb *webappv1alpha1.GuestBook) {
+			toRedis(gb)
+			gb.Annotations = map[string]string{webappv1alpha1.BackendMigrationAnnotation: "to-redis"}
+		}), webhook: false, policy: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := webhookAdmits(tt.old, tt.gb); got != tt.webhook {
+				t.Errorf("webhook admits = %t, want %t", got, tt.webhook)
+			}
+			if got := policyAdmits(t, tt.old, tt.gb); got != tt.policy {
+				t.Errorf("policy admits = %t, want %t", got, tt.policy)
+			}
+		})
+	}
+}
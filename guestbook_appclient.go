@@ -0,0 +1,302 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	webappv1alpha1 "github.com/yourusername/guestbook-operator/api/v1alpha1"
+)
+
+// appRequestTimeout bounds each call the controller makes to a guestbook
+const appRequestTimeout = 5 * time.Second
+
+// errAppNotFound is returned when the admin API answers 404 Not Found
+var errAppNotFound = errors.New("not found")
+
+// appClient talks to the admin API of a running guestbook through its Service
+type appClient struct {
+	httpClient *http.Client
+	baseURL    string
+
+	// username and password authenticate to an admin API protected by
+	// spec.auth.basicAuthSecretRef; both are empty when it is open
+	username string
+	password string
+}
+
+// newAppClient returns an appClient for the given GuestBook, reading the
+// credentials of a protected admin API from its basic auth Secret. A missing
+// Secret leaves the client without credentials, like the pods it would
+// authenticate to, which wait for the Secret to be mounted.
+func newAppClient(ctx context.Context, reader client.Reader, httpClient *http.Client, gb *webappv1alpha1.GuestBook) (*appClient, error) {
+	if httpClient == nil {
+		var err error
+		if httpClient, err = appHTTPClient(ctx, reader, gb); err != nil {
+			return nil, err
+		}
+	}
+	c := &appClient{
+		httpClient: httpClient,
+		baseURL:    serviceURL(gb),
+	}
+
+	if ref := gb.Spec.Auth.BasicAuthSecretRef; ref != nil {
+		secret := &corev1.Secret{}
+		err := reader.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: gb.Namespace}, secret)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("basic auth secret %q: %w", ref.Name, err)
+		}
+		c.username = string(secret.Data["username"])
+		c.password = string(secret.Data["password"])
+	}
+	return c, nil
+}
+
+// appHTTPClient returns the HTTP client for a GuestBook's admin API. Over
+// TLS it trusts the ca.crt of the serving Secret, since a certificate for
+// the in-cluster Service name comes from a private CA; without one it falls
+// back to the system roots. Keep-alives are off because the client lives
+// for a single reconcile.
+func appHTTPClient(ctx context.Context, reader client.Reader, gb *webappv1alpha1.GuestBook) (*http.Client, error) {
+	if !tlsEnabled(gb) {
+		return &http.Client{Timeout: appRequestTimeout}, nil
+	}
+
+	secret := &corev1.Secret{}
+	err := reader.Get(ctx, types.NamespacedName{Name: tlsSecretName(gb), Namespace: gb.Namespace}, secret)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("TLS secret %q: %w", tlsSecretName(gb), err)
+	}
+	var roots *x509.CertPool
+	if ca := secret.Data["ca.crt"]; len(ca) > 0 {
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("TLS secret %q: ca.crt holds no PEM certificates", tlsSecretName(gb))
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+	transport.DisableKeepAlives = true
+	return &http.Client{Timeout: appRequestTimeout, Transport: transport}, nil
+}
+
+// adminCurlVolumes returns the volumes the containers of adminCurlContainer
+// mount, to be added to their pod
+func adminCurlVolumes(gb *webappv1alpha1.GuestBook) []corev1.Volume {
+	if !tlsEnabled(gb) {
+		return nil
+	}
+	return []corev1.Volume{{
+		Name: "admin-ca",
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: tlsSecretName(gb),
+				Items:      []corev1.KeyToPath{{Key: "ca.crt", Path: "ca.crt"}},
+			},
+		},
+	}}
+}
+
+// adminCurlContainer returns a container running curl against the admin API
+// with args, authenticating with the basic auth Secret when there is one
+// and, over TLS, trusting the serving certificate's CA. The credentials
+// reach curl through the environment, so they never appear in the pod spec.
+// The pod needs adminCurlVolumes.
+func adminCurlContainer(gb *webappv1alpha1.GuestBook, name string, args ...string) corev1.Container {
+	container := corev1.Container{
+		Name:  name,
+		Image: pruneImage,
+		Args:  []string{"-fsS"},
+	}
+	if ref := gb.Spec.Auth.BasicAuthSecretRef; ref != nil {
+		container.Env = []corev1.EnvVar{
+			{Name: "ADMIN_USERNAME", ValueFrom: secretKeyRef(ref.Name, "username")},
+			{Name: "ADMIN_PASSWORD", ValueFrom: secretKeyRef(ref.Name, "password")},
+		}
+		container.Args = append(container.Args, "-u", "$(ADMIN_USERNAME):$(ADMIN_PASSWORD)")
+	}
+	if tlsEnabled(gb) {
+		container.VolumeMounts = []corev1.VolumeMount{{Name: "admin-ca", MountPath: adminCAMountPath, ReadOnly: true}}
+		container.Args = append(container.Args, "--cacert", path.Join(adminCAMountPath, "ca.crt"))
+	}
+	container.Args = append(container.Args, args...)
+	return container
+}
+
+// pendingEntries returns the number of entries waiting in the moderation queue
+func (c *appClient) pendingEntries(ctx context.Context) (int32, error) {
+	var resp struct {
+		Count int32 `json:"count"`
+	}
+	if err := c.getJSON(ctx, "/admin/moderation/pending", &resp); err != nil {
+		return 0, err
+	}
+	return resp.Count, nil
+}
+
+// entryStats summarizes the entries stored by a guestbook
+type entryStats struct {
+	Count         int64      `json:"count"`
+	LastEntryTime *time.Time `json:"lastEntryTime,omitempty"`
+}
+
+// entryStats returns the number of stored entries and when the newest was written
+func (c *appClient) entryStats(ctx context.Context) (*entryStats, error) {
+	stats := &entryStats{}
+	if err := c.getJSON(ctx, "/admin/entries/stats", stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// version returns the version string the guestbook reports for itself
+func (c *appClient) version(ctx context.Context) (string, error) {
+	var resp struct {
+		Version string `json:"version"`
+	}
+	if err := c.getJSON(ctx, "/admin/version", &resp); err != nil {
+		return "", err
+	}
+	return resp.Version, nil
+}
+
+// exportEntries returns every stored entry in the guestbook's export format
+func (c *appClient) exportEntries(ctx context.Context) ([]byte, error) {
+	var data []byte
+	err := c.do(ctx, http.MethodGet, "/admin/entries/export", nil, func(body io.Reader) error {
+		var err error
+		data, err = io.ReadAll(body)
+		return err
+	})
+	return data, err
+}
+
+// importEntries loads entries produced by exportEntries into the guestbook
+func (c *appClient) importEntries(ctx context.Context, data []byte) error {
+	return c.do(ctx, http.MethodPost, "/admin/entries/import", bytes.NewReader(data), nil)
+}
+
+// appEntry is an entry as the admin API stores it
+type appEntry struct {
+	Author    string    `json:"author"`
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// putEntry creates or replaces the entry with the given ID
+func (c *appClient) putEntry(ctx context.Context, id string, entry appEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodPut, "/admin/entries/"+url.PathEscape(id), bytes.NewReader(data), nil)
+}
+
+// deleteEntry removes the entry with the given ID; one that doesn't exist is
+// not an error
+func (c *appClient) deleteEntry(ctx context.Context, id string) error {
+	err := c.do(ctx, http.MethodDelete, "/admin/entries/"+url.PathEscape(id), nil, nil)
+	if errors.Is(err, errAppNotFound) {
+		return nil
+	}
+	return err
+}
+
+// appUser is an admin UI account as the admin API stores it
+type appUser struct {
+	Role     string `json:"role"`
+	Password string `json:"password"`
+}
+
+// putUser creates or replaces the account with the given username
+func (c *appClient) putUser(ctx context.Context, username string, user appUser) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodPut, "/admin/users/"+url.PathEscape(username), bytes.NewReader(data), nil)
+}
+
+// deleteUser removes the account with the given username; one that doesn't
+// exist is not an error
+func (c *appClient) deleteUser(ctx context.Context, username string) error {
+	err := c.do(ctx, http.MethodDelete, "/admin/users/"+url.PathEscape(username), nil, nil)
+	if errors.Is(err, errAppNotFound) {
+		return nil
+	}
+	return err
+}
+
+// getJSON performs a GET against the admin API and decodes the JSON body into out
+func (c *appClient) getJSON(ctx context.Context, path string, out interface{}) error {
+	return c.do(ctx, http.MethodGet, path, nil, func(body io.Reader) error {
+		return json.NewDecoder(body).Decode(out)
+	})
+}
+
+// do sends a request to the admin API and hands a successful response body
+// to read, which may be nil
+func (c *appClient) do(ctx context.Context, method, path string, body io.Reader, read func(io.Reader) error) error {
+	ctx, cancel := context.WithTimeout(ctx, appRequestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.username != "" || c.password != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s %s: %w", method, path, errAppNotFound)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s: unexpected status %s", method, path, resp.Status)
+	}
+	if read == nil {
+		return nil
+	}
+	return read(resp.Body)
+}
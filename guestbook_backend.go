@@ -0,0 +1,534 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	webappv1alpha1 "github.com/yourusername/guestbook-operator/api/v1alpha1"
+)
+
+const (
+	redisImage    = "redis:7-alpine"
+	postgresImage = "postgres:16-alpine"
+)
+
+// backendDialTimeout bounds each connectivity check against a data store
+const backendDialTimeout = 5 * time.Second
+
+// externalSecretKeys must all be present in an external connection Secret
+var externalSecretKeys = webappv1alpha1.ExternalConnectionSecretKeys
+
+// backend provisions the data store behind a GuestBook and describes how the
+// guestbook container connects to it
+type backend interface {
+	// reconcile creates or updates the resources the data store needs
+	reconcile(ctx context.Context, r *GuestBookReconciler, gb *webappv1alpha1.GuestBook) error
+
+	// env returns the environment the guestbook container needs to reach
+	// the data store
+	env(gb *webappv1alpha1.GuestBook) []corev1.EnvVar
+
+	// readiness checks whether the data store can serve the guestbook
+	readiness(ctx context.Context, r *GuestBookReconciler, gb *webappv1alpha1.GuestBook) (backendReadiness, error)
+}
+
+// backendReadiness is the outcome of a readiness check, in the shape of the
+// BackendReady condition
+type backendReadiness struct {
+	ready   bool
+	reason  string
+	message string
+}
+
+// backendReady returns a passing readiness result
+func backendReady(reason, format string, args ...interface{}) backendReadiness {
+	return backendReadiness{ready: true, reason: reason, message: fmt.Sprintf(format, args...)}
+}
+
+// backendNotReady returns a failing readiness result
+func backendNotReady(reason, format string, args ...interface{}) backendReadiness {
+	return backendReadiness{reason: reason, message: fmt.Sprintf(format, args...)}
+}
+
+// backendForGuestBook returns the backend selected by spec.backend.type
+func backendForGuestBook(gb *webappv1alpha1.GuestBook) backend {
+	switch gb.Spec.Backend.Type {
+	case webappv1alpha1.BackendRedis:
+		return redisBackend{}
+	case webappv1alpha1.BackendPostgres:
+		return postgresBackend{}
+	case webappv1alpha1.BackendExternal:
+		return externalBackend{}
+	default:
+		return inMemoryBackend{}
+	}
+}
+
+// inMemoryBackend keeps entries in the guestbook process; nothing is provisioned
+type inMemoryBackend struct{}
+
+func (inMemoryBackend) reconcile(context.Context, *GuestBookReconciler, *webappv1alpha1.GuestBook) error {
+	return nil
+}
+
+func (inMemoryBackend) env(*webappv1alpha1.GuestBook) []corev1.EnvVar {
+	return []corev1.EnvVar{{Name: "GUESTBOOK_BACKEND", Value: string(webappv1alpha1.BackendInMemory)}}
+}
+
+func (inMemoryBackend) readiness(context.Context, *GuestBookReconciler, *webappv1alpha1.GuestBook) (backendReadiness, error) {
+	return backendReady("InMemory", "In-memory backend needs no data store"), nil
+}
+
+// redisBackend runs a password-protected, single-replica Redis StatefulSet
+// with append-only persistence
+type redisBackend struct{}
+
+func (redisBackend) reconcile(ctx context.Context, r *GuestBookReconciler, gb *webappv1alpha1.GuestBook) error {
+	name := gb.Name + "-redis"
+
+	if err := ensureGeneratedSecret(ctx, r, gb, name, "password"); err != nil {
+		return err
+	}
+	if err := r.apply(ctx, redisStatefulSet(gb, name), gb); err != nil {
+		return err
+	}
+	return r.apply(ctx, backendService(gb, name, "redis", 6379), gb)
+}
+
+func (redisBackend) env(gb *webappv1alpha1.GuestBook) []corev1.EnvVar {
+	name := gb.Name + "-redis"
+	return []corev1.EnvVar{
+		{Name: "GUESTBOOK_BACKEND", Value: string(webappv1alpha1.BackendRedis)},
+		{Name: "GUESTBOOK_REDIS_ADDR", Value: name + ":6379"},
+		{Name: "GUESTBOOK_REDIS_PASSWORD", ValueFrom: secretKeyRef(name, "password")},
+		// The kubelet expands $(VAR) references to variables defined above
+		{Name: "GUESTBOOK_REDIS_URL", Value: fmt.Sprintf("redis://:$(GUESTBOOK_REDIS_PASSWORD)@%s:6379/0", name)},
+	}
+}
+
+// readiness waits for the StatefulSet, then authenticates and PINGs Redis
+// through its Service the way the guestbook would
+func (redisBackend) readiness(ctx context.Context, r *GuestBookReconciler, gb *webappv1alpha1.GuestBook) (backendReadiness, error) {
+	name := gb.Name + "-redis"
+	sts := &appsv1.StatefulSet{}
+	err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: gb.Namespace}, sts)
+	if errors.IsNotFound(err) {
+		return backendNotReady("Provisioning", "Redis StatefulSet not created yet"), nil
+	} else if err != nil {
+		return backendReadiness{}, err
+	}
+	if sts.Status.ReadyReplicas < 1 {
+		return backendNotReady("Provisioning", "Redis is starting"), nil
+	}
+
+	secret := &corev1.Secret{}
+	if err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: gb.Namespace}, secret); err != nil {
+		return backendReadiness{}, err
+	}
+
+	address := net.JoinHostPort(serviceHost(gb, name), "6379")
+	if err := pingRedis(ctx, address, string(secret.Data["password"])); err != nil {
+		return backendNotReady("Unreachable", "Redis at %s: %v", address, err), nil
+	}
+	return backendReady("Connected", "Redis at %s answers PING", address), nil
+}
+
+// pingRedis authenticates against the Redis server at address and PINGs it
+func pingRedis(ctx context.Context, address, password string) error {
+	dialer := net.Dialer{Timeout: backendDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(backendDialTimeout)); err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(conn, "AUTH %s\r\nPING\r\n", password); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	for _, want := range []string{"+OK", "+PONG"} {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if got := strings.TrimSpace(line); got != want {
+			return fmt.Errorf("unexpected reply %q", got)
+		}
+	}
+	return nil
+}
+
+// redisStatefulSet creates the Redis StatefulSet for a GuestBook
+func redisStatefulSet(gb *webappv1alpha1.GuestBook, name string) *appsv1.StatefulSet {
+	replicas := int32(1)
+	labels := backendLabels(gb, "redis")
+
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: gb.Namespace,
+			Labels:    labels,
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:    &replicas,
+			ServiceName: name,
+			Selector:    &metav1.LabelSelector{MatchLabels: backendSelectorLabels(gb, "redis")},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:  "redis",
+						Image: redisImage,
+						Args:  []string{"--appendonly", "yes", "--requirepass", "$(REDIS_PASSWORD)"},
+						Env: []corev1.EnvVar{
+							{Name: "REDIS_PASSWORD", ValueFrom: secretKeyRef(name, "password")},
+						},
+						Ports: []corev1.ContainerPort{{Name: "redis", ContainerPort: 6379}},
+						ReadinessProbe: &corev1.Probe{
+							ProbeHandler: corev1.ProbeHandler{
+								TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromString("redis")},
+							},
+							PeriodSeconds: 5,
+						},
+						VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data"}},
+					}},
+				},
+			},
+			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{{
+				ObjectMeta: metav1.ObjectMeta{Name: "data"},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+					Resources: corev1.VolumeResourceRequirements{
+						Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1Gi")},
+					},
+				},
+			}},
+		},
+	}
+}
+
+// postgresBackend runs a single PostgreSQL instance with its own volume and a
+// generated password
+type postgresBackend struct{}
+
+func (postgresBackend) reconcile(ctx context.Context, r *GuestBookReconciler, gb *webappv1alpha1.GuestBook) error {
+	name := gb.Name + "-postgres"
+
+	if err := ensureGeneratedSecret(ctx, r, gb, name, "password"); err != nil {
+		return err
+	}
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name + "-data",
+			Namespace: gb.Namespace,
+			Labels:    labelsForGuestBook(gb.Name),
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1Gi")},
+			},
+		},
+	}
+	if err := ensureCreated(ctx, r, gb, pvc); err != nil {
+		return err
+	}
+
+	container := corev1.Container{
+		Name:  "postgres",
+		Image: postgresImage,
+		Ports: []corev1.ContainerPort{{Name: "postgres", ContainerPort: 5432}},
+		Env: []corev1.EnvVar{
+			{Name: "POSTGRES_DB", Value: "guestbook"},
+			{Name: "POSTGRES_PASSWORD", ValueFrom: secretKeyRef(name, "password")},
+			{Name: "PGDATA", Value: "/var/lib/postgresql/data/pgdata"},
+		},
+		VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/var/lib/postgresql/data"}},
+	}
+	volumes := []corev1.Volume{{
+		Name: "data",
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: pvc.Name},
+		},
+	}}
+
+	if err := r.apply(ctx, backendDeployment(gb, name, container, volumes), gb); err != nil {
+		return err
+	}
+	return r.apply(ctx, backendService(gb, name, "postgres", 5432), gb)
+}
+
+func (postgresBackend) env(gb *webappv1alpha1.GuestBook) []corev1.EnvVar {
+	name := gb.Name + "-postgres"
+	return []corev1.EnvVar{
+		{Name: "GUESTBOOK_BACKEND", Value: string(webappv1alpha1.BackendPostgres)},
+		{Name: "GUESTBOOK_POSTGRES_HOST", Value: name},
+		{Name: "GUESTBOOK_POSTGRES_DB", Value: "guestbook"},
+		{Name: "GUESTBOOK_POSTGRES_USER", Value: "postgres"},
+		{Name: "GUESTBOOK_POSTGRES_PASSWORD", ValueFrom: secretKeyRef(name, "password")},
+	}
+}
+
+// readiness waits for the Deployment, then checks that PostgreSQL accepts
+// connections through its Service
+func (postgresBackend) readiness(ctx context.Context, r *GuestBookReconciler, gb *webappv1alpha1.GuestBook) (backendReadiness, error) {
+	name := gb.Name + "-postgres"
+	deployment := &appsv1.Deployment{}
+	err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: gb.Namespace}, deployment)
+	if errors.IsNotFound(err) {
+		return backendNotReady("Provisioning", "PostgreSQL Deployment not created yet"), nil
+	} else if err != nil {
+		return backendReadiness{}, err
+	}
+	if deployment.Status.AvailableReplicas < 1 {
+		return backendNotReady("Provisioning", "PostgreSQL is starting"), nil
+	}
+
+	address := net.JoinHostPort(serviceHost(gb, name), "5432")
+	if err := probeTCP(ctx, address); err != nil {
+		return backendNotReady("Unreachable", "cannot connect to PostgreSQL at %s: %v", address, err), nil
+	}
+	return backendReady("Connected", "PostgreSQL at %s accepts connections", address), nil
+}
+
+// externalBackend uses an existing database described by a connection Secret.
+// Nothing is provisioned; readiness validates the Secret and checks that the
+// database accepts TCP connections.
+type externalBackend struct{}
+
+func (externalBackend) reconcile(context.Context, *GuestBookReconciler, *webappv1alpha1.GuestBook) error {
+	return nil
+}
+
+func (externalBackend) env(gb *webappv1alpha1.GuestBook) []corev1.EnvVar {
+	ext := gb.Spec.Backend.External
+	if ext == nil {
+		return nil
+	}
+	driver := ext.Driver
+	if driver == "" {
+		driver = "postgres"
+	}
+
+	name := ext.ConnectionSecretRef.Name
+	env := []corev1.EnvVar{{Name: "GUESTBOOK_BACKEND", Value: driver}}
+	for _, key := range externalSecretKeys {
+		env = append(env, corev1.EnvVar{
+			Name:      "GUESTBOOK_DB_" + strings.ToUpper(key),
+			ValueFrom: secretKeyRef(name, key),
+		})
+	}
+	return env
+}
+
+func (externalBackend) readiness(ctx context.Context, r *GuestBookReconciler, gb *webappv1alpha1.GuestBook) (backendReadiness, error) {
+	ext := gb.Spec.Backend.External
+	if ext == nil {
+		return backendNotReady("NotConfigured", "spec.backend.external is not set"), nil
+	}
+
+	secret := &corev1.Secret{}
+	err := r.Get(ctx, types.NamespacedName{Name: ext.ConnectionSecretRef.Name, Namespace: gb.Namespace}, secret)
+	if errors.IsNotFound(err) {
+		return backendNotReady("SecretNotFound", "connection Secret %q not found", ext.ConnectionSecretRef.Name), nil
+	} else if err != nil {
+		return backendReadiness{}, err
+	}
+
+	var missing []string
+	for _, key := range externalSecretKeys {
+		if len(secret.Data[key]) == 0 {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return backendNotReady("SecretInvalid", "connection Secret %q is missing keys: %s", secret.Name, strings.Join(missing, ", ")), nil
+	}
+
+	address := net.JoinHostPort(string(secret.Data["host"]), string(secret.Data["port"]))
+	if err := probeTCP(ctx, address); err != nil {
+		return backendNotReady("Unreachable", "cannot connect to %s: %v", address, err), nil
+	}
+	return backendReady("Connected", "External database at %s is reachable", address), nil
+}
+
+// probeTCP checks that address accepts TCP connections
+func probeTCP(ctx context.Context, address string) error {
+	dialer := net.Dialer{Timeout: backendDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// serviceHost returns the cluster DNS name of a Service in the GuestBook's namespace
+func serviceHost(gb *webappv1alpha1.GuestBook, name string) string {
+	return fmt.Sprintf("%s.%s.svc.cluster.local", name, gb.Namespace)
+}
+
+// isExternalBackend reports whether the GuestBook uses an external database
+func isExternalBackend(gb *webappv1alpha1.GuestBook) bool {
+	return gb.Spec.Backend.Type == webappv1alpha1.BackendExternal
+}
+
+// backendLabels returns the labels for a supporting component of a
+// GuestBook. The app label differs from the guestbook pods so that the
+// guestbook Service, PodDisruptionBudget and NetworkPolicy don't select them.
+func backendLabels(gb *webappv1alpha1.GuestBook, component string) map[string]string {
+	labels := backendSelectorLabels(gb, component)
+	labels[managedByLabel] = managedByValue
+	return labels
+}
+
+// backendSelectorLabels returns the labels that select a supporting
+// component's pods; see selectorLabelsForGuestBook for why they are fixed
+func backendSelectorLabels(gb *webappv1alpha1.GuestBook, component string) map[string]string {
+	labels := selectorLabelsForGuestBook(gb.Name)
+	labels["app"] = "guestbook-" + component
+	labels["component"] = component
+	return labels
+}
+
+// backendDeployment creates a single-replica Deployment for a data store.
+// Recreate avoids two instances sharing a volume during rollouts.
+func backendDeployment(gb *webappv1alpha1.GuestBook, name string, container corev1.Container, volumes []corev1.Volume) *appsv1.Deployment {
+	replicas := int32(1)
+	labels := backendLabels(gb, container.Name)
+
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: gb.Namespace,
+			Labels:    labels,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: backendSelectorLabels(gb, container.Name)},
+			Strategy: appsv1.DeploymentStrategy{Type: appsv1.RecreateDeploymentStrategyType},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{container},
+					Volumes:    volumes,
+				},
+			},
+		},
+	}
+}
+
+// backendService creates a ClusterIP Service for a data store
+func backendService(gb *webappv1alpha1.GuestBook, name, component string, port int32) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: gb.Namespace,
+			Labels:    backendLabels(gb, component),
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: backendSelectorLabels(gb, component),
+			Ports: []corev1.ServicePort{{
+				Name:     component,
+				Port:     port,
+				Protocol: corev1.ProtocolTCP,
+			}},
+		},
+	}
+}
+
+// secretKeyRef returns an env var source reading key from the named Secret
+func secretKeyRef(name, key string) *corev1.EnvVarSource {
+	return &corev1.EnvVarSource{
+		SecretKeyRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: name},
+			Key:                  key,
+		},
+	}
+}
+
+// ensureGeneratedSecret creates a Secret holding random values for keys. An
+// existing Secret is left alone so credentials survive reconciles.
+func ensureGeneratedSecret(ctx context.Context, r *GuestBookReconciler, gb *webappv1alpha1.GuestBook, name string, keys ...string) error {
+	data := map[string][]byte{}
+	for _, key := range keys {
+		buf := make([]byte, 16)
+		if _, err := rand.Read(buf); err != nil {
+			return err
+		}
+		data[key] = []byte(hex.EncodeToString(buf))
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: gb.Namespace,
+			Labels:    labelsForGuestBook(gb.Name),
+		},
+		Data: data,
+	}
+	return ensureCreated(ctx, r, gb, secret)
+}
+
+// ensureCreated creates obj owned by the GuestBook if it doesn't exist yet and
+// never updates it afterwards
+func ensureCreated(ctx context.Context, r *GuestBookReconciler, gb *webappv1alpha1.GuestBook, obj client.Object) error {
+	if err := ctrl.SetControllerReference(gb, obj, r.Scheme); err != nil {
+		return err
+	}
+	gvk, err := apiutil.GVKForObject(obj, r.Scheme)
+	if err != nil {
+		return err
+	}
+	markDesired(ctx, gvk.Kind, obj.GetName())
+
+	found := obj.DeepCopyObject().(client.Object)
+	err = r.Get(ctx, types.NamespacedName{Name: obj.GetName(), Namespace: obj.GetNamespace()}, found)
+	if err == nil || !errors.IsNotFound(err) {
+		return err
+	}
+
+	log.FromContext(ctx).Info("Creating resource", "kind", fmt.Sprintf("%T", obj), "name", obj.GetName())
+	if err := r.Create(ctx, obj); err != nil {
+		return err
+	}
+	r.expectations.expectCreate(client.ObjectKeyFromObject(gb), obj)
+	return nil
+}
@@ -0,0 +1,278 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	webappv1alpha1 "github.com/yourusername/guestbook-operator/api/v1alpha1"
+)
+
+// objectStoreImage uploads snapshots to and downloads them from the object store
+const objectStoreImage = "amazon/aws-cli:2.15.0"
+
+// snapshotPath is where a snapshot is staged inside backup and restore pods
+const snapshotPath = "/work/snapshot.json"
+
+// uploadScript uploads the staged snapshot and reports its size and
+// checksum through the termination message, which the controller reads
+const uploadScript = `set -e
+size=$(stat -c %s ` + snapshotPath + `)
+sum=$(sha256sum ` + snapshotPath + ` | cut -d' ' -f1)
+aws s3 cp ` + snapshotPath + ` "$DESTINATION"
+printf '{"sizeBytes":%s,"checksum":"sha256:%s"}' "$size" "$sum" > /dev/termination-log
+`
+
+// snapshotReport is what the upload container writes to its termination message
+type snapshotReport struct {
+	SizeBytes int64  `json:"sizeBytes"`
+	Checksum  string `json:"checksum"`
+}
+
+// BackupReconciler runs a Job per GuestBookBackup that exports the
+// guestbook's entries and uploads them to an object store
+type BackupReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+
+	// Recorder emits events on backups; SetupWithManager fills it in from
+	// the manager when nil
+	Recorder record.EventRecorder
+}
+
+// +kubebuilder:rbac:groups=webapp.example.com,resources=guestbookbackups,verbs=get;list;watch
+// +kubebuilder:rbac:groups=webapp.example.com,resources=guestbookbackups/status,verbs=get;update;patch
+
+// Reconcile starts the backup Job and records its outcome
+func (r *BackupReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	backup := &webappv1alpha1.GuestBookBackup{}
+	if err := r.Get(ctx, req.NamespacedName, backup); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if backup.Status.Phase == webappv1alpha1.BackupCompleted || backup.Status.Phase == webappv1alpha1.BackupFailed {
+		return ctrl.Result{}, nil
+	}
+	base := backup.DeepCopy()
+
+	if err := r.reconcileBackup(ctx, backup); err != nil {
+		log.Error(err, "Failed to reconcile backup")
+		return ctrl.Result{}, err
+	}
+	if backup.Status.Phase != base.Status.Phase {
+		eventType := corev1.EventTypeNormal
+		if backup.Status.Phase == webappv1alpha1.BackupFailed {
+			eventType = corev1.EventTypeWarning
+		}
+		r.Recorder.Event(backup, eventType, "Backup"+string(backup.Status.Phase), backup.Status.Message)
+	}
+	return ctrl.Result{}, r.Status().Patch(ctx, backup, client.MergeFrom(base))
+}
+
+// reconcileBackup advances the backup's status from its Job
+func (r *BackupReconciler) reconcileBackup(ctx context.Context, backup *webappv1alpha1.GuestBookBackup) error {
+	job := &batchv1.Job{}
+	err := r.Get(ctx, types.NamespacedName{Name: backupJobName(backup), Namespace: backup.Namespace}, job)
+	if errors.IsNotFound(err) {
+		return r.startBackup(ctx, backup)
+	} else if err != nil {
+		return err
+	}
+
+	if job.Status.Succeeded > 0 {
+		report, err := r.snapshotReport(ctx, job)
+		if err != nil {
+			return err
+		}
+		now := metav1.Now()
+		backup.Status.SizeBytes = report.SizeBytes
+		backup.Status.Checksum = report.Checksum
+		backup.Status.CompletionTime = &now
+		setBackupPhase(backup, webappv1alpha1.BackupCompleted, "Uploaded %d bytes to %s", report.SizeBytes, backup.Status.Location)
+		return nil
+	}
+	for _, c := range job.Status.Conditions {
+		if c.Type == batchv1.JobFailed && c.Status == corev1.ConditionTrue {
+			now := metav1.Now()
+			backup.Status.CompletionTime = &now
+			setBackupPhase(backup, webappv1alpha1.BackupFailed, "Job %s failed: %s", job.Name, c.Message)
+			return nil
+		}
+	}
+	setBackupPhase(backup, webappv1alpha1.BackupRunning, "Job %s is exporting and uploading the entries", job.Name)
+	return nil
+}
+
+// startBackup creates the backup Job, which is owned by the backup so it is
+// cleaned up with it
+func (r *BackupReconciler) startBackup(ctx context.Context, backup *webappv1alpha1.GuestBookBackup) error {
+	gb := &webappv1alpha1.GuestBook{}
+	err := r.Get(ctx, types.NamespacedName{Name: backup.Spec.GuestBookRef.Name, Namespace: backup.Namespace}, gb)
+	if errors.IsNotFound(err) {
+		now := metav1.Now()
+		backup.Status.CompletionTime = &now
+		setBackupPhase(backup, webappv1alpha1.BackupFailed, "GuestBook %s not found", backup.Spec.GuestBookRef.Name)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	location := snapshotLocation(backup)
+	job := backupJob(backup, gb, location)
+	if err := controllerutil.SetControllerReference(backup, job, r.Scheme); err != nil {
+		return err
+	}
+	if err := r.Create(ctx, job); err != nil && !errors.IsAlreadyExists(err) {
+		return err
+	}
+
+	now := metav1.Now()
+	backup.Status.JobName = job.Name
+	backup.Status.Location = location
+	backup.Status.StartTime = &now
+	setBackupPhase(backup, webappv1alpha1.BackupPending, "Created Job %s", job.Name)
+	return nil
+}
+
+// snapshotReport reads the size and checksum the succeeded pod reported
+func (r *BackupReconciler) snapshotReport(ctx context.Context, job *batchv1.Job) (*snapshotReport, error) {
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods, client.InNamespace(job.Namespace), client.MatchingLabels{"job-name": job.Name}); err != nil {
+		return nil, err
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != corev1.PodSucceeded {
+			continue
+		}
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name != "upload" || status.State.Terminated == nil {
+				continue
+			}
+			report := &snapshotReport{}
+			if err := json.Unmarshal([]byte(status.State.Terminated.Message), report); err != nil {
+				return nil, fmt.Errorf("parsing report of pod %s: %w", pod.Name, err)
+			}
+			return report, nil
+		}
+	}
+	return nil, fmt.Errorf("no succeeded pod of Job %s reported a snapshot", job.Name)
+}
+
+// setBackupPhase moves a backup to phase with a formatted message
+func setBackupPhase(backup *webappv1alpha1.GuestBookBackup, phase webappv1alpha1.BackupPhase, format string, args ...interface{}) {
+	backup.Status.Phase = phase
+	backup.Status.Message = fmt.Sprintf(format, args...)
+}
+
+// backupJobName is the name of a backup's Job
+func backupJobName(backup *webappv1alpha1.GuestBookBackup) string {
+	return backup.Name + "-backup"
+}
+
+// snapshotLocation is the object URL a backup is written to:
+// <prefix><namespace>/<guestbook>/<backup>.json
+func snapshotLocation(backup *webappv1alpha1.GuestBookBackup) string {
+	dest := backup.Spec.Destination
+	key := dest.Prefix + path.Join(backup.Namespace, backup.Spec.GuestBookRef.Name, backup.Name+".json")
+	return fmt.Sprintf("s3://%s/%s", dest.Bucket, key)
+}
+
+// objectStoreEnv configures the AWS CLI for a location
+func objectStoreEnv(dest webappv1alpha1.ObjectStoreLocation) []corev1.EnvVar {
+	var env []corev1.EnvVar
+	if dest.Endpoint != "" {
+		env = append(env, corev1.EnvVar{Name: "AWS_ENDPOINT_URL", Value: dest.Endpoint})
+	}
+	if dest.Region != "" {
+		env = append(env, corev1.EnvVar{Name: "AWS_REGION", Value: dest.Region})
+	}
+	return env
+}
+
+// backupJob exports the entries through the admin API into a scratch
+// volume, then uploads them to the object store
+func backupJob(backup *webappv1alpha1.GuestBookBackup, gb *webappv1alpha1.GuestBook, location string) *batchv1.Job {
+	backoffLimit := int32(3)
+	dest := backup.Spec.Destination
+
+	exportContainer := adminCurlContainer(gb, "export", "-o", snapshotPath, serviceURL(gb)+"/admin/entries/export")
+	exportContainer.VolumeMounts = append(exportContainer.VolumeMounts, corev1.VolumeMount{Name: "work", MountPath: path.Dir(snapshotPath)})
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      backupJobName(backup),
+			Namespace: backup.Namespace,
+			Labels:    labelsForGuestBook(gb.Name),
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: backendLabels(gb, "backup"),
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					InitContainers: []corev1.Container{
+						exportContainer,
+					},
+					Containers: []corev1.Container{
+						{
+							Name:    "upload",
+							Image:   objectStoreImage,
+							Command: []string{"/bin/sh", "-c", uploadScript},
+							Env:     append(objectStoreEnv(dest), corev1.EnvVar{Name: "DESTINATION", Value: location}),
+							EnvFrom: []corev1.EnvFromSource{
+								{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: dest.CredentialsSecretRef}},
+							},
+							VolumeMounts: []corev1.VolumeMount{{Name: "work", MountPath: path.Dir(snapshotPath), ReadOnly: true}},
+						},
+					},
+					Volumes: append(adminCurlVolumes(gb),
+						corev1.Volume{Name: "work", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+					),
+				},
+			},
+		},
+	}
+}
+
+// SetupWithManager sets up the controller with the Manager
+func (r *BackupReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.Recorder == nil {
+		r.Recorder = mgr.GetEventRecorderFor("guestbookbackup-controller")
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&webappv1alpha1.GuestBookBackup{}).
+		Owns(&batchv1.Job{}).
+		Complete(r)
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ObjectStoreLocation is a bucket in an S3-compatible object store
+type ObjectStoreLocation struct {
+	// Bucket is the bucket the snapshot is written to
+	// +kubebuilder:validation:MinLength=1
+	Bucket string `json:"bucket"`
+
+	// Prefix is prepended to the object key, e.g. "guestbooks/"
+	// +optional
+	Prefix string `json:"prefix,omitempty"`
+
+	// Endpoint is the object store URL, for stores other than AWS S3
+	// +optional
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// Region is the region of the bucket
+	// +optional
+	Region string `json:"region,omitempty"`
+
+	// CredentialsSecretRef names a Secret with AWS_ACCESS_KEY_ID and
+	// AWS_SECRET_ACCESS_KEY for the object store
+	CredentialsSecretRef corev1.LocalObjectReference `json:"credentialsSecretRef"`
+}
+
+// GuestBookBackupSpec defines the desired state of GuestBookBackup
+// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="spec is immutable"
+type GuestBookBackupSpec struct {
+	// GuestBookRef is the GuestBook in the same namespace to snapshot
+	GuestBookRef corev1.LocalObjectReference `json:"guestBookRef"`
+
+	// Destination is where the snapshot is stored
+	Destination ObjectStoreLocation `json:"destination"`
+}
+
+// BackupPhase is a coarse summary of where a backup is
+// +kubebuilder:validation:Enum=Pending;Running;Completed;Failed
+type BackupPhase string
+
+const (
+	// BackupPending means the backup Job hasn't started
+	BackupPending BackupPhase = "Pending"
+
+	// BackupRunning means the backup Job is exporting and uploading the entries
+	BackupRunning BackupPhase = "Running"
+
+	// BackupCompleted means the snapshot is in the object store
+	BackupCompleted BackupPhase = "Completed"
+
+	// BackupFailed means the backup stopped; see the message for why
+	BackupFailed BackupPhase = "Failed"
+)
+
+// GuestBookBackupStatus defines the observed state of GuestBookBackup
+type GuestBookBackupStatus struct {
+	// Phase is where the backup is
+	// +optional
+	Phase BackupPhase `json:"phase,omitempty"`
+
+	// Message explains the phase, e.g. why the backup failed
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// JobName is the Job that takes the snapshot
+	// +optional
+	JobName string `json:"jobName,omitempty"`
+
+	// Location is the URL of the snapshot, e.g. "s3://bucket/key"
+	// +optional
+	Location string `json:"location,omitempty"`
+
+	// SizeBytes is the size of the snapshot
+	// +optional
+	SizeBytes int64 `json:"sizeBytes,omitempty"`
+
+	// Checksum is the SHA-256 of the snapshot, as "sha256:<hex>"
+	// +optional
+	Checksum string `json:"checksum,omitempty"`
+
+	// StartTime is when the backup Job was created
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// CompletionTime is when the backup completed or failed
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:shortName=gbb
+// +kubebuilder:printcolumn:name="GuestBook",type=string,JSONPath=`.spec.guestBookRef.name`
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Size",type=integer,JSONPath=`.status.sizeBytes`
+// +kubebuilder:printcolumn:name="Location",type=string,JSONPath=`.status.location`,priority=1
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// GuestBookBackup takes a one-off snapshot of a GuestBook's entries into an
+// object store. The snapshot is the guestbook's entry export, so it works
+// the same for every backend. Deleting the GuestBookBackup doesn't remove the
+// object; deleting its GuestBook does only when the GuestBook's
+// backupCleanupPolicy is Drop. Otherwise expire snapshots with the bucket's
+// lifecycle rules.
+type GuestBookBackup struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   GuestBookBackupSpec   `json:"spec,omitempty"`
+	Status GuestBookBackupStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// GuestBookBackupList contains a list of GuestBookBackup
+type GuestBookBackupList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []GuestBookBackup `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&GuestBookBackup{}, &GuestBookBackupList{})
+}
@@ -0,0 +1,249 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	webappv1alpha1 "github.com/yourusername/guestbook-operator/api/v1alpha1"
+)
+
+// ClusterGuestBookReconciler keeps a GuestBook in every namespace a
+// ClusterGuestBook selects and rolls their status up
+type ClusterGuestBookReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+
+	// Recorder emits events on ClusterGuestBooks; SetupWithManager fills it
+	// in from the manager when nil
+	Recorder record.EventRecorder
+
+	// WatchNamespaces are the namespaces the manager's cache covers; nil
+	// means all of them. GuestBooks are only created in these.
+	WatchNamespaces map[string]bool
+}
+
+// +kubebuilder:rbac:groups=webapp.example.com,resources=clusterguestbooks,verbs=get;list;watch
+// +kubebuilder:rbac:groups=webapp.example.com,resources=clusterguestbooks/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch
+
+// Reconcile applies the template to the selected namespaces, deletes the
+// GuestBooks of namespaces no longer selected and updates the rollup
+func (r *ClusterGuestBookReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	cgb := &webappv1alpha1.ClusterGuestBook{}
+	if err := r.Get(ctx, req.NamespacedName, cgb); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if !cgb.DeletionTimestamp.IsZero() {
+		// Garbage collection removes the GuestBooks through their owner references
+		return ctrl.Result{}, nil
+	}
+	base := cgb.DeepCopy()
+
+	selector, err := metav1.LabelSelectorAsSelector(&cgb.Spec.NamespaceSelector)
+	if err != nil {
+		setClusterGuestBookReady(cgb, metav1.ConditionFalse, "InvalidSelector", err.Error())
+		return ctrl.Result{}, r.Status().Patch(ctx, cgb, client.MergeFrom(base))
+	}
+	namespaces := &corev1.NamespaceList{}
+	if err := r.List(ctx, namespaces, client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	selected := map[string]bool{}
+	instances := make([]webappv1alpha1.ClusterGuestBookInstance, 0, len(namespaces.Items))
+	for _, ns := range namespaces.Items {
+		if !ns.DeletionTimestamp.IsZero() {
+			continue
+		}
+		selected[ns.Name] = true
+		instance, err := r.reconcileInstance(ctx, cgb, ns.Name)
+		if err != nil {
+			log.Error(err, "Failed to apply GuestBook", "namespace", ns.Name)
+			return ctrl.Result{}, err
+		}
+		instances = append(instances, instance)
+	}
+
+	if err := r.pruneInstances(ctx, cgb, selected); err != nil {
+		log.Error(err, "Failed to delete GuestBooks of deselected namespaces")
+		return ctrl.Result{}, err
+	}
+
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Namespace < instances[j].Namespace })
+	var ready int32
+	for _, instance := range instances {
+		if instance.Ready {
+			ready++
+		}
+	}
+	cgb.Status.Instances = instances
+	cgb.Status.Namespaces = int32(len(instances))
+	cgb.Status.ReadyNamespaces = ready
+	cgb.Status.ObservedGeneration = cgb.Generation
+	if len(instances) == 0 {
+		setClusterGuestBookReady(cgb, metav1.ConditionFalse, "NoNamespaces", "No namespaces match the namespace selector")
+	} else if ready == cgb.Status.Namespaces {
+		setClusterGuestBookReady(cgb, metav1.ConditionTrue, "AllReady",
+			fmt.Sprintf("GuestBooks in all %d selected namespaces are ready", ready))
+	} else {
+		setClusterGuestBookReady(cgb, metav1.ConditionFalse, "NotAllReady",
+			fmt.Sprintf("%d of %d selected namespaces have a ready GuestBook", ready, cgb.Status.Namespaces))
+	}
+	return ctrl.Result{}, r.Status().Patch(ctx, cgb, client.MergeFrom(base))
+}
+
+// reconcileInstance applies the template to one namespace and reports the
+// GuestBook there. A GuestBook of the same name that the ClusterGuestBook
+// doesn't own is left alone and reported, and so is a namespace outside the
+// operator's watched namespaces, whose GuestBook it couldn't read back.
+func (r *ClusterGuestBookReconciler) reconcileInstance(ctx context.Context, cgb *webappv1alpha1.ClusterGuestBook, namespace string) (webappv1alpha1.ClusterGuestBookInstance, error) {
+	instance := webappv1alpha1.ClusterGuestBookInstance{Namespace: namespace}
+	if r.WatchNamespaces != nil && !r.WatchNamespaces[namespace] {
+		instance.Message = fmt.Sprintf("Namespace %s is not watched by the operator", namespace)
+		return instance, nil
+	}
+
+	existing := &webappv1alpha1.GuestBook{}
+	found := true
+	if err := r.Get(ctx, types.NamespacedName{Name: cgb.Name, Namespace: namespace}, existing); errors.IsNotFound(err) {
+		found = false
+	} else if err != nil {
+		return instance, err
+	}
+	if found && !metav1.IsControlledBy(existing, cgb) {
+		instance.Message = fmt.Sprintf("GuestBook %s/%s exists and is not managed by this ClusterGuestBook", namespace, cgb.Name)
+		r.Recorder.Event(cgb, corev1.EventTypeWarning, "NameConflict", instance.Message)
+		return instance, nil
+	}
+
+	gb := guestBookForClusterGuestBook(cgb, namespace)
+	if err := ctrl.SetControllerReference(cgb, gb, r.Scheme); err != nil {
+		return instance, err
+	}
+	if err := r.Patch(ctx, gb, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership); err != nil {
+		return instance, err
+	}
+
+	// A freshly created GuestBook has no status yet; the Owns watch brings
+	// us back once its controller reports one
+	instance.Phase = gb.Status.Phase
+	if c := meta.FindStatusCondition(gb.Status.Conditions, conditionReady); c != nil {
+		instance.Ready = c.Status == metav1.ConditionTrue
+		if !instance.Ready {
+			instance.Message = c.Message
+		}
+	}
+	return instance, nil
+}
+
+// pruneInstances deletes the GuestBooks of namespaces the selector no longer picks
+func (r *ClusterGuestBookReconciler) pruneInstances(ctx context.Context, cgb *webappv1alpha1.ClusterGuestBook, selected map[string]bool) error {
+	guestbooks := &webappv1alpha1.GuestBookList{}
+	if err := r.List(ctx, guestbooks, client.MatchingLabels{webappv1alpha1.ClusterGuestBookLabel: cgb.Name}); err != nil {
+		return err
+	}
+	for i := range guestbooks.Items {
+		gb := &guestbooks.Items[i]
+		if selected[gb.Namespace] || !metav1.IsControlledBy(gb, cgb) || !gb.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if err := r.Delete(ctx, gb); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+		r.Recorder.Eventf(cgb, corev1.EventTypeNormal, "Deleted", "Deleted GuestBook %s/%s, its namespace is no longer selected", gb.Namespace, gb.Name)
+	}
+	return nil
+}
+
+// guestBookForClusterGuestBook renders the GuestBook for one namespace
+func guestBookForClusterGuestBook(cgb *webappv1alpha1.ClusterGuestBook, namespace string) *webappv1alpha1.GuestBook {
+	labels := map[string]string{}
+	for k, v := range cgb.Spec.Template.Metadata.Labels {
+		labels[k] = v
+	}
+	labels[webappv1alpha1.ClusterGuestBookLabel] = cgb.Name
+
+	return &webappv1alpha1.GuestBook{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: webappv1alpha1.GroupVersion.String(),
+			Kind:       "GuestBook",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        cgb.Name,
+			Namespace:   namespace,
+			Labels:      labels,
+			Annotations: cgb.Spec.Template.Metadata.Annotations,
+		},
+		Spec: *cgb.Spec.Template.Spec.DeepCopy(),
+	}
+}
+
+// setClusterGuestBookReady sets the Ready condition of a ClusterGuestBook
+func setClusterGuestBookReady(cgb *webappv1alpha1.ClusterGuestBook, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&cgb.Status.Conditions, metav1.Condition{
+		Type:               conditionReady,
+		Status:             status,
+		ObservedGeneration: cgb.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// findClusterGuestBooksForNamespace requeues every ClusterGuestBook when a
+// namespace appears or its labels change, since it may now match a selector
+func (r *ClusterGuestBookReconciler) findClusterGuestBooksForNamespace(ctx context.Context, _ client.Object) []reconcile.Request {
+	cgbs := &webappv1alpha1.ClusterGuestBookList{}
+	if err := r.List(ctx, cgbs); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list ClusterGuestBooks")
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(cgbs.Items))
+	for _, cgb := range cgbs.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: cgb.Name}})
+	}
+	return requests
+}
+
+// SetupWithManager sets up the controller with the Manager
+func (r *ClusterGuestBookReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.Recorder == nil {
+		r.Recorder = mgr.GetEventRecorderFor("clusterguestbook-controller")
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&webappv1alpha1.ClusterGuestBook{}).
+		Owns(&webappv1alpha1.GuestBook{}).
+		Watches(&corev1.Namespace{}, handler.EnqueueRequestsFromMapFunc(r.findClusterGuestBooksForNamespace)).
+		Complete(r)
+}
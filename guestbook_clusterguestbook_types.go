@@ -0,0 +1,121 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ClusterGuestBookLabel is set on each GuestBook a ClusterGuestBook creates,
+// with the ClusterGuestBook's name as the value
+const ClusterGuestBookLabel = "webapp.example.com/cluster-guestbook"
+
+// GuestBookInstanceTemplate is the GuestBook a ClusterGuestBook stamps out
+type GuestBookInstanceTemplate struct {
+	// Labels and annotations added to each GuestBook
+	// +optional
+	Metadata PodTemplateMetadata `json:"metadata,omitempty"`
+
+	// Spec of each GuestBook
+	Spec GuestBookSpec `json:"spec"`
+}
+
+// ClusterGuestBookSpec defines the desired state of ClusterGuestBook
+type ClusterGuestBookSpec struct {
+	// NamespaceSelector picks the namespaces that get a GuestBook; an empty
+	// selector picks every namespace
+	NamespaceSelector metav1.LabelSelector `json:"namespaceSelector"`
+
+	// Template is the GuestBook created in each selected namespace, under
+	// the ClusterGuestBook's name
+	Template GuestBookInstanceTemplate `json:"template"`
+}
+
+// ClusterGuestBookInstance is the state of one GuestBook of a ClusterGuestBook
+type ClusterGuestBookInstance struct {
+	// Namespace of the GuestBook
+	Namespace string `json:"namespace"`
+
+	// Phase of the GuestBook
+	// +optional
+	Phase GuestBookPhase `json:"phase,omitempty"`
+
+	// Ready is true when the GuestBook's Ready condition is True
+	Ready bool `json:"ready"`
+
+	// Message explains why the GuestBook isn't ready or couldn't be created
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// ClusterGuestBookStatus defines the observed state of ClusterGuestBook
+type ClusterGuestBookStatus struct {
+	// ObservedGeneration is the generation last rolled out to the namespaces
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Namespaces is how many namespaces the selector picks
+	Namespaces int32 `json:"namespaces"`
+
+	// ReadyNamespaces is how many of them have a ready GuestBook
+	ReadyNamespaces int32 `json:"readyNamespaces"`
+
+	// Instances reports each GuestBook, sorted by namespace
+	// +listType=map
+	// +listMapKey=namespace
+	// +optional
+	Instances []ClusterGuestBookInstance `json:"instances,omitempty"`
+
+	// Conditions represent the latest observations of the ClusterGuestBook
+	// state; Ready is True when every selected namespace is ready
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:scope=Cluster,shortName=cgb
+// +kubebuilder:printcolumn:name="Namespaces",type=integer,JSONPath=`.status.namespaces`
+// +kubebuilder:printcolumn:name="Ready",type=integer,JSONPath=`.status.readyNamespaces`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// ClusterGuestBook runs an identical GuestBook in every namespace its
+// selector picks, e.g. one per team for demo or staging environments
+type ClusterGuestBook struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ClusterGuestBookSpec   `json:"spec,omitempty"`
+	Status ClusterGuestBookStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ClusterGuestBookList contains a list of ClusterGuestBook
+type ClusterGuestBookList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClusterGuestBook `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ClusterGuestBook{}, &ClusterGuestBookList{})
+}
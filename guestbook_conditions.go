@@ -0,0 +1,180 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	webappv1alpha1 "github.com/yourusername/guestbook-operator/api/v1alpha1"
+)
+
+// Standard condition types. Users script against these (for example
+// `kubectl wait --for=condition=Ready`), so they must not change.
+const (
+	// conditionReady is True when the desired number of replicas serve traffic
+	conditionReady = "Ready"
+	// conditionAvailable is True when the Deployment has minimum availability
+	conditionAvailable = "Available"
+	// conditionProgressing is True while a rollout of the current spec is under way
+	conditionProgressing = "Progressing"
+	// conditionDegraded is True when something keeps the GuestBook from its
+	// desired state
+	conditionDegraded = "Degraded"
+)
+
+// Reasons for the standard conditions
+const (
+	reasonDeploymentReady            = "DeploymentReady"
+	reasonDeploymentNotReady         = "DeploymentNotReady"
+	reasonDeploymentNotFound         = "DeploymentNotFound"
+	reasonMinimumReplicasAvailable   = "MinimumReplicasAvailable"
+	reasonMinimumReplicasUnavailable = "MinimumReplicasUnavailable"
+	reasonRollingOut                 = "RollingOut"
+	reasonRolloutComplete            = "RolloutComplete"
+	reasonRolloutHeld                = "RolloutHeld"
+	reasonProgressDeadlineExceeded   = "ProgressDeadlineExceeded"
+	reasonBackendNotReady            = "BackendNotReady"
+	reasonImagePullSecretsMissing    = "ImagePullSecretsMissing"
+	reasonReplicasUnavailable        = "ReplicasUnavailable"
+	reasonAsExpected                 = "AsExpected"
+	reasonSuspended                  = "Suspended"
+)
+
+// setCondition records a condition against the current generation. It
+// reports whether anything changed.
+func setCondition(gb *webappv1alpha1.GuestBook, conditionType string, status metav1.ConditionStatus, reason, message string) bool {
+	return meta.SetStatusCondition(&gb.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: gb.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// setWorkloadConditions derives Ready, Available, Progressing and Degraded
+// from the Deployment and the dependency conditions already recorded. d is
+// nil when the Deployment doesn't exist yet.
+func setWorkloadConditions(gb *webappv1alpha1.GuestBook, d *appsv1.Deployment) {
+	// Compare against the Deployment's replica count, which the autoscaler
+	// may have changed
+	wantReplicas := desiredReplicas(gb)
+	var available int32
+	if d != nil {
+		if d.Spec.Replicas != nil {
+			wantReplicas = *d.Spec.Replicas
+		}
+		available = d.Status.AvailableReplicas
+	}
+	replicasMessage := fmt.Sprintf("%d/%d replicas available", available, wantReplicas)
+
+	var deadline *appsv1.DeploymentCondition
+	if c := deploymentCondition(d, appsv1.DeploymentProgressing); c != nil &&
+		c.Status == corev1.ConditionFalse && c.Reason == "ProgressDeadlineExceeded" {
+		deadline = c
+	}
+
+	switch {
+	case d == nil:
+		setCondition(gb, conditionProgressing, metav1.ConditionFalse, reasonRolloutHeld,
+			"The Deployment is not created until its dependencies are ready")
+	case deadline != nil:
+		setCondition(gb, conditionProgressing, metav1.ConditionFalse, reasonProgressDeadlineExceeded, deadline.Message)
+	case !rolloutComplete(d):
+		setCondition(gb, conditionProgressing, metav1.ConditionTrue, reasonRollingOut,
+			fmt.Sprintf("%d/%d replicas updated", d.Status.UpdatedReplicas, wantReplicas))
+	default:
+		setCondition(gb, conditionProgressing, metav1.ConditionFalse, reasonRolloutComplete,
+			"The current spec is fully rolled out")
+	}
+
+	if c := deploymentCondition(d, appsv1.DeploymentAvailable); c != nil && c.Status == corev1.ConditionTrue {
+		setCondition(gb, conditionAvailable, metav1.ConditionTrue, reasonMinimumReplicasAvailable, replicasMessage)
+	} else {
+		setCondition(gb, conditionAvailable, metav1.ConditionFalse, reasonMinimumReplicasUnavailable, replicasMessage)
+	}
+
+	// Dependencies come first: they usually explain the symptoms below
+	degradedReason, degradedMessage := "", ""
+	if c := meta.FindStatusCondition(gb.Status.Conditions, "BackendReady"); c != nil && c.Status == metav1.ConditionFalse {
+		degradedReason, degradedMessage = reasonBackendNotReady, c.Message
+	} else if c := meta.FindStatusCondition(gb.Status.Conditions, "ImagePullSecretsReady"); c != nil && c.Status == metav1.ConditionFalse {
+		degradedReason, degradedMessage = reasonImagePullSecretsMissing, c.Message
+	} else if deadline != nil {
+		degradedReason, degradedMessage = reasonProgressDeadlineExceeded, deadline.Message
+	} else if d != nil && rolloutComplete(d) && available < wantReplicas {
+		degradedReason, degradedMessage = reasonReplicasUnavailable, replicasMessage
+	}
+	if degradedReason != "" {
+		setCondition(gb, conditionDegraded, metav1.ConditionTrue, degradedReason, degradedMessage)
+	} else {
+		setCondition(gb, conditionDegraded, metav1.ConditionFalse, reasonAsExpected, "No problems detected")
+	}
+
+	switch {
+	case d == nil:
+		setCondition(gb, conditionReady, metav1.ConditionFalse, reasonDeploymentNotFound, "The Deployment has not been created yet")
+	case degradedReason != "":
+		setCondition(gb, conditionReady, metav1.ConditionFalse, degradedReason, degradedMessage)
+	case available < wantReplicas:
+		setCondition(gb, conditionReady, metav1.ConditionFalse, reasonDeploymentNotReady, replicasMessage)
+	default:
+		setCondition(gb, conditionReady, metav1.ConditionTrue, reasonDeploymentReady, replicasMessage)
+	}
+}
+
+// deploymentCondition returns the Deployment condition of the given type, or
+// nil if d is nil or doesn't report it
+func deploymentCondition(d *appsv1.Deployment, conditionType appsv1.DeploymentConditionType) *appsv1.DeploymentCondition {
+	if d == nil {
+		return nil
+	}
+	for i := range d.Status.Conditions {
+		if d.Status.Conditions[i].Type == conditionType {
+			return &d.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// recordRolloutEvent emits an event when the Progressing condition shows a
+// rollout starting, finishing or getting stuck. previous is the condition
+// before this reconcile, nil if it wasn't set.
+func (r *GuestBookReconciler) recordRolloutEvent(ctx context.Context, gb *webappv1alpha1.GuestBook, previous *metav1.Condition) {
+	current := meta.FindStatusCondition(gb.Status.Conditions, conditionProgressing)
+	if current == nil || (previous != nil && previous.Status == current.Status && previous.Reason == current.Reason) {
+		return
+	}
+
+	switch current.Reason {
+	case reasonRollingOut:
+		r.recorder(ctx).Event(gb, corev1.EventTypeNormal, "RolloutStarted", "Rolling out the current spec")
+	case reasonRolloutComplete:
+		// Only a rollout we saw start is worth announcing as finished
+		if previous != nil && previous.Reason == reasonRollingOut {
+			r.recorder(ctx).Event(gb, corev1.EventTypeNormal, "RolloutCompleted", current.Message)
+		}
+	case reasonProgressDeadlineExceeded:
+		r.recorder(ctx).Event(gb, corev1.EventTypeWarning, "RolloutFailed", current.Message)
+	}
+}
@@ -0,0 +1,2544 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	appsv1ac "k8s.io/client-go/applyconfigurations/apps/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	webappv1alpha1 "github.com/yourusername/guestbook-operator/api/v1alpha1"
+)
+
+// defaultPort is used for the Service and container when the spec leaves
+// port or targetPort unset; it matches the sample frontend image
+const defaultPort int32 = 80
+
+// defaultTLSPort is the Service port used when the guestbook serves TLS
+const defaultTLSPort int32 = 443
+
+// configHashAnnotation is stamped on the pod template so that changes to the
+// rendered ConfigMap, referenced Secrets or templates roll the Deployment
+const configHashAnnotation = "webapp.example.com/config-hash"
+
+// authMountPath is where the basic auth Secret is mounted in the container
+const authMountPath = "/etc/guestbook/auth"
+
+// templatesMountPath is where custom page templates are mounted in the container
+const templatesMountPath = "/etc/guestbook/templates"
+
+// tlsMountPath is where the serving certificate is mounted in the container
+const tlsMountPath = "/etc/guestbook/tls"
+
+// adminCAMountPath is where curl containers find the CA of the serving certificate
+const adminCAMountPath = "/etc/guestbook/admin-ca"
+
+// certificateGVK identifies cert-manager Certificates, which are handled as
+// unstructured objects so the operator does not depend on cert-manager's API
+var certificateGVK = schema.GroupVersionKind{Group: "cert-manager.io", Version: "v1", Kind: "Certificate"}
+
+// nginxLimitRPMAnnotation asks ingress-nginx to rate limit per client IP;
+// other ingress controllers ignore it
+const nginxLimitRPMAnnotation = "nginx.ingress.kubernetes.io/limit-rpm"
+
+// externalDNSHostnameAnnotation tells external-dns which record to publish
+const externalDNSHostnameAnnotation = "external-dns.alpha.kubernetes.io/hostname"
+
+// dnsRetryInterval is how often an unresolved DNS record is rechecked
+const dnsRetryInterval = 30 * time.Second
+
+// addressRetryInterval is how often a load balancer is checked for an address
+const addressRetryInterval = 15 * time.Second
+
+// statsPollInterval is how often the entry stats in status are refreshed;
+// new entries don't touch any watched object
+const statsPollInterval = 5 * time.Minute
+
+// secretRefIndex is the cache index of GuestBooks by referenced Secret name,
+// covering spec.backend.external.connectionSecretRef.name among others
+const secretRefIndex = "spec.secretRefs"
+
+// templateRefIndex is the cache index of GuestBooks by template ConfigMap name
+const templateRefIndex = "spec.templateConfigMapRef.name"
+
+// themeRefIndex is the cache index of GuestBooks by referenced theme, as
+// "<kind>/<name>"
+const themeRefIndex = "spec.themeRef"
+
+// pausedAnnotation set to "true" stops the controller from touching the
+// GuestBook or its children, e.g. during incident response
+const pausedAnnotation = "guestbook.example.com/paused"
+
+// defaultReconcileTimeout bounds a reconcile when ReconcileTimeout is unset
+const defaultReconcileTimeout = 2 * time.Minute
+
+// timeoutRetryInterval is how long to wait after a reconcile timed out
+const timeoutRetryInterval = 30 * time.Second
+
+// fieldManager is the server-side apply field manager for child resources
+const fieldManager = "guestbook-operator"
+
+// pruneImage runs curl against the admin API for the retention CronJob and
+// the backup and restore Jobs
+const pruneImage = "curlimages/curl:8.5.0"
+
+// backendRetryInterval is how often an unready external backend is rechecked
+const backendRetryInterval = 30 * time.Second
+
+// GuestBookReconciler reconciles a GuestBook object
+type GuestBookReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+
+	// HTTPClient is used to query the guestbook admin API; a client with
+	// a short timeout is used when nil
+	HTTPClient *http.Client
+
+	// Resolver checks that requested DNS records exist; net.DefaultResolver
+	// is used when nil
+	Resolver *net.Resolver
+
+	// APIReader reads objects straight from the API server, for those the
+	// cache doesn't know about yet; SetupWithManager fills it in when nil
+	APIReader client.Reader
+
+	// Recorder emits events on GuestBooks; SetupWithManager fills it in
+	// from the manager when nil
+	Recorder record.EventRecorder
+
+	// RateLimiter paces retries of failed reconciles; controller-runtime's
+	// default is used when nil
+	RateLimiter workqueue.TypedRateLimiter[reconcile.Request]
+
+	// MaxConcurrentReconciles is how many GuestBooks are reconciled in
+	// parallel; one at a time when zero
+	MaxConcurrentReconciles int
+
+	// ReconcileTimeout bounds a single reconcile, so a hung dependency can't
+	// hold a worker forever; defaultReconcileTimeout is used when zero
+	ReconcileTimeout time.Duration
+
+	// UsePriorityQueue hands out new and changed GuestBooks ahead of the
+	// initial list after a restart and of resyncs that changed nothing
+	UsePriorityQueue bool
+
+	// expectations holds back reconciles until the cache has seen the
+	// controller's own creates and deletes
+	expectations expectations
+}
+
+// +kubebuilder:rbac:groups=webapp.example.com,resources=guestbooks,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=webapp.example.com,resources=guestbooks/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=webapp.example.com,resources=guestbooks/finalizers,verbs=update
+// +kubebuilder:rbac:groups=webapp.example.com,resources=guestbookthemes;clusterguestbookthemes,verbs=get;list;watch
+// +kubebuilder:rbac:groups=webapp.example.com,resources=guestbooktemplates,verbs=get;list;watch
+// +kubebuilder:rbac:groups=webapp.example.com,resources=moderationpolicies,verbs=get;list;watch
+// +kubebuilder:rbac:groups=webapp.example.com,resources=guestbookbackups,verbs=get;list;watch;delete
+// +kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;delete
+// +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups=core,resources=serviceaccounts,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=networkpolicies,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=autoscaling,resources=horizontalpodautoscalers,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=policy,resources=poddisruptionbudgets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=batch,resources=cronjobs,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;delete
+// +kubebuilder:rbac:groups=cert-manager.io,resources=certificates,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=monitoring.coreos.com,resources=servicemonitors,verbs=get;list;watch;create;update;patch;delete
+
+// Reconcile is the main reconciliation loop
+func (r *GuestBookReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	timeout := r.ReconcileTimeout
+	if timeout == 0 {
+		timeout = defaultReconcileTimeout
+	}
+	ctx, reconcileID := withReconcileID(ctx, req)
+	ctx, span := startReconcileSpan(ctx, req, reconcileID)
+	reconcileCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	result, err := r.reconcileGuestBook(reconcileCtx, req)
+	endSpan(span, err)
+	timedOut := err != nil && reconcileCtx.Err() == context.DeadlineExceeded
+	reconcileDuration.WithLabelValues(reconcileOutcome(result, err, timedOut)).Observe(time.Since(start).Seconds())
+	if err == nil {
+		return result, nil
+	}
+
+	// The reconcile context may be spent, so record the failure on the parent
+	reconcileErrors.WithLabelValues(reconcileErrorReason(err, timedOut)).Inc()
+	r.recordReconcileError(ctx, req.NamespacedName, err, timedOut)
+	if timedOut {
+		// Give the worker back and come back later rather than retrying
+		// straight into whatever hung
+		log.FromContext(ctx).Info("Reconcile timed out", "timeout", timeout.String())
+		return ctrl.Result{RequeueAfter: timeoutRetryInterval}, nil
+	}
+	return result, err
+}
+
+// reconcileGuestBook brings the GuestBook's children in line with its spec
+func (r *GuestBookReconciler) reconcileGuestBook(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	// 1. Fetch the GuestBook instance
+	guestbook := &webappv1alpha1.GuestBook{}
+	fetchCtx, fetchSpan := tracer.Start(ctx, "fetch")
+	err := r.Get(fetchCtx, req.NamespacedName, guestbook)
+	endSpan(fetchSpan, client.IgnoreNotFound(err))
+	if err != nil {
+		if errors.IsNotFound(err) {
+			// Object not found, could have been deleted
+			log.Info("GuestBook resource not found. Ignoring since object must be deleted")
+			r.expectations.forget(req.NamespacedName)
+			return ctrl.Result{}, nil
+		}
+		// Error reading the object - requeue the request
+		log.Error(err, "Failed to get GuestBook")
+		return ctrl.Result{}, err
+	}
+	ctx = withGeneration(ctx, guestbook.Generation)
+	ctx = withStatusBase(ctx, guestbook)
+	log = ctrl.LoggerFrom(ctx)
+
+	// 2. Wait until the cache shows the children created or deleted by
+	// earlier reconciles, so they aren't created or deleted twice
+	cacheSynced, err := r.expectations.satisfied(ctx, r.Client, req.NamespacedName)
+	if err != nil {
+		log.Error(err, "Failed to check cache expectations")
+		return ctrl.Result{}, err
+	}
+	if !cacheSynced {
+		log.V(1).Info("Waiting for the cache to observe earlier writes")
+		return ctrl.Result{RequeueAfter: expectationsRetryInterval}, nil
+	}
+
+	ctx, state := withApplyState(ctx)
+
+	// 3. Do nothing at all while an operator has paused the GuestBook
+	if guestbook.Annotations[pausedAnnotation] == "true" {
+		log.Info("GuestBook is paused, skipping reconciliation", "name", guestbook.Name)
+		if err := r.recordPaused(ctx, guestbook); err != nil {
+			log.Error(err, "Failed to record paused GuestBook")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+
+	// 4. Tear down external resources of a deleted GuestBook, and make sure
+	// a live one carries the finalizer that lets us do so
+	if !guestbook.DeletionTimestamp.IsZero() {
+		return r.reconcileDelete(ctx, guestbook)
+	}
+	if controllerutil.AddFinalizer(guestbook, guestBookFinalizer) {
+		if err := r.Update(ctx, guestbook); err != nil {
+			log.Error(err, "Failed to add finalizer")
+			return ctrl.Result{}, err
+		}
+		setStatusBase(ctx, guestbook)
+	}
+
+	// 5. Merge in the referenced GuestBookTemplate, and stop if it can't
+	// be used rather than roll out a half-configured GuestBook
+	if ok, err := r.applyTemplate(ctx, guestbook); err != nil {
+		log.Error(err, "Failed to apply GuestBookTemplate")
+		return ctrl.Result{}, err
+	} else if !ok {
+		log.Info("GuestBookTemplate unusable, skipping reconciliation", "template", guestbook.Spec.TemplateRef.Name)
+		return ctrl.Result{}, r.patchStatus(ctx, guestbook)
+	}
+
+	// 6. Stop here while suspended, leaving child resources in place
+	if guestbook.Spec.Suspend {
+		log.Info("GuestBook is suspended, skipping reconciliation", "name", guestbook.Name)
+		if err := r.reconcileSuspended(ctx, guestbook); err != nil {
+			log.Error(err, "Failed to reconcile suspended GuestBook")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+
+	log.Info("Reconciling GuestBook", "name", guestbook.Name)
+
+	// 7. Look up the shared theme, which shapes the rendered configuration
+	theme, err := r.resolveTheme(ctx, guestbook)
+	if err != nil {
+		log.Error(err, "Failed to resolve theme")
+		return ctrl.Result{}, err
+	}
+
+	// 8. Create or update the ConfigMap
+	configMap := r.configMapForGuestBook(guestbook, theme)
+	if err := r.apply(ctx, configMap, guestbook); err != nil {
+		log.Error(err, "Failed to apply ConfigMap")
+		return ctrl.Result{}, err
+	}
+
+	// 9. Create or update the compiled moderation policy, which the app
+	// reloads in place
+	policy, err := r.resolveModerationPolicy(ctx, guestbook)
+	if err != nil {
+		log.Error(err, "Failed to resolve moderation policy")
+		return ctrl.Result{}, err
+	}
+	if policy != nil {
+		moderationConfigMap, err := r.moderationConfigMapForGuestBook(guestbook, policy)
+		if err != nil {
+			log.Error(err, "Failed to compile moderation policy")
+			return ctrl.Result{}, err
+		}
+		if err := r.apply(ctx, moderationConfigMap, guestbook); err != nil {
+			log.Error(err, "Failed to apply moderation policy ConfigMap")
+			return ctrl.Result{}, err
+		}
+	}
+
+	// 10. Create or update the ServiceAccount, unless the user brings their own
+	if guestbook.Spec.ServiceAccountName == "" {
+		serviceAccount := r.serviceAccountForGuestBook(guestbook)
+		if err := r.apply(ctx, serviceAccount, guestbook); err != nil {
+			log.Error(err, "Failed to apply ServiceAccount")
+			return ctrl.Result{}, err
+		}
+	}
+
+	// 11. Create the PersistentVolumeClaim, if persistence is enabled
+	if guestbook.Spec.Persistence.Enabled {
+		if err := r.reconcilePVC(ctx, guestbook); err != nil {
+			log.Error(err, "Failed to reconcile PersistentVolumeClaim")
+			return ctrl.Result{}, err
+		}
+	}
+
+	// 12. Provision the data backend and record whether it is ready
+	dataStore := backendForGuestBook(guestbook)
+	if err := dataStore.reconcile(ctx, r, guestbook); err != nil {
+		log.Error(err, "Failed to reconcile data backend", "type", guestbook.Spec.Backend.Type)
+		return ctrl.Result{}, err
+	}
+	backendReady, err := r.setBackendCondition(ctx, guestbook, dataStore)
+	if err != nil {
+		log.Error(err, "Failed to check data backend", "type", guestbook.Spec.Backend.Type)
+		return ctrl.Result{}, err
+	}
+
+	// An external database is outside our control: hold the rollout and
+	// report why, instead of starting pods that would crash-loop
+	if !backendReady && isExternalBackend(guestbook) {
+		log.Info("External backend not ready, holding rollout")
+		deployment := &appsv1.Deployment{}
+		err := r.Get(ctx, types.NamespacedName{Name: guestbook.Name, Namespace: guestbook.Namespace}, deployment)
+		if errors.IsNotFound(err) {
+			deployment = nil
+		} else if err != nil {
+			log.Error(err, "Failed to get Deployment")
+			return ctrl.Result{}, err
+		}
+		setWorkloadConditions(guestbook, deployment)
+		guestbook.Status.Phase = phaseForGuestBook(guestbook, nil)
+		if err := r.patchStatus(ctx, guestbook); err != nil {
+			log.Error(err, "Failed to update GuestBook status")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{RequeueAfter: backendRetryInterval}, nil
+	}
+
+	// 13. Request a serving certificate from cert-manager, if configured
+	if guestbook.Spec.TLS.IssuerRef != nil {
+		certificate := r.certificateForGuestBook(guestbook)
+		if err := r.apply(ctx, certificate, guestbook); err != nil {
+			log.Error(err, "Failed to apply Certificate")
+			return ctrl.Result{}, err
+		}
+	}
+
+	// 14. Create the ServiceMonitor, if monitoring is enabled and the
+	// Prometheus Operator is installed
+	if err := r.reconcileServiceMonitor(ctx, guestbook); err != nil {
+		log.Error(err, "Failed to apply ServiceMonitor")
+		return ctrl.Result{}, err
+	}
+
+	// 15. Check that the image pull secrets exist; pods can still be created
+	// without them, so a missing one is only reported
+	if err := r.setImagePullSecretsCondition(ctx, guestbook); err != nil {
+		log.Error(err, "Failed to check image pull Secrets")
+		return ctrl.Result{}, err
+	}
+
+	// 16. Create or update the Deployment, rolling it when its configuration
+	// inputs change and holding disruptive changes for the maintenance window
+	renderCtx, renderSpan := tracer.Start(ctx, "render config")
+	configHash, err := r.configHash(renderCtx, guestbook, theme)
+	endSpan(renderSpan, err)
+	if err != nil {
+		log.Error(err, "Failed to hash configuration inputs")
+		return ctrl.Result{}, err
+	}
+	guestbook.Status.ConfigHash = configHash
+	deployment := r.deploymentForGuestBook(guestbook, configHash)
+	waitForWindow, err := r.applyMaintenanceWindow(ctx, guestbook, deployment)
+	if err != nil {
+		log.Error(err, "Failed to evaluate maintenance window")
+		return ctrl.Result{}, err
+	}
+	if guestbook.Spec.Autoscaling != nil {
+		if err := r.restoreReplicas(ctx, guestbook); err != nil {
+			log.Error(err, "Failed to restore Deployment replicas")
+			return ctrl.Result{}, err
+		}
+	}
+	if err := r.apply(ctx, deployment, guestbook); err != nil {
+		log.Error(err, "Failed to apply Deployment")
+		return ctrl.Result{}, err
+	}
+
+	// 17. Create or update the Service
+	service := r.serviceForGuestBook(guestbook)
+	if err := r.apply(ctx, service, guestbook); err != nil {
+		log.Error(err, "Failed to apply Service")
+		return ctrl.Result{}, err
+	}
+
+	// 18. Create or update the Ingress, if enabled
+	if guestbook.Spec.Ingress.Enabled {
+		ingress := r.ingressForGuestBook(guestbook)
+		if err := r.apply(ctx, ingress, guestbook); err != nil {
+			log.Error(err, "Failed to apply Ingress")
+			return ctrl.Result{}, err
+		}
+	}
+
+	// 19. Create or update the NetworkPolicy, if enabled
+	if guestbook.Spec.NetworkPolicy.Enabled {
+		networkPolicy := r.networkPolicyForGuestBook(guestbook)
+		if err := r.apply(ctx, networkPolicy, guestbook); err != nil {
+			log.Error(err, "Failed to apply NetworkPolicy")
+			return ctrl.Result{}, err
+		}
+	}
+
+	// 20. Create or update the HorizontalPodAutoscaler, if autoscaling is enabled
+	if guestbook.Spec.Autoscaling != nil {
+		hpa := r.hpaForGuestBook(guestbook)
+		if err := r.apply(ctx, hpa, guestbook); err != nil {
+			log.Error(err, "Failed to apply HorizontalPodAutoscaler")
+			return ctrl.Result{}, err
+		}
+	}
+
+	// 21. Manage the PodDisruptionBudget, which only makes sense with more
+	// than one replica
+	if err := r.reconcilePDB(ctx, guestbook); err != nil {
+		log.Error(err, "Failed to reconcile PodDisruptionBudget")
+		return ctrl.Result{}, err
+	}
+
+	// 22. Create or update the retention CronJob, if pruning is configured
+	if retentionEnabled(guestbook) {
+		cronJob := r.pruneCronJobForGuestBook(guestbook)
+		if err := r.apply(ctx, cronJob, guestbook); err != nil {
+			log.Error(err, "Failed to apply retention CronJob")
+			return ctrl.Result{}, err
+		}
+	}
+
+	// 23. Delete children the spec no longer calls for, unless changes are
+	// being held for the maintenance window and the running pods may still
+	// depend on them
+	if !meta.IsStatusConditionTrue(guestbook.Status.Conditions, "PendingChanges") {
+		if err := r.pruneChildren(ctx, guestbook, state); err != nil {
+			log.Error(err, "Failed to prune child resources")
+			return ctrl.Result{}, err
+		}
+	}
+
+	// 24. Check that the external DNS record has been published
+	dnsReady := r.setDNSCondition(ctx, guestbook)
+
+	// 25. Update status
+	setFieldConflictCondition(guestbook, state.conflicts)
+	addressPending, err := r.updateStatus(ctx, guestbook)
+	if err != nil {
+		log.Error(err, "Failed to update GuestBook status")
+		return ctrl.Result{}, err
+	}
+
+	log.Info("Reconciliation complete")
+
+	// Come back when the window opens to roll out queued changes, or sooner
+	// to look for the DNS record or load balancer address again, and at the
+	// latest to poll the entry stats
+	requeueAfter := soonest(waitForWindow, statsPollInterval)
+	if !dnsReady {
+		requeueAfter = soonest(requeueAfter, dnsRetryInterval)
+	}
+	if addressPending {
+		requeueAfter = soonest(requeueAfter, addressRetryInterval)
+	}
+	return ctrl.Result{RequeueAfter: requeueAfter}, nil
+}
+
+// soonest returns the shorter of two requeue delays, where 0 means none
+func soonest(a, b time.Duration) time.Duration {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// apply server-side applies the desired state of a child resource as the
+// operator's field manager, so fields set by others (the autoscaler, mesh
+// injectors, users) are left alone. When another manager holds a field the
+// spec sets, the conflict is recorded on the GuestBook and the spec wins.
+func (r *GuestBookReconciler) apply(ctx context.Context, obj client.Object, owner *webappv1alpha1.GuestBook) (err error) {
+	log := log.FromContext(ctx)
+
+	// Set GuestBook instance as the owner
+	if err := ctrl.SetControllerReference(owner, obj, r.Scheme); err != nil {
+		return err
+	}
+
+	// Apply needs apiVersion and kind on the object
+	gvk, err := apiutil.GVKForObject(obj, r.Scheme)
+	if err != nil {
+		return err
+	}
+	obj.GetObjectKind().SetGroupVersionKind(gvk)
+	markDesired(ctx, gvk.Kind, obj.GetName())
+
+	hash, err := appliedHash(obj)
+	if err != nil {
+		return err
+	}
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[appliedHashAnnotation] = hash
+	obj.SetAnnotations(annotations)
+
+	ctx, span := tracer.Start(ctx, "apply", childAttributes(gvk.Kind, obj.GetName()))
+	defer func() { endSpan(span, err) }()
+
+	// Look at the existing object, asking the API server directly when the
+	// cache doesn't have it: it may predate the GuestBook and need adopting
+	key := types.NamespacedName{
+		Name:      obj.GetName(),
+		Namespace: obj.GetNamespace(),
+	}
+	found := obj.DeepCopyObject().(client.Object)
+	err = r.Get(ctx, key, found)
+	if errors.IsNotFound(err) {
+		err = r.APIReader.Get(ctx, key, found)
+	}
+	creating := errors.IsNotFound(err)
+	switch {
+	case creating:
+		log.Info("Creating resource", "kind", gvk.Kind, "name", obj.GetName())
+	case err != nil:
+		return err
+	default:
+		if err := r.checkOwnership(ctx, found, obj, owner); err != nil {
+			return err
+		}
+
+		// If the object was last applied from the same desired state, it
+		// needs no write while it still matches, and any difference is a
+		// manual edit. The GuestBook's generation isn't enough to tell:
+		// themes, templates, moderation policies and the maintenance window
+		// change the desired state without touching the spec.
+		if found.GetAnnotations()[appliedHashAnnotation] == hash {
+			same, err := upToDate(found, obj)
+			if err != nil {
+				return err
+			}
+			if same {
+				log.V(1).Info("Resource up to date", "kind", gvk.Kind, "name", obj.GetName())
+				return nil
+			}
+			if fields := driftedFields(found, obj); len(fields) > 0 {
+				log.Info("Correcting drift", "kind", gvk.Kind, "name", obj.GetName(), "fields", fields)
+				r.recorder(ctx).Eventf(owner, corev1.EventTypeWarning, "DriftCorrected",
+					"Reverted manual changes to %s %s: %s", gvk.Kind, obj.GetName(), strings.Join(fields, ", "))
+			}
+		}
+	}
+
+	obj.SetResourceVersion("")
+	obj.SetManagedFields(nil)
+	err = r.Patch(ctx, obj, client.Apply, client.FieldOwner(fieldManager))
+	if errors.IsConflict(err) {
+		log.Info("Taking over conflicting fields", "kind", gvk.Kind, "name", obj.GetName(), "conflict", err.Error())
+		recordApplyConflict(ctx, fmt.Sprintf("%s %s: %v", gvk.Kind, obj.GetName(), err))
+		err = r.Patch(ctx, obj, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership)
+	}
+
+	if err == nil && creating {
+		r.expectations.expectCreate(client.ObjectKeyFromObject(owner), obj)
+	}
+
+	switch {
+	case err != nil && creating:
+		r.recorder(ctx).Eventf(owner, corev1.EventTypeWarning, "CreateFailed", "Failed to create %s %s: %v", gvk.Kind, obj.GetName(), err)
+	case err != nil:
+		r.recorder(ctx).Eventf(owner, corev1.EventTypeWarning, "UpdateFailed", "Failed to update %s %s: %v", gvk.Kind, obj.GetName(), err)
+	case creating:
+		r.recorder(ctx).Eventf(owner, corev1.EventTypeNormal, "Created", "Created %s %s", gvk.Kind, obj.GetName())
+	}
+	return err
+}
+
+// applyState collects what the controller wrote during one reconcile
+type applyState struct {
+	// conflicts describes fields taken over from other field managers
+	conflicts []string
+
+	// desired holds the kind/name of every child the spec still calls for
+	desired map[string]bool
+}
+
+// applyStateKey is the context key of the reconcile's applyState
+type applyStateKey struct{}
+
+// withApplyState returns a context carrying a fresh applyState
+func withApplyState(ctx context.Context) (context.Context, *applyState) {
+	state := &applyState{desired: map[string]bool{}}
+	return context.WithValue(ctx, applyStateKey{}, state), state
+}
+
+// recordApplyConflict adds a conflict to the ones collected for this reconcile
+func recordApplyConflict(ctx context.Context, conflict string) {
+	if state, ok := ctx.Value(applyStateKey{}).(*applyState); ok {
+		state.conflicts = append(state.conflicts, conflict)
+	}
+}
+
+// markDesired records that obj is part of the desired set, so the prune
+// pass keeps it
+func markDesired(ctx context.Context, kind, name string) {
+	if state, ok := ctx.Value(applyStateKey{}).(*applyState); ok {
+		state.desired[kind+"/"+name] = true
+	}
+}
+
+// setFieldConflictCondition records whether applying the children took over
+// fields from another field manager
+func setFieldConflictCondition(gb *webappv1alpha1.GuestBook, conflicts []string) {
+	condition := metav1.Condition{
+		Type:               "FieldConflict",
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: gb.Generation,
+		Reason:             "NoConflicts",
+		Message:            "All child resources applied without conflicts",
+	}
+	if len(conflicts) > 0 {
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "OwnershipForced"
+		condition.Message = "Took over fields set by other managers: " + strings.Join(conflicts, "; ")
+	}
+	meta.SetStatusCondition(&gb.Status.Conditions, condition)
+}
+
+// checkOwnership makes sure an existing child may be updated. An object the
+// GuestBook doesn't control yet is adopted when it carries the labels the
+// controller would give it; one controlled by something else, or unlabeled,
+// is left alone with an error rather than taken over.
+func (r *GuestBookReconciler) checkOwnership(ctx context.Context, found, desired client.Object, owner *webappv1alpha1.GuestBook) error {
+	ref := metav1.GetControllerOf(found)
+	if ref != nil {
+		if ref.UID != owner.UID {
+			return fmt.Errorf("%s %s is controlled by %s %s", kindOf(desired), found.GetName(), ref.Kind, ref.Name)
+		}
+		return nil
+	}
+
+	for k, v := range desired.GetLabels() {
+		if found.GetLabels()[k] != v {
+			return fmt.Errorf("%s %s already exists and is not labeled for GuestBook %s", kindOf(desired), found.GetName(), owner.Name)
+		}
+	}
+
+	log.FromContext(ctx).Info("Adopting resource", "kind", kindOf(desired), "name", found.GetName())
+	r.recorder(ctx).Eventf(owner, corev1.EventTypeNormal, "Adopted", "Adopted existing %s %s", kindOf(desired), found.GetName())
+	return nil
+}
+
+// kindOf returns the kind of an object for use in messages
+func kindOf(obj client.Object) string {
+	if kind := obj.GetObjectKind().GroupVersionKind().Kind; kind != "" {
+		return kind
+	}
+	t := reflect.TypeOf(obj)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+// configMapForGuestBook creates a ConfigMap for the welcome messages and the
+// theme returned by resolveTheme
+func (r *GuestBookReconciler) configMapForGuestBook(gb *webappv1alpha1.GuestBook, theme webappv1alpha1.GuestBookThemeSpec) *corev1.ConfigMap {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      gb.Name + "-config",
+			Namespace: gb.Namespace,
+			Labels:    labelsForGuestBook(gb.Name),
+		},
+		Data: map[string]string{
+			"welcome.txt":        gb.Spec.WelcomeMessage,
+			"theme.colorScheme":  theme.ColorScheme,
+			"theme.bannerImage":  theme.BannerImage,
+			"theme.darkMode":     strconv.FormatBool(theme.DarkMode),
+			"moderation.enabled": strconv.FormatBool(gb.Spec.Moderation.Enabled),
+			"readOnly":           strconv.FormatBool(gb.Spec.ReadOnly),
+		},
+	}
+
+	if rl := gb.Spec.RateLimit; rl != nil {
+		cm.Data["rateLimit.requestsPerMinute"] = strconv.Itoa(int(rl.RequestsPerMinute))
+		cm.Data["rateLimit.burst"] = strconv.Itoa(int(rl.Burst))
+	}
+
+	if cors := gb.Spec.CORS; cors != nil {
+		methods := cors.AllowedMethods
+		if len(methods) == 0 {
+			methods = []string{"GET", "POST"}
+		}
+		cm.Data["cors.allowedOrigins"] = strings.Join(cors.AllowedOrigins, ",")
+		cm.Data["cors.allowedMethods"] = strings.Join(methods, ",")
+	}
+
+	languages := make([]string, 0, len(gb.Spec.WelcomeMessages))
+	for lang, message := range gb.Spec.WelcomeMessages {
+		cm.Data["welcome."+lang+".txt"] = message
+		languages = append(languages, lang)
+	}
+	sort.Strings(languages)
+	cm.Data["welcome.languages"] = strings.Join(languages, ",")
+
+	if gb.Spec.Auth.BasicAuthSecretRef != nil {
+		cm.Data["auth.basicAuthDir"] = authMountPath
+	}
+	if tlsEnabled(gb) {
+		cm.Data["tls.certDir"] = tlsMountPath
+	}
+	if gb.Spec.TemplateConfigMapRef != nil {
+		cm.Data["templates.dir"] = templatesMountPath
+	}
+	if gb.Spec.Moderation.PolicyRef != nil {
+		cm.Data["moderation.policyFile"] = moderationMountPath + "/policy.json"
+	}
+	if gb.Spec.Monitoring.Enabled {
+		cm.Data["metrics.port"] = strconv.Itoa(int(metricsPortForGuestBook(gb)))
+	}
+
+	return cm
+}
+
+// hashConfigData returns a stable hash of ConfigMap data
+func hashConfigData(data map[string]string) string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s=%s\n", k, data[k])
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// serviceAccountForGuestBook creates a dedicated ServiceAccount for the
+// guestbook pods. The app never talks to the API server, so no token is
+// mounted.
+func (r *GuestBookReconciler) serviceAccountForGuestBook(gb *webappv1alpha1.GuestBook) *corev1.ServiceAccount {
+	automount := false
+	return &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      gb.Name,
+			Namespace: gb.Namespace,
+			Labels:    labelsForGuestBook(gb.Name),
+		},
+		AutomountServiceAccountToken: &automount,
+	}
+}
+
+// serviceAccountNameForGuestBook returns the ServiceAccount the pods run as
+func serviceAccountNameForGuestBook(gb *webappv1alpha1.GuestBook) string {
+	if gb.Spec.ServiceAccountName != "" {
+		return gb.Spec.ServiceAccountName
+	}
+	return gb.Name
+}
+
+// deploymentForGuestBook creates a Deployment for the guestbook
+func (r *GuestBookReconciler) deploymentForGuestBook(gb *webappv1alpha1.GuestBook, configHash string) *appsv1.Deployment {
+	labels := labelsForGuestBook(gb.Name)
+
+	// User metadata goes first so selector labels and hash annotations
+	// can't be overridden
+	podLabels := map[string]string{}
+	for k, v := range gb.Spec.PodTemplateMetadata.Labels {
+		podLabels[k] = v
+	}
+	for k, v := range labels {
+		podLabels[k] = v
+	}
+	podAnnotations := map[string]string{}
+	for k, v := range gb.Spec.PodTemplateMetadata.Annotations {
+		podAnnotations[k] = v
+	}
+	podAnnotations[configHashAnnotation] = configHash
+
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      gb.Name,
+			Namespace: gb.Namespace,
+			Labels:    labels,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: selectorLabelsForGuestBook(gb.Name),
+			},
+			Strategy: *gb.Spec.UpdateStrategy.DeepCopy(),
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      podLabels,
+					Annotations: podAnnotations,
+				},
+				Spec: corev1.PodSpec{
+					NodeSelector:              gb.Spec.NodeSelector,
+					Tolerations:               gb.Spec.Tolerations,
+					Affinity:                  gb.Spec.Affinity,
+					SecurityContext:           podSecurityContextForGuestBook(gb),
+					ServiceAccountName:        serviceAccountNameForGuestBook(gb),
+					PriorityClassName:         gb.Spec.PriorityClassName,
+					ImagePullSecrets:          gb.Spec.ImagePullSecrets,
+					TopologySpreadConstraints: topologySpreadForGuestBook(gb),
+					Containers: []corev1.Container{
+						{
+							// Changing the image changes the pod template,
+							// which makes the Deployment roll out new pods
+							Name:            "guestbook",
+							Image:           gb.Spec.Image,
+							ImagePullPolicy: gb.Spec.ImagePullPolicy,
+							Resources:       gb.Spec.Resources,
+							Env:             envForGuestBook(gb),
+							EnvFrom:         gb.Spec.EnvFrom,
+							LivenessProbe:   probeForGuestBook(gb, 10, 10, 3, gb.Spec.Probes.Liveness),
+							ReadinessProbe:  probeForGuestBook(gb, 5, 5, 3, gb.Spec.Probes.Readiness),
+							StartupProbe:    probeForGuestBook(gb, 0, 5, 30, gb.Spec.Probes.Startup),
+							SecurityContext: containerSecurityContextForGuestBook(gb),
+							Ports: []corev1.ContainerPort{
+								{
+									ContainerPort: targetPortForGuestBook(gb),
+									Name:          "http",
+								},
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "config",
+									MountPath: "/config",
+								},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "config",
+							VolumeSource: corev1.VolumeSource{
+								ConfigMap: &corev1.ConfigMapVolumeSource{
+									LocalObjectReference: corev1.LocalObjectReference{
+										Name: gb.Name + "-config",
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	// With autoscaling the HorizontalPodAutoscaler owns the replica count;
+	// leaving it out of the applied configuration keeps us from fighting it
+	if gb.Spec.Autoscaling == nil {
+		replicas := desiredReplicas(gb)
+		deployment.Spec.Replicas = &replicas
+	}
+
+	podSpec := &deployment.Spec.Template.Spec
+
+	if ref := gb.Spec.Auth.BasicAuthSecretRef; ref != nil {
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name: "auth",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: ref.Name,
+				},
+			},
+		})
+		podSpec.Containers[0].VolumeMounts = append(podSpec.Containers[0].VolumeMounts, corev1.VolumeMount{
+			Name:      "auth",
+			MountPath: authMountPath,
+			ReadOnly:  true,
+		})
+	}
+
+	if tlsEnabled(gb) {
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name: "tls",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: tlsSecretName(gb),
+				},
+			},
+		})
+		podSpec.Containers[0].VolumeMounts = append(podSpec.Containers[0].VolumeMounts, corev1.VolumeMount{
+			Name:      "tls",
+			MountPath: tlsMountPath,
+			ReadOnly:  true,
+		})
+	}
+
+	if ref := gb.Spec.TemplateConfigMapRef; ref != nil {
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name: "templates",
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: *ref,
+				},
+			},
+		})
+		podSpec.Containers[0].VolumeMounts = append(podSpec.Containers[0].VolumeMounts, corev1.VolumeMount{
+			Name:      "templates",
+			MountPath: templatesMountPath,
+			ReadOnly:  true,
+		})
+	}
+
+	if gb.Spec.Monitoring.Enabled {
+		podSpec.Containers[0].Ports = append(podSpec.Containers[0].Ports, corev1.ContainerPort{
+			ContainerPort: metricsPortForGuestBook(gb),
+			Name:          "metrics",
+		})
+	}
+
+	if gb.Spec.Moderation.PolicyRef != nil {
+		// Optional, so pods still start while a missing policy has left
+		// the ConfigMap pruned
+		optional := true
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name: "moderation",
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: moderationConfigMapName(gb)},
+					Optional:             &optional,
+				},
+			},
+		})
+		podSpec.Containers[0].VolumeMounts = append(podSpec.Containers[0].VolumeMounts, corev1.VolumeMount{
+			Name:      "moderation",
+			MountPath: moderationMountPath,
+			ReadOnly:  true,
+		})
+	}
+
+	if gb.Spec.Persistence.Enabled {
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name: "data",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: gb.Name + "-data",
+				},
+			},
+		})
+		podSpec.Containers[0].VolumeMounts = append(podSpec.Containers[0].VolumeMounts, corev1.VolumeMount{
+			Name:      "data",
+			MountPath: "/data",
+		})
+	}
+
+	// Sidecars always follow the guestbook container and init containers
+	// keep spec order, so the rendered pod template is stable across reconciles
+	for i := range gb.Spec.Sidecars {
+		podSpec.Containers = append(podSpec.Containers, *gb.Spec.Sidecars[i].DeepCopy())
+	}
+	for i := range gb.Spec.InitContainers {
+		podSpec.InitContainers = append(podSpec.InitContainers, *gb.Spec.InitContainers[i].DeepCopy())
+	}
+
+	return deployment
+}
+
+// envForGuestBook returns the guestbook container environment. User
+// supplied variables come last so they win over generated ones.
+func envForGuestBook(gb *webappv1alpha1.GuestBook) []corev1.EnvVar {
+	env := backendForGuestBook(gb).env(gb)
+
+	level, format := gb.Spec.Logging.Level, gb.Spec.Logging.Format
+	if level == "" {
+		level = "info"
+	}
+	if format == "" {
+		format = "text"
+	}
+	env = append(env,
+		corev1.EnvVar{Name: "GUESTBOOK_LOG_LEVEL", Value: level},
+		corev1.EnvVar{Name: "GUESTBOOK_LOG_FORMAT", Value: format},
+	)
+
+	return append(env, gb.Spec.ExtraEnv...)
+}
+
+// probeForGuestBook returns an HTTP probe against the guestbook port using
+// the given defaults, with any user overrides applied on top
+func probeForGuestBook(gb *webappv1alpha1.GuestBook, initialDelay, period, failureThreshold int32, override *webappv1alpha1.ProbeSettings) *corev1.Probe {
+	scheme := corev1.URISchemeHTTP
+	if tlsEnabled(gb) {
+		scheme = corev1.URISchemeHTTPS
+	}
+
+	probe := &corev1.Probe{
+		ProbeHandler: corev1.ProbeHandler{
+			HTTPGet: &corev1.HTTPGetAction{
+				Path:   "/",
+				Port:   intstr.FromString("http"),
+				Scheme: scheme,
+			},
+		},
+		InitialDelaySeconds: initialDelay,
+		PeriodSeconds:       period,
+		FailureThreshold:    failureThreshold,
+	}
+
+	if override != nil {
+		if override.InitialDelaySeconds != nil {
+			probe.InitialDelaySeconds = *override.InitialDelaySeconds
+		}
+		if override.PeriodSeconds != nil {
+			probe.PeriodSeconds = *override.PeriodSeconds
+		}
+		if override.FailureThreshold != nil {
+			probe.FailureThreshold = *override.FailureThreshold
+		}
+	}
+
+	return probe
+}
+
+// topologySpreadForGuestBook returns the user's spread constraints, or a
+// best-effort zone spread when running more than one replica
+func topologySpreadForGuestBook(gb *webappv1alpha1.GuestBook) []corev1.TopologySpreadConstraint {
+	if len(gb.Spec.TopologySpreadConstraints) > 0 {
+		return gb.Spec.TopologySpreadConstraints
+	}
+	if desiredReplicas(gb) <= 1 && (gb.Spec.Autoscaling == nil || gb.Spec.Autoscaling.MaxReplicas <= 1) {
+		return nil
+	}
+
+	// ScheduleAnyway keeps single-zone clusters schedulable
+	return []corev1.TopologySpreadConstraint{
+		{
+			MaxSkew:           1,
+			TopologyKey:       corev1.LabelTopologyZone,
+			WhenUnsatisfiable: corev1.ScheduleAnyway,
+			LabelSelector: &metav1.LabelSelector{
+				MatchLabels: selectorLabelsForGuestBook(gb.Name),
+			},
+		},
+	}
+}
+
+// podSecurityContextForGuestBook returns the user's pod security context with
+// defaults filled in for anything left unset
+func podSecurityContextForGuestBook(gb *webappv1alpha1.GuestBook) *corev1.PodSecurityContext {
+	sc := &corev1.PodSecurityContext{}
+	if gb.Spec.PodSecurityContext != nil {
+		sc = gb.Spec.PodSecurityContext.DeepCopy()
+	}
+
+	if sc.SeccompProfile == nil {
+		sc.SeccompProfile = &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault}
+	}
+	return sc
+}
+
+// containerSecurityContextForGuestBook returns the user's container security
+// context with defaults filled in for anything left unset. RunAsNonRoot is
+// not defaulted because the sample frontend image runs as root.
+func containerSecurityContextForGuestBook(gb *webappv1alpha1.GuestBook) *corev1.SecurityContext {
+	sc := &corev1.SecurityContext{}
+	if gb.Spec.ContainerSecurityContext != nil {
+		sc = gb.Spec.ContainerSecurityContext.DeepCopy()
+	}
+
+	if sc.AllowPrivilegeEscalation == nil {
+		allowPrivilegeEscalation := false
+		sc.AllowPrivilegeEscalation = &allowPrivilegeEscalation
+	}
+	return sc
+}
+
+// serviceForGuestBook creates a Service for the guestbook
+func (r *GuestBookReconciler) serviceForGuestBook(gb *webappv1alpha1.GuestBook) *corev1.Service {
+	labels := labelsForGuestBook(gb.Name)
+
+	serviceType := gb.Spec.Service.Type
+	if serviceType == "" {
+		serviceType = corev1.ServiceTypeClusterIP
+	}
+
+	// Source ranges are only valid on LoadBalancer Services, so drop them
+	// when switching away from that type
+	var sourceRanges []string
+	if serviceType == corev1.ServiceTypeLoadBalancer {
+		sourceRanges = gb.Spec.Service.LoadBalancerSourceRanges
+	}
+
+	annotations := map[string]string{}
+	if host := gb.Spec.DNS.Hostname; host != "" && !gb.Spec.Ingress.Enabled {
+		annotations[externalDNSHostnameAnnotation] = host
+	}
+	for k, v := range gb.Spec.Service.Annotations {
+		annotations[k] = v
+	}
+
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        gb.Name + "-service",
+			Namespace:   gb.Namespace,
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: selectorLabelsForGuestBook(gb.Name),
+			Ports: []corev1.ServicePort{
+				{
+					Name:       "http",
+					Port:       portForGuestBook(gb),
+					TargetPort: intstr.FromString("http"),
+					Protocol:   corev1.ProtocolTCP,
+				},
+			},
+			// Ports never set a NodePort, so the API server keeps the
+			// allocated one for NodePort/LoadBalancer and releases it when
+			// the type goes back to ClusterIP
+			Type:                     serviceType,
+			LoadBalancerSourceRanges: sourceRanges,
+		},
+	}
+	if gb.Spec.Monitoring.Enabled {
+		service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{
+			Name:       "metrics",
+			Port:       metricsPortForGuestBook(gb),
+			TargetPort: intstr.FromString("metrics"),
+			Protocol:   corev1.ProtocolTCP,
+		})
+	}
+	return service
+}
+
+// pvcForGuestBook creates a PersistentVolumeClaim for guestbook entries
+func (r *GuestBookReconciler) pvcForGuestBook(gb *webappv1alpha1.GuestBook) *corev1.PersistentVolumeClaim {
+	spec := gb.Spec.Persistence
+
+	accessModes := spec.AccessModes
+	if len(accessModes) == 0 {
+		accessModes = []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce}
+	}
+
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      gb.Name + "-data",
+			Namespace: gb.Namespace,
+			Labels:    labelsForGuestBook(gb.Name),
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      accessModes,
+			StorageClassName: spec.StorageClassName,
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: spec.Size,
+				},
+			},
+		},
+	}
+}
+
+// reconcilePVC creates the data PVC. A PVC spec is immutable apart from the
+// storage request, so an existing claim is only updated to grow it.
+func (r *GuestBookReconciler) reconcilePVC(ctx context.Context, gb *webappv1alpha1.GuestBook) error {
+	log := log.FromContext(ctx)
+
+	pvc := r.pvcForGuestBook(gb)
+	if err := ctrl.SetControllerReference(gb, pvc, r.Scheme); err != nil {
+		return err
+	}
+	markDesired(ctx, "PersistentVolumeClaim", pvc.Name)
+
+	found := &corev1.PersistentVolumeClaim{}
+	err := r.Get(ctx, types.NamespacedName{Name: pvc.Name, Namespace: pvc.Namespace}, found)
+	if err != nil && errors.IsNotFound(err) {
+		log.Info("Creating resource", "kind", "PersistentVolumeClaim", "name", pvc.Name)
+		if err := r.Create(ctx, pvc); err != nil {
+			return err
+		}
+		r.expectations.expectCreate(client.ObjectKeyFromObject(gb), pvc)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	desired := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+	current := found.Spec.Resources.Requests[corev1.ResourceStorage]
+	if desired.Cmp(current) <= 0 {
+		return nil
+	}
+
+	log.Info("Expanding PersistentVolumeClaim", "name", pvc.Name, "from", current.String(), "to", desired.String())
+	found.Spec.Resources.Requests[corev1.ResourceStorage] = desired
+	return r.Update(ctx, found)
+}
+
+// certificateForGuestBook creates a cert-manager Certificate for the
+// guestbook Service names
+func (r *GuestBookReconciler) certificateForGuestBook(gb *webappv1alpha1.GuestBook) *unstructured.Unstructured {
+	issuer := gb.Spec.TLS.IssuerRef
+	kind := issuer.Kind
+	if kind == "" {
+		kind = "Issuer"
+	}
+
+	service := gb.Name + "-service"
+	dnsNames := []interface{}{
+		service,
+		fmt.Sprintf("%s.%s.svc", service, gb.Namespace),
+		fmt.Sprintf("%s.%s.svc.cluster.local", service, gb.Namespace),
+	}
+
+	certificate := &unstructured.Unstructured{}
+	certificate.SetGroupVersionKind(certificateGVK)
+	certificate.SetName(gb.Name + "-tls")
+	certificate.SetNamespace(gb.Namespace)
+	certificate.SetLabels(labelsForGuestBook(gb.Name))
+	certificate.Object["spec"] = map[string]interface{}{
+		"secretName": tlsSecretName(gb),
+		"dnsNames":   dnsNames,
+		"issuerRef": map[string]interface{}{
+			"name":  issuer.Name,
+			"kind":  kind,
+			"group": "cert-manager.io",
+		},
+	}
+	return certificate
+}
+
+// tlsEnabled reports whether the guestbook serves HTTPS itself
+func tlsEnabled(gb *webappv1alpha1.GuestBook) bool {
+	return gb.Spec.TLS.SecretRef != nil || gb.Spec.TLS.IssuerRef != nil
+}
+
+// tlsSecretName returns the Secret holding the serving certificate
+func tlsSecretName(gb *webappv1alpha1.GuestBook) string {
+	if ref := gb.Spec.TLS.SecretRef; ref != nil {
+		return ref.Name
+	}
+	return gb.Name + "-tls"
+}
+
+// ingressForGuestBook creates an Ingress routing to the guestbook Service
+func (r *GuestBookReconciler) ingressForGuestBook(gb *webappv1alpha1.GuestBook) *networkingv1.Ingress {
+	pathType := networkingv1.PathTypePrefix
+	spec := gb.Spec.Ingress
+
+	// Throttle at the edge as well as in the app and publish DNS; user
+	// annotations win
+	annotations := map[string]string{}
+	if rl := gb.Spec.RateLimit; rl != nil {
+		annotations[nginxLimitRPMAnnotation] = strconv.Itoa(int(rl.RequestsPerMinute))
+	}
+	if host := gb.Spec.DNS.Hostname; host != "" {
+		annotations[externalDNSHostnameAnnotation] = host
+	}
+	for k, v := range spec.Annotations {
+		annotations[k] = v
+	}
+
+	ingress := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        gb.Name,
+			Namespace:   gb.Namespace,
+			Labels:      labelsForGuestBook(gb.Name),
+			Annotations: annotations,
+		},
+		Spec: networkingv1.IngressSpec{
+			IngressClassName: spec.IngressClassName,
+			Rules: []networkingv1.IngressRule{
+				{
+					Host: spec.Host,
+					IngressRuleValue: networkingv1.IngressRuleValue{
+						HTTP: &networkingv1.HTTPIngressRuleValue{
+							Paths: []networkingv1.HTTPIngressPath{
+								{
+									Path:     "/",
+									PathType: &pathType,
+									Backend: networkingv1.IngressBackend{
+										Service: &networkingv1.IngressServiceBackend{
+											Name: gb.Name + "-service",
+											Port: networkingv1.ServiceBackendPort{
+												Name: "http",
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	if spec.TLSSecretName != "" {
+		tls := networkingv1.IngressTLS{SecretName: spec.TLSSecretName}
+		if spec.Host != "" {
+			tls.Hosts = []string{spec.Host}
+		}
+		ingress.Spec.TLS = []networkingv1.IngressTLS{tls}
+	}
+
+	return ingress
+}
+
+// networkPolicyForGuestBook creates a NetworkPolicy that only admits traffic
+// to the guestbook port
+func (r *GuestBookReconciler) networkPolicyForGuestBook(gb *webappv1alpha1.GuestBook) *networkingv1.NetworkPolicy {
+	protocol := corev1.ProtocolTCP
+	port := intstr.FromInt32(targetPortForGuestBook(gb))
+
+	rule := networkingv1.NetworkPolicyIngressRule{
+		Ports: []networkingv1.NetworkPolicyPort{{Protocol: &protocol, Port: &port}},
+	}
+	if gb.Spec.Monitoring.Enabled {
+		metricsPort := intstr.FromInt32(metricsPortForGuestBook(gb))
+		rule.Ports = append(rule.Ports, networkingv1.NetworkPolicyPort{Protocol: &protocol, Port: &metricsPort})
+	}
+	if len(gb.Spec.NetworkPolicy.From) > 0 {
+		rule.From = append([]networkingv1.NetworkPolicyPeer{{
+			PodSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"guestbook": gb.Name},
+			},
+		}}, gb.Spec.NetworkPolicy.From...)
+	}
+
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      gb.Name,
+			Namespace: gb.Namespace,
+			Labels:    labelsForGuestBook(gb.Name),
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: selectorLabelsForGuestBook(gb.Name),
+			},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+			Ingress:     []networkingv1.NetworkPolicyIngressRule{rule},
+		},
+	}
+}
+
+// hpaForGuestBook creates a HorizontalPodAutoscaler targeting the guestbook
+// Deployment
+func (r *GuestBookReconciler) hpaForGuestBook(gb *webappv1alpha1.GuestBook) *autoscalingv2.HorizontalPodAutoscaler {
+	spec := gb.Spec.Autoscaling
+
+	targetCPU := int32(80)
+	if spec.TargetCPUUtilization != nil {
+		targetCPU = *spec.TargetCPUUtilization
+	}
+
+	return &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      gb.Name,
+			Namespace: gb.Namespace,
+			Labels:    labelsForGuestBook(gb.Name),
+		},
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{
+				APIVersion: "apps/v1",
+				Kind:       "Deployment",
+				Name:       gb.Name,
+			},
+			MinReplicas: spec.MinReplicas,
+			MaxReplicas: spec.MaxReplicas,
+			Metrics: []autoscalingv2.MetricSpec{
+				{
+					Type: autoscalingv2.ResourceMetricSourceType,
+					Resource: &autoscalingv2.ResourceMetricSource{
+						Name: corev1.ResourceCPU,
+						Target: autoscalingv2.MetricTarget{
+							Type:               autoscalingv2.UtilizationMetricType,
+							AverageUtilization: &targetCPU,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// desiredReplicas returns the replica count the GuestBook asks for; with
+// autoscaling this is the starting point before the autoscaler takes over
+func desiredReplicas(gb *webappv1alpha1.GuestBook) int32 {
+	if gb.Spec.Replicas != nil {
+		return *gb.Spec.Replicas
+	}
+	if a := gb.Spec.Autoscaling; a != nil && a.MinReplicas != nil {
+		return *a.MinReplicas
+	}
+	return 1
+}
+
+// pdbForGuestBook creates a PodDisruptionBudget for the guestbook pods
+func (r *GuestBookReconciler) pdbForGuestBook(gb *webappv1alpha1.GuestBook) *policyv1.PodDisruptionBudget {
+	spec := gb.Spec.PodDisruptionBudget
+
+	pdb := &policyv1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      gb.Name,
+			Namespace: gb.Namespace,
+			Labels:    labelsForGuestBook(gb.Name),
+		},
+		Spec: policyv1.PodDisruptionBudgetSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: selectorLabelsForGuestBook(gb.Name),
+			},
+			MinAvailable:   spec.MinAvailable,
+			MaxUnavailable: spec.MaxUnavailable,
+		},
+	}
+	if pdb.Spec.MinAvailable == nil && pdb.Spec.MaxUnavailable == nil {
+		one := intstr.FromInt32(1)
+		pdb.Spec.MaxUnavailable = &one
+	}
+	return pdb
+}
+
+// reconcilePDB applies the PodDisruptionBudget while the GuestBook runs more
+// than one replica, since a budget over a single pod would block node drains.
+// Otherwise the prune pass removes it.
+func (r *GuestBookReconciler) reconcilePDB(ctx context.Context, gb *webappv1alpha1.GuestBook) error {
+	if gb.Spec.PodDisruptionBudget == nil {
+		return nil
+	}
+	if desiredReplicas(gb) > 1 {
+		return r.apply(ctx, r.pdbForGuestBook(gb), gb)
+	}
+	return nil
+}
+
+// pruneCronJobForGuestBook creates a CronJob that prunes old entries through
+// the guestbook's admin API
+func (r *GuestBookReconciler) pruneCronJobForGuestBook(gb *webappv1alpha1.GuestBook) *batchv1.CronJob {
+	retention := gb.Spec.Retention
+
+	query := url.Values{}
+	if retention.MaxEntries != nil {
+		query.Set("maxEntries", strconv.Itoa(int(*retention.MaxEntries)))
+	}
+	if retention.TTL != nil {
+		query.Set("ttl", retention.TTL.Duration.String())
+	}
+	pruneURL := serviceURL(gb) + "/admin/prune?" + query.Encode()
+
+	schedule := retention.Schedule
+	if schedule == "" {
+		schedule = "0 * * * *"
+	}
+
+	return &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      gb.Name + "-prune",
+			Namespace: gb.Namespace,
+			Labels:    labelsForGuestBook(gb.Name),
+		},
+		Spec: batchv1.CronJobSpec{
+			Schedule:          schedule,
+			ConcurrencyPolicy: batchv1.ForbidConcurrent,
+			JobTemplate: batchv1.JobTemplateSpec{
+				Spec: batchv1.JobSpec{
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{
+							Labels: backendLabels(gb, "prune"),
+						},
+						Spec: corev1.PodSpec{
+							RestartPolicy: corev1.RestartPolicyOnFailure,
+							Containers: []corev1.Container{
+								adminCurlContainer(gb, "prune", "-X", "POST", pruneURL),
+							},
+							Volumes: adminCurlVolumes(gb),
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// retentionEnabled reports whether the GuestBook asks for entry pruning
+func retentionEnabled(gb *webappv1alpha1.GuestBook) bool {
+	return gb.Spec.Retention.MaxEntries != nil || gb.Spec.Retention.TTL != nil
+}
+
+// secretNamesForGuestBook returns the names of all Secrets a GuestBook references
+func secretNamesForGuestBook(gb *webappv1alpha1.GuestBook) []string {
+	var names []string
+	if ref := gb.Spec.Auth.BasicAuthSecretRef; ref != nil {
+		names = append(names, ref.Name)
+	}
+	if tlsEnabled(gb) {
+		names = append(names, tlsSecretName(gb))
+	}
+	if ext := gb.Spec.Backend.External; isExternalBackend(gb) && ext != nil {
+		names = append(names, ext.ConnectionSecretRef.Name)
+	}
+	return names
+}
+
+// referencedSecretsHash returns a hash over the data of every Secret the
+// GuestBook references, or "" when it references none. A missing Secret is
+// hashed as empty: pods wait for it to be mounted, and the Secret watch
+// reconciles again once it shows up.
+func (r *GuestBookReconciler) referencedSecretsHash(ctx context.Context, gb *webappv1alpha1.GuestBook) (string, error) {
+	names := secretNamesForGuestBook(gb)
+	if len(names) == 0 {
+		return "", nil
+	}
+
+	data := map[string]string{}
+	for _, name := range names {
+		secret := &corev1.Secret{}
+		err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: gb.Namespace}, secret)
+		if err != nil && !errors.IsNotFound(err) {
+			return "", fmt.Errorf("secret %q: %w", name, err)
+		}
+		for k, v := range secret.Data {
+			data[name+"/"+k] = string(v)
+		}
+	}
+	return hashConfigData(data), nil
+}
+
+// findGuestBooksForSecret maps a Secret to the GuestBooks that reference it
+func (r *GuestBookReconciler) findGuestBooksForSecret(ctx context.Context, secret client.Object) []reconcile.Request {
+	guestbooks := &webappv1alpha1.GuestBookList{}
+	err := r.List(ctx, guestbooks,
+		client.InNamespace(secret.GetNamespace()),
+		client.MatchingFields{secretRefIndex: secret.GetName()})
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list GuestBooks for Secret", "secret", secret.GetName())
+		return nil
+	}
+	return requestsForGuestBooks(guestbooks)
+}
+
+// secretRefsForGuestBook indexes a GuestBook by every Secret it references,
+// including its external backend connection Secret and image pull Secrets
+func secretRefsForGuestBook(obj client.Object) []string {
+	gb := obj.(*webappv1alpha1.GuestBook)
+	names := secretNamesForGuestBook(gb)
+	for _, ref := range gb.Spec.ImagePullSecrets {
+		names = append(names, ref.Name)
+	}
+	return names
+}
+
+// templateRefForGuestBook indexes a GuestBook by its template ConfigMap
+func templateRefForGuestBook(obj client.Object) []string {
+	gb := obj.(*webappv1alpha1.GuestBook)
+	if ref := gb.Spec.TemplateConfigMapRef; ref != nil {
+		return []string{ref.Name}
+	}
+	return nil
+}
+
+// requestsForGuestBooks returns a reconcile request for each GuestBook
+func requestsForGuestBooks(guestbooks *webappv1alpha1.GuestBookList) []reconcile.Request {
+	requests := make([]reconcile.Request, 0, len(guestbooks.Items))
+	for _, gb := range guestbooks.Items {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Name: gb.Name, Namespace: gb.Namespace},
+		})
+	}
+	return requests
+}
+
+// setBackendCondition records the BackendReady condition on the in-memory
+// GuestBook; it is persisted with the next status update
+func (r *GuestBookReconciler) setBackendCondition(ctx context.Context, gb *webappv1alpha1.GuestBook, b backend) (bool, error) {
+	result, err := b.readiness(ctx, r, gb)
+	if err != nil {
+		return false, err
+	}
+
+	condition := metav1.Condition{
+		Type:               "BackendReady",
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: gb.Generation,
+		Reason:             result.reason,
+		Message:            result.message,
+	}
+	if !result.ready {
+		condition.Status = metav1.ConditionFalse
+	}
+	if meta.SetStatusCondition(&gb.Status.Conditions, condition) {
+		switch {
+		case result.ready:
+			r.recorder(ctx).Event(gb, corev1.EventTypeNormal, "BackendReady", result.message)
+		case result.reason == "NotConfigured" || result.reason == "SecretNotFound" || result.reason == "SecretInvalid":
+			r.recorder(ctx).Event(gb, corev1.EventTypeWarning, "InvalidBackendConfig", result.message)
+		default:
+			r.recorder(ctx).Event(gb, corev1.EventTypeWarning, "BackendNotReady", result.message)
+		}
+	}
+	return result.ready, nil
+}
+
+// configHash returns a hash over every input that shapes the guestbook's
+// configuration: the rendered ConfigMap, referenced Secrets and templates
+func (r *GuestBookReconciler) configHash(ctx context.Context, gb *webappv1alpha1.GuestBook, theme webappv1alpha1.GuestBookThemeSpec) (string, error) {
+	secretHash, err := r.referencedSecretsHash(ctx, gb)
+	if err != nil {
+		return "", err
+	}
+	templateHash, err := r.templateConfigMapHash(ctx, gb)
+	if err != nil {
+		return "", err
+	}
+	return hashConfigData(map[string]string{
+		"configmap": hashConfigData(r.configMapForGuestBook(gb, theme).Data),
+		"secrets":   secretHash,
+		"templates": templateHash,
+	}), nil
+}
+
+// templateConfigMapHash returns a hash over the user's template ConfigMap,
+// or "" when none is referenced. A missing ConfigMap hashes as empty, like a
+// missing Secret.
+func (r *GuestBookReconciler) templateConfigMapHash(ctx context.Context, gb *webappv1alpha1.GuestBook) (string, error) {
+	ref := gb.Spec.TemplateConfigMapRef
+	if ref == nil {
+		return "", nil
+	}
+
+	cm := &corev1.ConfigMap{}
+	err := r.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: gb.Namespace}, cm)
+	if err != nil && !errors.IsNotFound(err) {
+		return "", fmt.Errorf("configmap %q: %w", ref.Name, err)
+	}
+	data := map[string]string{}
+	for k, v := range cm.Data {
+		data[k] = v
+	}
+	for k, v := range cm.BinaryData {
+		data[k] = string(v)
+	}
+	return hashConfigData(data), nil
+}
+
+// resolveTheme returns the theme the GuestBook is rendered with and records
+// the ThemeResolved condition. A missing shared theme falls back to
+// spec.theme, so the page keeps working until the theme is created.
+func (r *GuestBookReconciler) resolveTheme(ctx context.Context, gb *webappv1alpha1.GuestBook) (webappv1alpha1.GuestBookThemeSpec, error) {
+	ref := gb.Spec.ThemeRef
+	if ref == nil {
+		meta.RemoveStatusCondition(&gb.Status.Conditions, "ThemeResolved")
+		return gb.Spec.Theme, nil
+	}
+
+	var theme webappv1alpha1.GuestBookThemeSpec
+	var err error
+	kind := themeKind(ref)
+	if kind == "ClusterGuestBookTheme" {
+		clusterTheme := &webappv1alpha1.ClusterGuestBookTheme{}
+		err = r.Get(ctx, types.NamespacedName{Name: ref.Name}, clusterTheme)
+		theme = clusterTheme.Spec
+	} else {
+		namespacedTheme := &webappv1alpha1.GuestBookTheme{}
+		err = r.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: gb.Namespace}, namespacedTheme)
+		theme = namespacedTheme.Spec
+	}
+	if errors.IsNotFound(err) {
+		message := fmt.Sprintf("%s %s not found; using spec.theme", kind, ref.Name)
+		if setCondition(gb, "ThemeResolved", metav1.ConditionFalse, "ThemeNotFound", message) {
+			r.recorder(ctx).Event(gb, corev1.EventTypeWarning, "ThemeNotFound", message)
+		}
+		return gb.Spec.Theme, nil
+	} else if err != nil {
+		return webappv1alpha1.GuestBookThemeSpec{}, fmt.Errorf("%s %q: %w", kind, ref.Name, err)
+	}
+
+	setCondition(gb, "ThemeResolved", metav1.ConditionTrue, "ThemeFound", fmt.Sprintf("Using %s %s", kind, ref.Name))
+	return theme, nil
+}
+
+// themeKind returns the kind a theme reference points at, which defaults to
+// GuestBookTheme
+func themeKind(ref *webappv1alpha1.ThemeReference) string {
+	if ref.Kind == "" {
+		return "GuestBookTheme"
+	}
+	return ref.Kind
+}
+
+// themeRefForGuestBook indexes a GuestBook by the theme it references
+func themeRefForGuestBook(obj client.Object) []string {
+	gb := obj.(*webappv1alpha1.GuestBook)
+	if ref := gb.Spec.ThemeRef; ref != nil {
+		return []string{themeKind(ref) + "/" + ref.Name}
+	}
+	return nil
+}
+
+// findGuestBooksForTheme maps a GuestBookTheme to the GuestBooks in its
+// namespace that use it
+func (r *GuestBookReconciler) findGuestBooksForTheme(ctx context.Context, theme client.Object) []reconcile.Request {
+	guestbooks := &webappv1alpha1.GuestBookList{}
+	err := r.List(ctx, guestbooks,
+		client.InNamespace(theme.GetNamespace()),
+		client.MatchingFields{themeRefIndex: "GuestBookTheme/" + theme.GetName()})
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list GuestBooks for GuestBookTheme", "theme", theme.GetName())
+		return nil
+	}
+	return requestsForGuestBooks(guestbooks)
+}
+
+// findGuestBooksForClusterTheme maps a ClusterGuestBookTheme to the
+// GuestBooks in every namespace that use it
+func (r *GuestBookReconciler) findGuestBooksForClusterTheme(ctx context.Context, theme client.Object) []reconcile.Request {
+	guestbooks := &webappv1alpha1.GuestBookList{}
+	err := r.List(ctx, guestbooks, client.MatchingFields{themeRefIndex: "ClusterGuestBookTheme/" + theme.GetName()})
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list GuestBooks for ClusterGuestBookTheme", "theme", theme.GetName())
+		return nil
+	}
+	return requestsForGuestBooks(guestbooks)
+}
+
+// findGuestBooksForConfigMap maps a ConfigMap to the GuestBooks that use it
+// for templates
+func (r *GuestBookReconciler) findGuestBooksForConfigMap(ctx context.Context, cm client.Object) []reconcile.Request {
+	guestbooks := &webappv1alpha1.GuestBookList{}
+	err := r.List(ctx, guestbooks,
+		client.InNamespace(cm.GetNamespace()),
+		client.MatchingFields{templateRefIndex: cm.GetName()})
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list GuestBooks for ConfigMap", "configMap", cm.GetName())
+		return nil
+	}
+	return requestsForGuestBooks(guestbooks)
+}
+
+// setImagePullSecretsCondition records whether every image pull Secret the
+// GuestBook names exists
+func (r *GuestBookReconciler) setImagePullSecretsCondition(ctx context.Context, gb *webappv1alpha1.GuestBook) error {
+	if len(gb.Spec.ImagePullSecrets) == 0 {
+		meta.RemoveStatusCondition(&gb.Status.Conditions, "ImagePullSecretsReady")
+		return nil
+	}
+
+	var missing []string
+	for _, ref := range gb.Spec.ImagePullSecrets {
+		secret := &corev1.Secret{}
+		err := r.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: gb.Namespace}, secret)
+		if errors.IsNotFound(err) {
+			missing = append(missing, ref.Name)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("secret %q: %w", ref.Name, err)
+		}
+	}
+
+	condition := metav1.Condition{
+		Type:               "ImagePullSecretsReady",
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: gb.Generation,
+		Reason:             "SecretsFound",
+		Message:            "All image pull Secrets exist",
+	}
+	if len(missing) > 0 {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "SecretsMissing"
+		condition.Message = fmt.Sprintf("image pull Secrets not found: %s", strings.Join(missing, ", "))
+	}
+	if meta.SetStatusCondition(&gb.Status.Conditions, condition) && len(missing) > 0 {
+		r.recorder(ctx).Event(gb, corev1.EventTypeWarning, "ImagePullSecretsMissing", condition.Message)
+	}
+	return nil
+}
+
+// updateVersionStatus records the image digest the guestbook pods resolved
+// and the version the app reports. Either is left as last seen when it
+// can't be read yet.
+func (r *GuestBookReconciler) updateVersionStatus(ctx context.Context, gb *webappv1alpha1.GuestBook, app *appClient) error {
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods, client.InNamespace(gb.Namespace), client.MatchingLabels(selectorLabelsForGuestBook(gb.Name))); err != nil {
+		return err
+	}
+
+	version := &webappv1alpha1.GuestBookVersionStatus{}
+	if gb.Status.Version != nil {
+		version = gb.Status.Version.DeepCopy()
+	}
+	for _, pod := range pods.Items {
+		if digest := imageDigest(&pod, "guestbook"); digest != "" {
+			version.ImageDigest = digest
+			break
+		}
+	}
+	if v, err := app.version(ctx); err != nil {
+		log.FromContext(ctx).Info("Unable to read app version", "error", err.Error())
+	} else {
+		version.AppVersion = v
+	}
+	gb.Status.Version = version
+	return nil
+}
+
+// imageDigest returns the digest of the image a pod's container is running,
+// taken from the runtime's image ID, e.g. "docker-pullable://repo@sha256:..."
+func imageDigest(pod *corev1.Pod, container string) string {
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.Name != container || !cs.Ready {
+			continue
+		}
+		if i := strings.LastIndex(cs.ImageID, "@"); i >= 0 {
+			return cs.ImageID[i+1:]
+		}
+	}
+	return ""
+}
+
+// urlForGuestBook returns the address clients should use to reach the
+// guestbook: the published DNS name, the Ingress host or the address its
+// load balancer was given, or else the in-cluster Service name. It reports
+// whether a load balancer address is still being allocated.
+func (r *GuestBookReconciler) urlForGuestBook(ctx context.Context, gb *webappv1alpha1.GuestBook) (string, bool, error) {
+	if host := gb.Spec.DNS.Hostname; host != "" && meta.IsStatusConditionTrue(gb.Status.Conditions, "DNSReady") {
+		return externalURL(gb, host), false, nil
+	}
+
+	if ing := gb.Spec.Ingress; ing.Enabled {
+		if ing.Host != "" {
+			return externalURL(gb, ing.Host), false, nil
+		}
+		ingress := &networkingv1.Ingress{}
+		err := r.Get(ctx, types.NamespacedName{Name: gb.Name, Namespace: gb.Namespace}, ingress)
+		if err != nil && !errors.IsNotFound(err) {
+			return "", false, err
+		}
+		for _, lb := range ingress.Status.LoadBalancer.Ingress {
+			if lb.Hostname != "" {
+				return externalURL(gb, lb.Hostname), false, nil
+			}
+			if lb.IP != "" {
+				return externalURL(gb, lb.IP), false, nil
+			}
+		}
+		return serviceURL(gb), true, nil
+	}
+
+	if gb.Spec.Service.Type == corev1.ServiceTypeLoadBalancer {
+		svc := &corev1.Service{}
+		err := r.Get(ctx, types.NamespacedName{Name: gb.Name + "-service", Namespace: gb.Namespace}, svc)
+		if err != nil && !errors.IsNotFound(err) {
+			return "", false, err
+		}
+		for _, lb := range svc.Status.LoadBalancer.Ingress {
+			if lb.Hostname != "" {
+				return externalURL(gb, lb.Hostname), false, nil
+			}
+			if lb.IP != "" {
+				return externalURL(gb, lb.IP), false, nil
+			}
+		}
+		return serviceURL(gb), true, nil
+	}
+
+	return serviceURL(gb), false, nil
+}
+
+// setDNSCondition records whether the requested DNS hostname resolves yet.
+// It returns true when no hostname is requested.
+func (r *GuestBookReconciler) setDNSCondition(ctx context.Context, gb *webappv1alpha1.GuestBook) bool {
+	host := gb.Spec.DNS.Hostname
+	if host == "" {
+		meta.RemoveStatusCondition(&gb.Status.Conditions, "DNSReady")
+		return true
+	}
+
+	resolver := r.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	condition := metav1.Condition{
+		Type:               "DNSReady",
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: gb.Generation,
+		Reason:             "RecordResolved",
+		Message:            fmt.Sprintf("%s resolves", host),
+	}
+	if _, err := resolver.LookupHost(ctx, host); err != nil {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "RecordNotResolved"
+		condition.Message = fmt.Sprintf("waiting for external-dns to publish %s: %v", host, err)
+	}
+	meta.SetStatusCondition(&gb.Status.Conditions, condition)
+	return condition.Status == metav1.ConditionTrue
+}
+
+// externalURL returns the URL under which the guestbook is reachable at
+// host, which may be a DNS name or an IP address
+func externalURL(gb *webappv1alpha1.GuestBook, host string) string {
+	if strings.Contains(host, ":") {
+		// IPv6 load balancer address
+		host = "[" + host + "]"
+	}
+	if ing := gb.Spec.Ingress; ing.Enabled {
+		if ing.TLSSecretName != "" || tlsEnabled(gb) {
+			return "https://" + host
+		}
+		return "http://" + host
+	}
+
+	scheme, schemePort := "http", defaultPort
+	if tlsEnabled(gb) {
+		scheme, schemePort = "https", defaultTLSPort
+	}
+	if port := portForGuestBook(gb); port != schemePort {
+		return fmt.Sprintf("%s://%s:%d", scheme, host, port)
+	}
+	return fmt.Sprintf("%s://%s", scheme, host)
+}
+
+// recordPaused sets the ReconciliationPaused condition, leaving the rest of
+// the status as last observed
+func (r *GuestBookReconciler) recordPaused(ctx context.Context, gb *webappv1alpha1.GuestBook) error {
+	changed := meta.SetStatusCondition(&gb.Status.Conditions, metav1.Condition{
+		Type:               "ReconciliationPaused",
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: gb.Generation,
+		Reason:             "PausedByAnnotation",
+		Message:            fmt.Sprintf("Reconciliation is paused by the %s annotation", pausedAnnotation),
+	})
+	if !changed {
+		return nil
+	}
+	return r.patchStatus(ctx, gb)
+}
+
+// reconcileSuspended optionally scales the Deployment to zero and records the
+// Suspended condition
+func (r *GuestBookReconciler) reconcileSuspended(ctx context.Context, gb *webappv1alpha1.GuestBook) error {
+	if gb.Spec.ScaleToZeroWhenSuspended {
+		// The autoscaler would scale the Deployment back up, and once it
+		// sees zero replicas it stops scaling altogether. Step 20 recreates
+		// it on resume.
+		if gb.Spec.Autoscaling != nil {
+			hpa := &autoscalingv2.HorizontalPodAutoscaler{ObjectMeta: metav1.ObjectMeta{Name: gb.Name, Namespace: gb.Namespace}}
+			if err := r.Delete(ctx, hpa); err != nil && !errors.IsNotFound(err) {
+				return err
+			}
+		}
+		if err := r.scaleToZero(ctx, gb); err != nil {
+			return err
+		}
+		setCondition(gb, conditionReady, metav1.ConditionFalse, reasonSuspended, "Scaled to zero while suspended")
+		setCondition(gb, conditionAvailable, metav1.ConditionFalse, reasonSuspended, "Scaled to zero while suspended")
+	}
+	setCondition(gb, conditionProgressing, metav1.ConditionFalse, reasonSuspended, "Rollouts are held while suspended")
+
+	meta.SetStatusCondition(&gb.Status.Conditions, metav1.Condition{
+		Type:               "Suspended",
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: gb.Generation,
+		Reason:             "SuspendRequested",
+		Message:            "Reconciliation is suspended by spec.suspend",
+	})
+	gb.Status.ObservedGeneration = gb.Generation
+	recordReconcileSuccess(gb)
+	return r.patchStatus(ctx, gb)
+}
+
+// scaleToZero server-side applies zero replicas to the Deployment. The rest
+// of the applied configuration is the one last applied, extracted from the
+// live object, so that the pod template isn't rolled while suspended.
+func (r *GuestBookReconciler) scaleToZero(ctx context.Context, gb *webappv1alpha1.GuestBook) error {
+	deployment := &appsv1.Deployment{}
+	err := r.Get(ctx, types.NamespacedName{Name: gb.Name, Namespace: gb.Namespace}, deployment)
+	if errors.IsNotFound(err) || (err == nil && ptr.Deref(deployment.Spec.Replicas, 1) == 0) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// The cache strips managed fields, which the extraction needs
+	if err := r.APIReader.Get(ctx, client.ObjectKeyFromObject(deployment), deployment); err != nil {
+		return err
+	}
+	applied, err := appsv1ac.ExtractDeployment(deployment, fieldManager)
+	if err != nil {
+		return err
+	}
+	if applied.Spec == nil {
+		applied.WithSpec(appsv1ac.DeploymentSpec())
+	}
+	applied.Spec.WithReplicas(0)
+	// This isn't the state the hash describes, and resuming shouldn't
+	// count as correcting drift
+	delete(applied.Annotations, appliedHashAnnotation)
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(applied)
+	if err != nil {
+		return err
+	}
+	// The autoscaler or a manual scale may hold the replica count; taking
+	// it over is the point, not a conflict to report
+	return r.Patch(ctx, &unstructured.Unstructured{Object: content}, client.Apply,
+		client.FieldOwner(fieldManager), client.ForceOwnership)
+}
+
+// restoreReplicas brings an autoscaled Deployment that suspension left at
+// zero back to the GuestBook's replica count, for the autoscaler to take
+// over from. It writes an update rather than an apply: the applied
+// configuration leaves replicas out under autoscaling, and would otherwise
+// reset them to the Deployment default.
+func (r *GuestBookReconciler) restoreReplicas(ctx context.Context, gb *webappv1alpha1.GuestBook) error {
+	deployment := &appsv1.Deployment{}
+	err := r.Get(ctx, types.NamespacedName{Name: gb.Name, Namespace: gb.Namespace}, deployment)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if ptr.Deref(deployment.Spec.Replicas, 1) != 0 || desiredReplicas(gb) == 0 {
+		return nil
+	}
+	patch := client.MergeFrom(deployment.DeepCopy())
+	deployment.Spec.Replicas = ptr.To(desiredReplicas(gb))
+	return r.Patch(ctx, deployment, patch, client.FieldOwner(fieldManager))
+}
+
+// updateStatus updates the GuestBook status subresource. It reports whether
+// the guestbook is still waiting for a load balancer address.
+func (r *GuestBookReconciler) updateStatus(ctx context.Context, gb *webappv1alpha1.GuestBook) (bool, error) {
+	// Get the Deployment to check available replicas
+	deployment := &appsv1.Deployment{}
+	err := r.Get(ctx, types.NamespacedName{Name: gb.Name, Namespace: gb.Namespace}, deployment)
+	if errors.IsNotFound(err) {
+		// Created this reconcile and not in the cache yet: report it as not
+		// yet observed, and let the Owns watch bring us back once it is.
+		deployment = &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Generation: 1},
+			Spec:       appsv1.DeploymentSpec{Replicas: ptr.To(desiredReplicas(gb))},
+		}
+	} else if err != nil {
+		return false, err
+	}
+
+	// Update status
+	gb.Status.AvailableReplicas = deployment.Status.AvailableReplicas
+	gb.Status.Replicas = deployment.Status.Replicas
+	gb.Status.Selector = labels.SelectorFromSet(selectorLabelsForGuestBook(gb.Name)).String()
+	gb.Status.ReadyReplicas = deployment.Status.ReadyReplicas
+	gb.Status.UpdatedReplicas = deployment.Status.UpdatedReplicas
+	gb.Status.UnavailableReplicas = deployment.Status.UnavailableReplicas
+	statusURL, addressPending, err := r.urlForGuestBook(ctx, gb)
+	if err != nil {
+		return false, err
+	}
+	gb.Status.URL = statusURL
+	gb.Status.ServiceURL = serviceURL(gb)
+
+	// The app reports its own version and entries. Pods may not be serving
+	// yet; keep the last known values rather than failing reconcile.
+	app, err := newAppClient(ctx, r.Client, r.HTTPClient, gb)
+	if err != nil {
+		return false, err
+	}
+
+	// Only report the image and version once every replica runs them
+	if rolloutComplete(deployment) {
+		gb.Status.Image = deployment.Spec.Template.Spec.Containers[0].Image
+		if err := r.updateVersionStatus(ctx, gb, app); err != nil {
+			return false, err
+		}
+	}
+
+	if retentionEnabled(gb) {
+		cronJob := &batchv1.CronJob{}
+		err := r.Get(ctx, types.NamespacedName{Name: gb.Name + "-prune", Namespace: gb.Namespace}, cronJob)
+		if err != nil && !errors.IsNotFound(err) {
+			return false, err
+		}
+		if err == nil {
+			gb.Status.LastPruneTime = cronJob.Status.LastSuccessfulTime
+		}
+	}
+
+	if stats, err := app.entryStats(ctx); err != nil {
+		log.FromContext(ctx).Info("Unable to read entry stats", "error", err.Error())
+	} else {
+		gb.Status.EntryCount = stats.Count
+		if stats.LastEntryTime != nil {
+			t := metav1.NewTime(*stats.LastEntryTime)
+			gb.Status.LastEntryTime = &t
+		}
+	}
+	if gb.Spec.Moderation.Enabled {
+		pending, err := app.pendingEntries(ctx)
+		if err != nil {
+			log.FromContext(ctx).Info("Unable to read moderation queue", "error", err.Error())
+		} else {
+			gb.Status.PendingEntries = pending
+		}
+	} else {
+		gb.Status.PendingEntries = 0
+	}
+
+	// Update conditions
+	wasProgressing := meta.FindStatusCondition(gb.Status.Conditions, conditionProgressing)
+	if wasProgressing != nil {
+		wasProgressing = wasProgressing.DeepCopy()
+	}
+	setWorkloadConditions(gb, deployment)
+	r.recordRolloutEvent(ctx, gb, wasProgressing)
+
+	readOnly := metav1.Condition{
+		Type:               "ReadOnly",
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: gb.Generation,
+		Reason:             "AcceptingEntries",
+		Message:            "New entries can be submitted",
+	}
+	if gb.Spec.ReadOnly {
+		readOnly.Status = metav1.ConditionTrue
+		readOnly.Reason = "ReadOnlyRequested"
+		readOnly.Message = "New entries are disabled by spec.readOnly"
+	}
+	meta.SetStatusCondition(&gb.Status.Conditions, readOnly)
+	gb.Status.Phase = phaseForGuestBook(gb, deployment)
+
+	meta.SetStatusCondition(&gb.Status.Conditions, metav1.Condition{
+		Type:               "Suspended",
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: gb.Generation,
+		Reason:             "NotSuspended",
+		Message:            "Reconciliation is active",
+	})
+	meta.SetStatusCondition(&gb.Status.Conditions, metav1.Condition{
+		Type:               "ReconciliationPaused",
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: gb.Generation,
+		Reason:             "NotPaused",
+		Message:            "Reconciliation is not paused",
+	})
+
+	// Status now reflects the current spec
+	gb.Status.ObservedGeneration = gb.Generation
+	recordReconcileSuccess(gb)
+	return addressPending, r.patchStatus(ctx, gb)
+}
+
+// statusBaseKey is the context key of the reconcile's statusBase
+type statusBaseKey struct{}
+
+// statusBase holds the GuestBook as it was read at the start of the
+// reconcile, which status patches are computed against
+type statusBase struct {
+	guestbook *webappv1alpha1.GuestBook
+}
+
+// withStatusBase returns a context carrying a snapshot of gb as read
+func withStatusBase(ctx context.Context, gb *webappv1alpha1.GuestBook) context.Context {
+	return context.WithValue(ctx, statusBaseKey{}, &statusBase{guestbook: gb.DeepCopy()})
+}
+
+// setStatusBase replaces the snapshot after a write returned a newer gb
+func setStatusBase(ctx context.Context, gb *webappv1alpha1.GuestBook) {
+	if base, ok := ctx.Value(statusBaseKey{}).(*statusBase); ok {
+		base.guestbook = gb.DeepCopy()
+	}
+}
+
+// patchStatus writes the status of gb as a merge patch against the snapshot
+// taken when gb was read, applying only at that resourceVersion. When the
+// GuestBook changed in between, the status computed here is laid over the
+// latest copy, which becomes the new base, and the patch is retried, so
+// neither side's condition transitions are lost.
+func (r *GuestBookReconciler) patchStatus(ctx context.Context, gb *webappv1alpha1.GuestBook) (err error) {
+	ctx, span := tracer.Start(ctx, "update status")
+	defer func() { endSpan(span, err) }()
+
+	holder, ok := ctx.Value(statusBaseKey{}).(*statusBase)
+	if !ok {
+		return fmt.Errorf("no status base for GuestBook %s", gb.Name)
+	}
+	base := holder.guestbook
+	status := gb.Status.DeepCopy()
+	key := client.ObjectKeyFromObject(gb)
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		err := r.Status().Patch(ctx, gb, client.MergeFromWithOptions(base, client.MergeFromWithOptimisticLock{}))
+		if err == nil {
+			holder.guestbook = gb.DeepCopy()
+			return nil
+		}
+		if !errors.IsConflict(err) {
+			return err
+		}
+
+		// The cache may be what's behind, so read the latest copy directly
+		latest := &webappv1alpha1.GuestBook{}
+		if err := r.APIReader.Get(ctx, key, latest); err != nil {
+			return err
+		}
+		base = latest.DeepCopy()
+		latest.Status = mergeStatus(latest.Status, *status)
+		latest.DeepCopyInto(gb)
+		return err
+	})
+}
+
+// mergeStatus returns the computed status with the conditions set one at a
+// time onto the latest ones, so a condition whose status didn't change keeps
+// its recorded transition time
+func mergeStatus(latest, computed webappv1alpha1.GuestBookStatus) webappv1alpha1.GuestBookStatus {
+	conditions := append([]metav1.Condition(nil), latest.Conditions...)
+	for _, c := range computed.Conditions {
+		meta.SetStatusCondition(&conditions, c)
+	}
+	for _, c := range latest.Conditions {
+		if meta.FindStatusCondition(computed.Conditions, c.Type) == nil {
+			meta.RemoveStatusCondition(&conditions, c.Type)
+		}
+	}
+	computed.Conditions = conditions
+	return computed
+}
+
+// phaseForGuestBook derives the status phase from the conditions and the
+// Deployment's rollout; d is nil when the Deployment hasn't been looked at
+func phaseForGuestBook(gb *webappv1alpha1.GuestBook, d *appsv1.Deployment) webappv1alpha1.GuestBookPhase {
+	conditions := gb.Status.Conditions
+	blocked := meta.IsStatusConditionFalse(conditions, "BackendReady") ||
+		meta.IsStatusConditionFalse(conditions, "ImagePullSecretsReady")
+
+	switch {
+	case !gb.DeletionTimestamp.IsZero():
+		return webappv1alpha1.PhaseTerminating
+	case blocked && gb.Status.AvailableReplicas == 0:
+		return webappv1alpha1.PhasePending
+	case blocked:
+		return webappv1alpha1.PhaseDegraded
+	case d == nil || d.Status.ObservedGeneration < d.Generation ||
+		(d.Spec.Replicas != nil && d.Status.UpdatedReplicas < *d.Spec.Replicas):
+		return webappv1alpha1.PhaseProvisioning
+	case !meta.IsStatusConditionTrue(conditions, conditionReady):
+		return webappv1alpha1.PhaseDegraded
+	}
+	return webappv1alpha1.PhaseReady
+}
+
+// recordReconcileSuccess stamps the reconcile times and clears the last error
+func recordReconcileSuccess(gb *webappv1alpha1.GuestBook) {
+	now := metav1.Now()
+	gb.Status.LastReconcileTime = &now
+	gb.Status.LastSuccessfulReconcileTime = &now
+	gb.Status.LastReconcileError = ""
+	meta.SetStatusCondition(&gb.Status.Conditions, metav1.Condition{
+		Type:               "Reconciled",
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: gb.Generation,
+		Reason:             "ReconcileSucceeded",
+		Message:            "The last reconcile succeeded",
+	})
+}
+
+// recordReconcileError writes a failed reconcile to the GuestBook status on
+// a fresh copy, since the in-memory one may be half-updated. Conflicts are
+// skipped: they are retried right away and don't indicate a problem.
+func (r *GuestBookReconciler) recordReconcileError(ctx context.Context, key types.NamespacedName, reconcileErr error, timedOut bool) {
+	if errors.IsConflict(reconcileErr) {
+		return
+	}
+
+	gb := &webappv1alpha1.GuestBook{}
+	if err := r.Get(ctx, key, gb); err != nil {
+		return
+	}
+	ctx = withStatusBase(ctx, gb)
+	now := metav1.Now()
+	gb.Status.LastReconcileTime = &now
+	gb.Status.LastReconcileError = reconcileErr.Error()
+
+	condition := metav1.Condition{
+		Type:               "Reconciled",
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: gb.Generation,
+		Reason:             "ReconcileFailed",
+		Message:            reconcileErr.Error(),
+	}
+	if timedOut {
+		condition.Reason = "ReconcileTimeout"
+		condition.Message = "Reconcile did not finish in time: " + reconcileErr.Error()
+	}
+	meta.SetStatusCondition(&gb.Status.Conditions, condition)
+
+	if err := r.patchStatus(ctx, gb); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to record reconcile error")
+	}
+}
+
+// rolloutComplete reports whether the Deployment has finished rolling out
+// its current pod template
+func rolloutComplete(d *appsv1.Deployment) bool {
+	if d.Status.ObservedGeneration < d.Generation {
+		return false
+	}
+	replicas := int32(1)
+	if d.Spec.Replicas != nil {
+		replicas = *d.Spec.Replicas
+	}
+	return d.Status.UpdatedReplicas == replicas &&
+		d.Status.Replicas == replicas &&
+		d.Status.AvailableReplicas == replicas
+}
+
+// portForGuestBook returns the Service port for a GuestBook
+func portForGuestBook(gb *webappv1alpha1.GuestBook) int32 {
+	if gb.Spec.Port != 0 {
+		return gb.Spec.Port
+	}
+	if tlsEnabled(gb) {
+		return defaultTLSPort
+	}
+	return defaultPort
+}
+
+// serviceURL returns the in-cluster URL of the guestbook Service, leaving
+// out the port when it is the default for the scheme
+func serviceURL(gb *webappv1alpha1.GuestBook) string {
+	scheme, schemePort := "http", defaultPort
+	if tlsEnabled(gb) {
+		scheme, schemePort = "https", defaultTLSPort
+	}
+
+	u := fmt.Sprintf("%s://%s-service.%s.svc.cluster.local", scheme, gb.Name, gb.Namespace)
+	if port := portForGuestBook(gb); port != schemePort {
+		u = fmt.Sprintf("%s:%d", u, port)
+	}
+	return u
+}
+
+// targetPortForGuestBook returns the container port for a GuestBook
+func targetPortForGuestBook(gb *webappv1alpha1.GuestBook) int32 {
+	if gb.Spec.TargetPort != 0 {
+		return gb.Spec.TargetPort
+	}
+	return defaultPort
+}
+
+// labelsForGuestBook returns the labels for a GuestBook resource
+func labelsForGuestBook(name string) map[string]string {
+	labels := selectorLabelsForGuestBook(name)
+	labels[managedByLabel] = managedByValue
+	return labels
+}
+
+// selectorLabelsForGuestBook returns the labels that select a GuestBook's
+// pods. They must stay as they are: a workload's spec.selector is
+// immutable, so new labels only go into labelsForGuestBook.
+func selectorLabelsForGuestBook(name string) map[string]string {
+	return map[string]string{
+		"app":       "guestbook",
+		"guestbook": name,
+	}
+}
+
+// managedByLabel marks every object the operator creates
+const (
+	managedByLabel = "managed-by"
+	managedByValue = "guestbook-operator"
+)
+
+// ManagedObjectsSelector matches the objects the operator creates. The
+// manager's cache can be limited to it for kinds that are plentiful in a
+// cluster but that the controllers only read when they manage them.
+func ManagedObjectsSelector() labels.Selector {
+	return labels.SelectorFromSet(labels.Set{managedByLabel: managedByValue})
+}
+
+// StripManagedFields is a cache transform dropping managedFields, which
+// nothing in the operator reads and which often outweigh the rest of the
+// object. Updates built from cached objects are unaffected: the API server
+// keeps the stored managedFields when a write leaves them out.
+func StripManagedFields(obj interface{}) (interface{}, error) {
+	if accessor, err := meta.Accessor(obj); err == nil {
+		accessor.SetManagedFields(nil)
+	}
+	return obj, nil
+}
+
+// StripManagedFieldsAndLastApplied also drops kubectl's
+// last-applied-configuration annotation, a full copy of the object. Only
+// use it for kinds the operator writes with server-side apply or not at
+// all: an update built from the cached copy would delete the annotation.
+func StripManagedFieldsAndLastApplied(obj interface{}) (interface{}, error) {
+	if accessor, err := meta.Accessor(obj); err == nil {
+		accessor.SetManagedFields(nil)
+		delete(accessor.GetAnnotations(), corev1.LastAppliedConfigAnnotation)
+	}
+	return obj, nil
+}
+
+// SetupWithManager sets up the controller with the Manager
+func (r *GuestBookReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.Recorder == nil {
+		r.Recorder = mgr.GetEventRecorderFor("guestbook-controller")
+	}
+	if r.APIReader == nil {
+		r.APIReader = mgr.GetAPIReader()
+	}
+
+	// Expose the state of every GuestBook on the metrics endpoint
+	if err := registerGuestBookCollector(mgr.GetClient()); err != nil {
+		return err
+	}
+
+	// Let Secret, ConfigMap, theme, template and policy events find the GuestBooks using them
+	// without scanning every GuestBook in the namespace
+	indexer := mgr.GetFieldIndexer()
+	if err := indexer.IndexField(context.Background(), &webappv1alpha1.GuestBook{}, secretRefIndex, secretRefsForGuestBook); err != nil {
+		return err
+	}
+	if err := indexer.IndexField(context.Background(), &webappv1alpha1.GuestBook{}, templateRefIndex, templateRefForGuestBook); err != nil {
+		return err
+	}
+	if err := indexer.IndexField(context.Background(), &webappv1alpha1.GuestBook{}, themeRefIndex, themeRefForGuestBook); err != nil {
+		return err
+	}
+	if err := indexer.IndexField(context.Background(), &webappv1alpha1.GuestBook{}, guestBookTemplateIndex, guestBookTemplateForGuestBook); err != nil {
+		return err
+	}
+	if err := indexer.IndexField(context.Background(), &webappv1alpha1.GuestBook{}, moderationPolicyIndex, moderationPolicyForGuestBook); err != nil {
+		return err
+	}
+
+	// Status writes don't bump the generation, so only spec, label and
+	// annotation changes (and deletion, which does bump it) trigger a
+	// reconcile; otherwise every status update would queue another one
+	guestBookChanged := predicate.Or(
+		predicate.GenerationChangedPredicate{},
+		predicate.LabelChangedPredicate{},
+		predicate.AnnotationChangedPredicate{},
+	)
+
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&webappv1alpha1.GuestBook{}, builder.WithPredicates(guestBookChanged)).
+		Owns(&appsv1.Deployment{}).
+		Owns(&appsv1.StatefulSet{}).
+		Owns(&corev1.Service{}).
+		Owns(&corev1.ConfigMap{}).
+		Owns(&networkingv1.Ingress{}).
+		Owns(&corev1.PersistentVolumeClaim{}).
+		Owns(&batchv1.CronJob{}).
+		Owns(&batchv1.Job{}).
+		Owns(&autoscalingv2.HorizontalPodAutoscaler{}).
+		Owns(&policyv1.PodDisruptionBudget{}).
+		Owns(&networkingv1.NetworkPolicy{}).
+		Owns(&corev1.ServiceAccount{}).
+		Watches(&corev1.Secret{}, handler.EnqueueRequestsFromMapFunc(r.findGuestBooksForSecret)).
+		Watches(&corev1.ConfigMap{}, handler.EnqueueRequestsFromMapFunc(r.findGuestBooksForConfigMap)).
+		Watches(&webappv1alpha1.GuestBookTheme{}, handler.EnqueueRequestsFromMapFunc(r.findGuestBooksForTheme)).
+		Watches(&webappv1alpha1.ClusterGuestBookTheme{}, handler.EnqueueRequestsFromMapFunc(r.findGuestBooksForClusterTheme)).
+		Watches(&webappv1alpha1.GuestBookTemplate{}, handler.EnqueueRequestsFromMapFunc(r.findGuestBooksForGuestBookTemplate)).
+		Watches(&webappv1alpha1.ModerationPolicy{}, handler.EnqueueRequestsFromMapFunc(r.findGuestBooksForModerationPolicy)).
+		WithOptions(controller.Options{
+			RateLimiter:             r.RateLimiter,
+			MaxConcurrentReconciles: r.MaxConcurrentReconciles,
+			// With the priority queue, For and Owns enqueue the initial
+			// list and unchanged updates at low priority
+			UsePriorityQueue: ptr.To(r.UsePriorityQueue),
+		}).
+		Complete(r)
+}
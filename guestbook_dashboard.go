@@ -0,0 +1,166 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// dashboardConfigMapName names the ConfigMap holding the dashboard
+	dashboardConfigMapName = "guestbook-operator-dashboard"
+	// dashboardKey is the dashboard's file name in the ConfigMap
+	dashboardKey = "guestbook-operator.json"
+	// dashboardLabel is the label the Grafana sidecar loads dashboards by
+	// with its default settings
+	dashboardLabel = "grafana_dashboard"
+	// dashboardUID keeps links to the dashboard stable across updates
+	dashboardUID = "guestbook-operator"
+)
+
+// DashboardPublisher publishes a Grafana dashboard of the GuestBook metrics
+// as a ConfigMap, labeled for the Grafana sidecar that loads dashboards from
+// ConfigMaps
+type DashboardPublisher struct {
+	Client client.Client
+
+	// Namespace is where the ConfigMap is written; it has to be one the
+	// sidecar watches
+	Namespace string
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, so only the
+// leader writes the dashboard
+func (p *DashboardPublisher) NeedLeaderElection() bool {
+	return true
+}
+
+// Start applies the dashboard ConfigMap once and returns. Applying it again
+// on every start rolls out dashboard changes with the operator.
+func (p *DashboardPublisher) Start(ctx context.Context) error {
+	dashboard, err := json.MarshalIndent(guestBookDashboard(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("rendering dashboard: %w", err)
+	}
+	cm := &corev1.ConfigMap{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      dashboardConfigMapName,
+			Namespace: p.Namespace,
+			Labels: map[string]string{
+				dashboardLabel:                 "1",
+				"app.kubernetes.io/name":       "guestbook-operator",
+				"app.kubernetes.io/managed-by": "guestbook-operator",
+			},
+		},
+		Data: map[string]string{dashboardKey: string(dashboard)},
+	}
+	if err := p.Client.Patch(ctx, cm, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership); err != nil {
+		return fmt.Errorf("applying dashboard ConfigMap %s/%s: %w", p.Namespace, cm.Name, err)
+	}
+	log.FromContext(ctx).Info("Published Grafana dashboard", "namespace", p.Namespace, "configMap", cm.Name)
+	return nil
+}
+
+// guestBookDashboard returns the dashboard model. Every query is filtered by
+// the namespace variable, and the datasource variable lets the dashboard be
+// pointed at whichever Prometheus scrapes the operator.
+func guestBookDashboard() map[string]interface{} {
+	return map[string]interface{}{
+		"uid":           dashboardUID,
+		"title":         "GuestBook Operator",
+		"tags":          []string{"guestbook", "kubernetes", "operator"},
+		"editable":      false,
+		"schemaVersion": 39,
+		"refresh":       "30s",
+		"time":          map[string]string{"from": "now-6h", "to": "now"},
+		"templating": map[string]interface{}{
+			"list": []interface{}{
+				map[string]interface{}{
+					"name":  "datasource",
+					"label": "Data source",
+					"type":  "datasource",
+					"query": "prometheus",
+				},
+				map[string]interface{}{
+					"name":       "namespace",
+					"label":      "Namespace",
+					"type":       "query",
+					"datasource": dashboardDatasource,
+					"query":      "label_values(guestbook_ready, namespace)",
+					"refresh":    2,
+					"multi":      true,
+					"includeAll": true,
+					"current":    map[string]interface{}{"text": "All", "value": "$__all"},
+				},
+			},
+		},
+		"panels": []interface{}{
+			dashboardPanel(1, "Ready GuestBooks", "stat", 0, 0, 6, 4,
+				dashboardTarget(`sum(guestbook_ready{namespace=~"$namespace"})`, "Ready")),
+			dashboardPanel(2, "GuestBooks", "stat", 6, 0, 6, 4,
+				dashboardTarget(`count(guestbook_ready{namespace=~"$namespace"})`, "Total")),
+			dashboardPanel(3, "Not ready", "table", 12, 0, 12, 8,
+				dashboardTarget(`guestbook_ready{namespace=~"$namespace"} == 0`, "{{namespace}}/{{name}}")),
+			dashboardPanel(4, "Desired replicas", "timeseries", 0, 8, 12, 8,
+				dashboardTarget(`guestbook_desired_replicas{namespace=~"$namespace"}`, "{{namespace}}/{{name}}")),
+			dashboardPanel(5, "Available replicas", "timeseries", 12, 8, 12, 8,
+				dashboardTarget(`guestbook_available_replicas{namespace=~"$namespace"}`, "{{namespace}}/{{name}}")),
+			dashboardPanel(6, "Missing replicas", "timeseries", 0, 16, 12, 8,
+				dashboardTarget(`guestbook_desired_replicas{namespace=~"$namespace"} - guestbook_available_replicas{namespace=~"$namespace"} > 0`, "{{namespace}}/{{name}}")),
+			// The error counter has no namespace label; it covers the whole operator
+			dashboardPanel(7, "Reconcile errors", "timeseries", 12, 16, 12, 8,
+				dashboardTarget(`sum by (reason) (rate(guestbook_reconcile_errors_total[5m]))`, "{{reason}}")),
+			dashboardPanel(8, "Reconcile latency (p99)", "timeseries", 0, 24, 12, 8,
+				dashboardTarget(`histogram_quantile(0.99, sum by (le, outcome) (rate(guestbook_reconcile_duration_seconds_bucket[5m])))`, "{{outcome}}")),
+			dashboardPanel(9, "Time since last successful reconcile", "timeseries", 12, 24, 12, 8,
+				dashboardTarget(`guestbook_seconds_since_last_successful_reconcile{namespace=~"$namespace"}`, "{{namespace}}/{{name}}")),
+		},
+	}
+}
+
+// dashboardDatasource points a panel or variable at the datasource variable
+var dashboardDatasource = map[string]string{"type": "prometheus", "uid": "${datasource}"}
+
+// dashboardPanel returns a panel of the given type at grid position x, y
+func dashboardPanel(id int, title, panelType string, x, y, w, h int, targets ...map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         id,
+		"title":      title,
+		"type":       panelType,
+		"datasource": dashboardDatasource,
+		"gridPos":    map[string]int{"x": x, "y": y, "w": w, "h": h},
+		"targets":    targets,
+	}
+}
+
+// dashboardTarget returns a Prometheus query for a panel
+func dashboardTarget(expr, legend string) map[string]interface{} {
+	return map[string]interface{}{
+		"datasource":   dashboardDatasource,
+		"expr":         expr,
+		"legendFormat": legend,
+		"refId":        "A",
+	}
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// appliedHashAnnotation records on a child a hash of the state last applied
+// to it, so that changed inputs can be told apart from manual edits
+const appliedHashAnnotation = "webapp.example.com/applied-hash"
+
+// appliedHash hashes the fields of a desired object that apply writes
+func appliedHash(obj client.Object) (string, error) {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return "", err
+	}
+	// encoding/json sorts map keys, so equal states hash the same
+	data, err := json.Marshal(appliedFields(content))
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// driftedFields compares a child object as found in the cluster with the
+// state the controller is about to apply, and names the user-visible fields
+// that were changed out from under it. Fields the API server defaults are
+// left out so they don't show up as drift on every pass.
+func driftedFields(found, desired client.Object) []string {
+	var fields []string
+	differs := func(name string, a, b interface{}) {
+		if !reflect.DeepEqual(a, b) {
+			fields = append(fields, name)
+		}
+	}
+
+	switch want := desired.(type) {
+	case *appsv1.Deployment:
+		got := found.(*appsv1.Deployment)
+		// Replicas are left out of the applied state under autoscaling
+		if want.Spec.Replicas != nil {
+			differs("spec.replicas", got.Spec.Replicas, want.Spec.Replicas)
+		}
+		differs("image", containerImages(got.Spec.Template.Spec.Containers), containerImages(want.Spec.Template.Spec.Containers))
+	case *corev1.Service:
+		got := found.(*corev1.Service)
+		differs("spec.selector", got.Spec.Selector, want.Spec.Selector)
+		differs("spec.ports", servicePorts(got.Spec.Ports), servicePorts(want.Spec.Ports))
+	case *corev1.ConfigMap:
+		got := found.(*corev1.ConfigMap)
+		differs("data", got.Data, want.Data)
+	}
+	return fields
+}
+
+// containerImages returns the image of each container by name
+func containerImages(containers []corev1.Container) map[string]string {
+	images := map[string]string{}
+	for _, c := range containers {
+		images[c.Name] = c.Image
+	}
+	return images
+}
+
+// servicePorts summarizes each Service port as name/protocol:port->targetPort,
+// ignoring the node ports the API server allocates
+func servicePorts(ports []corev1.ServicePort) []string {
+	summary := make([]string, 0, len(ports))
+	for _, p := range ports {
+		protocol := p.Protocol
+		if protocol == "" {
+			protocol = corev1.ProtocolTCP
+		}
+		summary = append(summary, fmt.Sprintf("%s/%s:%d->%s", p.Name, protocol, p.Port, p.TargetPort.String()))
+	}
+	return summary
+}
+
+// upToDate reports whether found already holds every field desired sets, so
+// applying desired would change nothing. Fields only found has, such as
+// server defaults and fields other managers own, don't count. A field the
+// controller stops setting isn't noticed here; callers apply regardless
+// whenever the applied hash has changed.
+func upToDate(found, desired client.Object) (bool, error) {
+	got, err := runtime.DefaultUnstructuredConverter.ToUnstructured(found)
+	if err != nil {
+		return false, err
+	}
+	want, err := runtime.DefaultUnstructuredConverter.ToUnstructured(desired)
+	if err != nil {
+		return false, err
+	}
+	return containsFields(appliedFields(got), appliedFields(want)), nil
+}
+
+// appliedFields keeps the parts of an object apply writes: labels,
+// annotations and owner references from the metadata, and everything else
+// apart from type information and status
+func appliedFields(obj map[string]interface{}) map[string]interface{} {
+	fields := map[string]interface{}{}
+	for key, value := range obj {
+		switch key {
+		case "apiVersion", "kind", "status":
+		case "metadata":
+			metadata, _ := value.(map[string]interface{})
+			kept := map[string]interface{}{}
+			for _, k := range []string{"labels", "annotations", "ownerReferences"} {
+				if v, ok := metadata[k]; ok {
+					kept[k] = v
+				}
+			}
+			fields[key] = kept
+		default:
+			fields[key] = value
+		}
+	}
+	return fields
+}
+
+// containsFields reports whether found holds every value set in desired.
+// Maps may carry extra keys; lists must match in length and element by
+// element.
+func containsFields(found, desired interface{}) bool {
+	switch want := desired.(type) {
+	case nil:
+		return true
+	case map[string]interface{}:
+		got, ok := found.(map[string]interface{})
+		if !ok {
+			return found == nil && isEmptyValue(want)
+		}
+		for key, value := range want {
+			if !containsFields(got[key], value) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		got, ok := found.([]interface{})
+		if !ok {
+			return found == nil && len(want) == 0
+		}
+		if len(got) != len(want) {
+			return false
+		}
+		for i := range want {
+			if !containsFields(got[i], want[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return (found == nil && isEmptyValue(want)) || reflect.DeepEqual(found, want)
+	}
+}
+
+// isEmptyValue reports whether v is a zero value or holds only zero values,
+// as unset optional fields do after conversion
+func isEmptyValue(v interface{}) bool {
+	switch value := v.(type) {
+	case nil:
+		return true
+	case map[string]interface{}:
+		for _, inner := range value {
+			if !isEmptyValue(inner) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		return len(value) == 0
+	default:
+		return reflect.ValueOf(v).IsZero()
+	}
+}
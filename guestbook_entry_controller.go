@@ -0,0 +1,223 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	webappv1alpha1 "github.com/yourusername/guestbook-operator/api/v1alpha1"
+)
+
+// entryFinalizer holds a deleted GuestBookEntry until it is removed from the
+// guestbook
+const entryFinalizer = "guestbook.example.com/entry"
+
+// entryGuestBookIndex is the cache index of GuestBookEntries by GuestBook name
+const entryGuestBookIndex = "spec.guestBookRef.name"
+
+// entryResyncInterval is how often a synced entry is written again, which
+// restores it after the guestbook lost its data, e.g. an inMemory restart
+const entryResyncInterval = 10 * time.Minute
+
+// entryRetryInterval is how often an entry waiting on its GuestBook is rechecked
+const entryRetryInterval = 30 * time.Second
+
+// conditionSynced is True when the entry is stored in its guestbook
+const conditionSynced = "Synced"
+
+// EntryReconciler keeps GuestBookEntries in their guestbook's data store
+type EntryReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+
+	// HTTPClient is used to call the guestbook admin API; a client with a
+	// short timeout is used when nil
+	HTTPClient *http.Client
+
+	// Recorder emits events on entries; SetupWithManager fills it in from
+	// the manager when nil
+	Recorder record.EventRecorder
+}
+
+// +kubebuilder:rbac:groups=webapp.example.com,resources=guestbookentries,verbs=get;list;watch;update;patch
+// +kubebuilder:rbac:groups=webapp.example.com,resources=guestbookentries/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=webapp.example.com,resources=guestbookentries/finalizers,verbs=update
+
+// Reconcile writes the entry to its guestbook, or removes it once deleted
+func (r *EntryReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	entry := &webappv1alpha1.GuestBookEntry{}
+	if err := r.Get(ctx, req.NamespacedName, entry); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	gb := &webappv1alpha1.GuestBook{}
+	err := r.Get(ctx, types.NamespacedName{Name: entry.Spec.GuestBookRef.Name, Namespace: entry.Namespace}, gb)
+	if errors.IsNotFound(err) {
+		gb = nil
+	} else if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if !entry.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, r.reconcileDelete(ctx, entry, gb)
+	}
+	if controllerutil.AddFinalizer(entry, entryFinalizer) {
+		if err := r.Update(ctx, entry); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	base := entry.DeepCopy()
+	result := ctrl.Result{RequeueAfter: entryResyncInterval}
+	switch {
+	case gb == nil:
+		setEntryCondition(entry, metav1.ConditionFalse, "GuestBookNotFound",
+			fmt.Sprintf("GuestBook %s not found", entry.Spec.GuestBookRef.Name))
+		result = ctrl.Result{}
+	case !meta.IsStatusConditionTrue(gb.Status.Conditions, conditionReady):
+		setEntryCondition(entry, metav1.ConditionFalse, "GuestBookNotReady",
+			fmt.Sprintf("Waiting for GuestBook %s to become ready", gb.Name))
+		result = ctrl.Result{RequeueAfter: entryRetryInterval}
+	default:
+		if err := r.sync(ctx, entry, gb); err != nil {
+			log.Error(err, "Failed to sync entry", "guestbook", gb.Name)
+			if setEntryCondition(entry, metav1.ConditionFalse, "SyncFailed", err.Error()) {
+				r.Recorder.Eventf(entry, corev1.EventTypeWarning, "SyncFailed", "Failed to write entry to GuestBook %s: %v", gb.Name, err)
+			}
+			if patchErr := r.Status().Patch(ctx, entry, client.MergeFrom(base)); patchErr != nil {
+				log.Error(patchErr, "Failed to update GuestBookEntry status")
+			}
+			return ctrl.Result{}, err
+		}
+	}
+
+	if err := r.Status().Patch(ctx, entry, client.MergeFrom(base)); err != nil {
+		return ctrl.Result{}, err
+	}
+	return result, nil
+}
+
+// sync writes the entry under an ID derived from its UID, so rewriting it
+// is idempotent and a recreated GuestBookEntry gets a new entry
+func (r *EntryReconciler) sync(ctx context.Context, entry *webappv1alpha1.GuestBookEntry, gb *webappv1alpha1.GuestBook) error {
+	timestamp := entry.CreationTimestamp.Time
+	if entry.Spec.Timestamp != nil {
+		timestamp = entry.Spec.Timestamp.Time
+	}
+
+	app, err := newAppClient(ctx, r.Client, r.HTTPClient, gb)
+	if err != nil {
+		return err
+	}
+	id := string(entry.UID)
+	if err := app.putEntry(ctx, id, appEntry{
+		Author:    entry.Spec.Author,
+		Message:   entry.Spec.Message,
+		Timestamp: timestamp,
+	}); err != nil {
+		return err
+	}
+
+	now := metav1.Now()
+	entry.Status.EntryID = id
+	entry.Status.LastSyncTime = &now
+	entry.Status.ObservedGeneration = entry.Generation
+	if setEntryCondition(entry, metav1.ConditionTrue, "Synced", fmt.Sprintf("Entry is stored in GuestBook %s", gb.Name)) {
+		r.Recorder.Eventf(entry, corev1.EventTypeNormal, "Synced", "Wrote entry to GuestBook %s", gb.Name)
+	}
+	return nil
+}
+
+// reconcileDelete removes the entry from its guestbook before letting the
+// GuestBookEntry go. Nothing is left to remove once the GuestBook is gone.
+func (r *EntryReconciler) reconcileDelete(ctx context.Context, entry *webappv1alpha1.GuestBookEntry, gb *webappv1alpha1.GuestBook) error {
+	if !controllerutil.ContainsFinalizer(entry, entryFinalizer) {
+		return nil
+	}
+	if gb != nil && gb.DeletionTimestamp.IsZero() && entry.Status.EntryID != "" {
+		app, err := newAppClient(ctx, r.Client, r.HTTPClient, gb)
+		if err != nil {
+			return err
+		}
+		if err := app.deleteEntry(ctx, entry.Status.EntryID); err != nil {
+			return fmt.Errorf("removing entry from GuestBook %s: %w", gb.Name, err)
+		}
+	}
+	controllerutil.RemoveFinalizer(entry, entryFinalizer)
+	return r.Update(ctx, entry)
+}
+
+// setEntryCondition sets the Synced condition and reports whether it changed
+func setEntryCondition(entry *webappv1alpha1.GuestBookEntry, status metav1.ConditionStatus, reason, message string) bool {
+	return meta.SetStatusCondition(&entry.Status.Conditions, metav1.Condition{
+		Type:               conditionSynced,
+		Status:             status,
+		ObservedGeneration: entry.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// findEntriesForGuestBook maps a GuestBook to the entries that belong to it,
+// so they are written as soon as it becomes ready
+func (r *EntryReconciler) findEntriesForGuestBook(ctx context.Context, obj client.Object) []reconcile.Request {
+	entries := &webappv1alpha1.GuestBookEntryList{}
+	if err := r.List(ctx, entries, client.InNamespace(obj.GetNamespace()), client.MatchingFields{entryGuestBookIndex: obj.GetName()}); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list GuestBookEntries", "guestbook", obj.GetName())
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(entries.Items))
+	for _, entry := range entries.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&entry)})
+	}
+	return requests
+}
+
+// SetupWithManager sets up the controller with the Manager
+func (r *EntryReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.Recorder == nil {
+		r.Recorder = mgr.GetEventRecorderFor("guestbookentry-controller")
+	}
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &webappv1alpha1.GuestBookEntry{}, entryGuestBookIndex, func(obj client.Object) []string {
+		return []string{obj.(*webappv1alpha1.GuestBookEntry).Spec.GuestBookRef.Name}
+	}); err != nil {
+		return err
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&webappv1alpha1.GuestBookEntry{}).
+		Watches(&webappv1alpha1.GuestBook{}, handler.EnqueueRequestsFromMapFunc(r.findEntriesForGuestBook)).
+		Complete(r)
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// GuestBookEntrySpec defines the desired state of GuestBookEntry
+type GuestBookEntrySpec struct {
+	// GuestBookRef is the GuestBook in the same namespace the entry belongs to
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="guestBookRef is immutable"
+	GuestBookRef corev1.LocalObjectReference `json:"guestBookRef"`
+
+	// Author is the name shown with the entry
+	// +kubebuilder:validation:MinLength=1
+	// +kubebuilder:validation:MaxLength=100
+	Author string `json:"author"`
+
+	// Message is the text of the entry
+	// +kubebuilder:validation:MinLength=1
+	// +kubebuilder:validation:MaxLength=2000
+	Message string `json:"message"`
+
+	// Timestamp is when the entry was written; the entry's creation time is
+	// used when unset
+	// +optional
+	Timestamp *metav1.Time `json:"timestamp,omitempty"`
+}
+
+// GuestBookEntryStatus defines the observed state of GuestBookEntry
+type GuestBookEntryStatus struct {
+	// ObservedGeneration is the generation last written to the guestbook
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// EntryID is the ID of the entry in the guestbook's data store
+	// +optional
+	EntryID string `json:"entryID,omitempty"`
+
+	// LastSyncTime is when the entry was last written to the guestbook
+	// +optional
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+
+	// Conditions report whether the entry is in the guestbook ("Synced")
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:shortName=gbe
+// +kubebuilder:printcolumn:name="GuestBook",type=string,JSONPath=`.spec.guestBookRef.name`
+// +kubebuilder:printcolumn:name="Author",type=string,JSONPath=`.spec.author`
+// +kubebuilder:printcolumn:name="Synced",type=string,JSONPath=`.status.conditions[?(@.type=="Synced")].status`
+// +kubebuilder:printcolumn:name="Message",type=string,JSONPath=`.spec.message`,priority=1
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// GuestBookEntry is an entry in a GuestBook managed as a Kubernetes object,
+// e.g. from Git. The controller keeps it in the guestbook's data store and
+// removes it when the GuestBookEntry is deleted.
+type GuestBookEntry struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   GuestBookEntrySpec   `json:"spec,omitempty"`
+	Status GuestBookEntryStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// GuestBookEntryList contains a list of GuestBookEntry
+type GuestBookEntryList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []GuestBookEntry `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&GuestBookEntry{}, &GuestBookEntryList{})
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// expectationsTimeout is how long unobserved writes hold back a GuestBook
+// before the cache is trusted anyway, matching the built-in controllers
+const expectationsTimeout = 5 * time.Minute
+
+// expectationsRetryInterval is how often a GuestBook waiting on the cache is
+// checked again; the watch event for the child usually comes first
+const expectationsRetryInterval = 2 * time.Second
+
+// expectations remembers, per GuestBook, the children the controller created
+// or deleted until the cache reflects them. A reconcile that ran before then
+// would see a missing child it just created, or a child it just deleted, and
+// act on it again. The zero value is ready to use.
+type expectations struct {
+	mu      sync.Mutex
+	pending map[types.NamespacedName][]expectedWrite
+}
+
+// expectedWrite is a create or delete the cache hasn't shown yet
+type expectedWrite struct {
+	// obj identifies the child; it is only used as a key and a Get target
+	obj client.Object
+
+	// deletedUID is the UID of a deleted child, empty for a creation
+	deletedUID types.UID
+
+	// recorded is when the write happened, for expiry
+	recorded time.Time
+}
+
+// expectCreate records that obj was created for the GuestBook owner
+func (e *expectations) expectCreate(owner types.NamespacedName, obj client.Object) {
+	e.add(owner, expectedWrite{obj: obj.DeepCopyObject().(client.Object), recorded: time.Now()})
+}
+
+// expectDelete records that obj was deleted for the GuestBook owner
+func (e *expectations) expectDelete(owner types.NamespacedName, obj client.Object) {
+	e.add(owner, expectedWrite{obj: obj.DeepCopyObject().(client.Object), deletedUID: obj.GetUID(), recorded: time.Now()})
+}
+
+func (e *expectations) add(owner types.NamespacedName, write expectedWrite) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.pending == nil {
+		e.pending = map[types.NamespacedName][]expectedWrite{}
+	}
+	e.pending[owner] = append(e.pending[owner], write)
+}
+
+// satisfied reports whether the cache behind reader shows every write
+// recorded for owner, dropping the ones it does and those that expired
+func (e *expectations) satisfied(ctx context.Context, reader client.Reader, owner types.NamespacedName) (bool, error) {
+	e.mu.Lock()
+	writes := e.pending[owner]
+	e.mu.Unlock()
+
+	var waiting []expectedWrite
+	for _, write := range writes {
+		if time.Since(write.recorded) > expectationsTimeout {
+			continue
+		}
+		seen, err := write.observed(ctx, reader)
+		if err != nil {
+			return false, err
+		}
+		if !seen {
+			waiting = append(waiting, write)
+		}
+	}
+
+	// Writes recorded while the lock was released are kept
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if current := e.pending[owner]; len(current) > len(writes) {
+		waiting = append(waiting, current[len(writes):]...)
+	}
+	if len(waiting) == 0 {
+		delete(e.pending, owner)
+		return true, nil
+	}
+	e.pending[owner] = waiting
+	return false, nil
+}
+
+// forget drops everything recorded for a GuestBook that no longer exists
+func (e *expectations) forget(owner types.NamespacedName) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.pending, owner)
+}
+
+// observed reports whether the cache shows the write: the created child is
+// present, or the deleted one is gone or replaced by a new object
+func (w expectedWrite) observed(ctx context.Context, reader client.Reader) (bool, error) {
+	found := w.obj.DeepCopyObject().(client.Object)
+	err := reader.Get(ctx, client.ObjectKeyFromObject(w.obj), found)
+	if errors.IsNotFound(err) {
+		return w.deletedUID != "", nil
+	} else if err != nil {
+		return false, err
+	}
+	if w.deletedUID != "" {
+		return found.GetUID() != w.deletedUID, nil
+	}
+	return true, nil
+}
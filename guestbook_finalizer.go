@@ -0,0 +1,518 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	webappv1alpha1 "github.com/yourusername/guestbook-operator/api/v1alpha1"
+)
+
+// guestBookFinalizer holds a deleted GuestBook until its external resources
+// are cleaned up
+const guestBookFinalizer = "guestbook.example.com/finalizer"
+
+// finalizeRetryInterval is how often an unfinished teardown is checked
+const finalizeRetryInterval = 10 * time.Second
+
+// backupImage archives the data volume for the final backup
+const backupImage = "busybox:1.36"
+
+// cleanupImages holds the client image used to drop tables per external driver
+var cleanupImages = map[string]string{
+	"postgres": postgresImage,
+	"mysql":    "mysql:8.4",
+}
+
+// cleanupCommands drop the guestbook's tables, using the GUESTBOOK_DB_*
+// variables the external backend exposes
+var cleanupCommands = map[string]string{
+	"postgres": `PGPASSWORD="$GUESTBOOK_DB_PASSWORD" psql -v ON_ERROR_STOP=1 -h "$GUESTBOOK_DB_HOST" -p "$GUESTBOOK_DB_PORT" -U "$GUESTBOOK_DB_USERNAME" -d "$GUESTBOOK_DB_DATABASE" -c 'DROP TABLE IF EXISTS entries'`,
+	"mysql":    `mysql -h "$GUESTBOOK_DB_HOST" -P "$GUESTBOOK_DB_PORT" -u "$GUESTBOOK_DB_USERNAME" -p"$GUESTBOOK_DB_PASSWORD" "$GUESTBOOK_DB_DATABASE" -e 'DROP TABLE IF EXISTS entries'`,
+}
+
+// reconcileDelete runs the teardown for a GuestBook being deleted and drops
+// the finalizer once nothing outside the cluster's garbage collection is left
+func (r *GuestBookReconciler) reconcileDelete(ctx context.Context, gb *webappv1alpha1.GuestBook) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	if !controllerutil.ContainsFinalizer(gb, guestBookFinalizer) {
+		return ctrl.Result{}, nil
+	}
+
+	done, err := r.finalizeGuestBook(ctx, gb)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !done {
+		log.Info("Waiting for GuestBook teardown to finish")
+		setCondition(gb, conditionReady, metav1.ConditionFalse, "Terminating", "The GuestBook is being deleted")
+		gb.Status.Phase = phaseForGuestBook(gb, nil)
+		if err := r.patchStatus(ctx, gb); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{RequeueAfter: finalizeRetryInterval}, nil
+	}
+
+	log.Info("GuestBook teardown complete, removing finalizer")
+	controllerutil.RemoveFinalizer(gb, guestBookFinalizer)
+	return ctrl.Result{}, r.Update(ctx, gb)
+}
+
+// finalizeGuestBook tears a deleted GuestBook down in order: traffic is
+// stopped first, then the pods, so the data is quiescent when the final
+// backup runs and the volume is released. Garbage collection removes the
+// remaining children once the finalizer is gone. Object store snapshots taken
+// by GuestBookBackups are left alone unless backupCleanupPolicy is Drop. It
+// reports whether teardown is finished; while it isn't, the Finalizing
+// condition names the step.
+func (r *GuestBookReconciler) finalizeGuestBook(ctx context.Context, gb *webappv1alpha1.GuestBook) (bool, error) {
+	steps := []func(context.Context, *webappv1alpha1.GuestBook) (bool, error){
+		r.stopTraffic,
+		r.scaleDownForDelete,
+		r.runFinalBackup,
+		r.releaseStorage,
+		r.dropExternalTables,
+		r.dropBackupSnapshots,
+	}
+	for _, step := range steps {
+		done, err := step(ctx, gb)
+		if err != nil || !done {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// setFinalizingCondition records which teardown step is in progress
+func setFinalizingCondition(gb *webappv1alpha1.GuestBook, reason, message string) {
+	meta.SetStatusCondition(&gb.Status.Conditions, metav1.Condition{
+		Type:               "Finalizing",
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: gb.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// stopTraffic deletes the Ingress, and the Service when it carries the
+// external-dns hostname, and waits until they are gone. New requests stop
+// arriving and external-dns withdraws the record before the GuestBook
+// disappears.
+func (r *GuestBookReconciler) stopTraffic(ctx context.Context, gb *webappv1alpha1.GuestBook) (bool, error) {
+	sources := []client.Object{
+		&networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: gb.Name, Namespace: gb.Namespace}},
+	}
+	if gb.Spec.DNS.Hostname != "" && !gb.Spec.Ingress.Enabled {
+		sources = append(sources, &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: gb.Name + "-service", Namespace: gb.Namespace}})
+	}
+
+	var remaining []string
+	for _, source := range sources {
+		gone, err := r.deleteAndWait(ctx, source)
+		if err != nil {
+			return false, err
+		}
+		if !gone {
+			remaining = append(remaining, fmt.Sprintf("%s %s", kindOf(source), source.GetName()))
+		}
+	}
+	if len(remaining) > 0 {
+		setFinalizingCondition(gb, "StoppingTraffic", fmt.Sprintf("Waiting for %s to be removed", strings.Join(remaining, ", ")))
+		return false, nil
+	}
+	return true, nil
+}
+
+// scaleDownForDelete removes the autoscaler and scales the Deployment to
+// zero, waiting until no guestbook pods are left
+func (r *GuestBookReconciler) scaleDownForDelete(ctx context.Context, gb *webappv1alpha1.GuestBook) (bool, error) {
+	// The autoscaler would scale the Deployment straight back up
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{ObjectMeta: metav1.ObjectMeta{Name: gb.Name, Namespace: gb.Namespace}}
+	if err := r.Delete(ctx, hpa); err != nil && !errors.IsNotFound(err) {
+		return false, err
+	}
+
+	deployment := &appsv1.Deployment{}
+	err := r.Get(ctx, types.NamespacedName{Name: gb.Name, Namespace: gb.Namespace}, deployment)
+	if errors.IsNotFound(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if deployment.Spec.Replicas == nil || *deployment.Spec.Replicas != 0 {
+		patch := client.MergeFrom(deployment.DeepCopy())
+		zero := int32(0)
+		deployment.Spec.Replicas = &zero
+		if err := r.Patch(ctx, deployment, patch); err != nil {
+			return false, err
+		}
+	}
+	if deployment.Status.Replicas > 0 {
+		setFinalizingCondition(gb, "ScalingDown", fmt.Sprintf("Waiting for %d guestbook pods to stop", deployment.Status.Replicas))
+		return false, nil
+	}
+	return true, nil
+}
+
+// runFinalBackup archives the data volume into the final backup PVC when
+// spec.persistence.finalBackup is set, and waits for the Job to succeed
+func (r *GuestBookReconciler) runFinalBackup(ctx context.Context, gb *webappv1alpha1.GuestBook) (bool, error) {
+	if !gb.Spec.Persistence.Enabled || !gb.Spec.Persistence.FinalBackup {
+		return true, nil
+	}
+
+	// The backup PVC is deliberately not owned by the GuestBook, so
+	// garbage collection leaves it behind
+	target := finalBackupPVCForGuestBook(gb)
+	err := r.Create(ctx, target)
+	if err != nil && !errors.IsAlreadyExists(err) {
+		return false, err
+	}
+
+	job := finalBackupJobForGuestBook(gb)
+	if err := ensureCreated(ctx, r, gb, job); err != nil {
+		return false, err
+	}
+	if err := r.Get(ctx, types.NamespacedName{Name: job.Name, Namespace: job.Namespace}, job); err != nil {
+		return false, client.IgnoreNotFound(err)
+	}
+	if job.Status.Succeeded > 0 {
+		return true, nil
+	}
+
+	reason, message := "BackingUp", fmt.Sprintf("Job %s is archiving the data volume into PVC %s", job.Name, target.Name)
+	for _, c := range job.Status.Conditions {
+		if c.Type == batchv1.JobFailed && c.Status == corev1.ConditionTrue {
+			reason, message = "BackupFailed", fmt.Sprintf("Job %s failed to archive the data volume: %s", job.Name, c.Message)
+		}
+	}
+	setFinalizingCondition(gb, reason, message)
+	return false, nil
+}
+
+// releaseStorage applies spec.persistence.reclaimPolicy to the data PVC. A
+// retained claim has its owner reference removed so garbage collection keeps
+// it; a deleted one is removed now that no pod mounts it.
+func (r *GuestBookReconciler) releaseStorage(ctx context.Context, gb *webappv1alpha1.GuestBook) (bool, error) {
+	if !gb.Spec.Persistence.Enabled {
+		return true, nil
+	}
+
+	pvc := &corev1.PersistentVolumeClaim{}
+	err := r.Get(ctx, types.NamespacedName{Name: gb.Name + "-data", Namespace: gb.Namespace}, pvc)
+	if errors.IsNotFound(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if gb.Spec.Persistence.ReclaimPolicy == webappv1alpha1.ReclaimPolicyRetain {
+		if !metav1.IsControlledBy(pvc, gb) {
+			return true, nil
+		}
+		patch := client.MergeFrom(pvc.DeepCopy())
+		if err := controllerutil.RemoveControllerReference(gb, pvc, r.Scheme); err != nil {
+			return false, err
+		}
+		return true, r.Patch(ctx, pvc, patch)
+	}
+
+	gone, err := r.deleteAndWait(ctx, pvc)
+	if err != nil {
+		return false, err
+	}
+	if !gone {
+		setFinalizingCondition(gb, "ReleasingStorage", fmt.Sprintf("Waiting for PersistentVolumeClaim %s to be removed", pvc.Name))
+	}
+	return gone, nil
+}
+
+// deleteAndWait deletes obj unless it is already going away, and reports
+// whether it is gone
+func (r *GuestBookReconciler) deleteAndWait(ctx context.Context, obj client.Object) (bool, error) {
+	err := r.Get(ctx, types.NamespacedName{Name: obj.GetName(), Namespace: obj.GetNamespace()}, obj)
+	if errors.IsNotFound(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	if obj.GetDeletionTimestamp().IsZero() {
+		if err := r.Delete(ctx, obj); err != nil && !errors.IsNotFound(err) {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// dropExternalTables runs a Job that drops the guestbook's tables from an
+// external database whose cleanupPolicy is Drop, and waits for it to succeed.
+// A failed Job keeps the finalizer in place rather than leaving data behind
+// silently; the Finalizing condition says why.
+func (r *GuestBookReconciler) dropExternalTables(ctx context.Context, gb *webappv1alpha1.GuestBook) (bool, error) {
+	ext := gb.Spec.Backend.External
+	if !isExternalBackend(gb) || ext == nil || ext.CleanupPolicy != webappv1alpha1.CleanupPolicyDrop {
+		return true, nil
+	}
+
+	job := cleanupJobForGuestBook(gb)
+	if err := ensureCreated(ctx, r, gb, job); err != nil {
+		return false, err
+	}
+	if err := r.Get(ctx, types.NamespacedName{Name: job.Name, Namespace: job.Namespace}, job); err != nil {
+		return false, client.IgnoreNotFound(err)
+	}
+
+	if job.Status.Succeeded > 0 {
+		return true, nil
+	}
+
+	reason, message := "DroppingTables", fmt.Sprintf("Job %s is dropping the guestbook tables", job.Name)
+	for _, c := range job.Status.Conditions {
+		if c.Type == batchv1.JobFailed && c.Status == corev1.ConditionTrue {
+			reason, message = "CleanupFailed", fmt.Sprintf("Job %s failed to drop the guestbook tables: %s", job.Name, c.Message)
+		}
+	}
+	setFinalizingCondition(gb, reason, message)
+	return false, nil
+}
+
+// dropBackupSnapshots deletes the object store snapshot of each of the
+// guestbook's GuestBookBackups when backupCleanupPolicy is Drop, then the
+// GuestBookBackup itself. Backups still in flight are waited for so their
+// upload doesn't land after the cleanup.
+func (r *GuestBookReconciler) dropBackupSnapshots(ctx context.Context, gb *webappv1alpha1.GuestBook) (bool, error) {
+	if gb.Spec.BackupCleanupPolicy != webappv1alpha1.CleanupPolicyDrop {
+		return true, nil
+	}
+
+	backups := &webappv1alpha1.GuestBookBackupList{}
+	if err := r.List(ctx, backups, client.InNamespace(gb.Namespace)); err != nil {
+		return false, err
+	}
+	done := true
+	for i := range backups.Items {
+		backup := &backups.Items[i]
+		if backup.Spec.GuestBookRef.Name != gb.Name {
+			continue
+		}
+		dropped, err := r.dropBackupSnapshot(ctx, gb, backup)
+		if err != nil {
+			return false, err
+		}
+		done = done && dropped
+	}
+	return done, nil
+}
+
+// dropBackupSnapshot runs a Job that removes one backup's snapshot and deletes
+// the GuestBookBackup once it has succeeded. A failed Job keeps the finalizer
+// in place, like a failed table cleanup.
+func (r *GuestBookReconciler) dropBackupSnapshot(ctx context.Context, gb *webappv1alpha1.GuestBook, backup *webappv1alpha1.GuestBookBackup) (bool, error) {
+	if phase := backup.Status.Phase; phase != webappv1alpha1.BackupCompleted && phase != webappv1alpha1.BackupFailed {
+		setFinalizingCondition(gb, "WaitingForBackup", fmt.Sprintf("GuestBookBackup %s has not finished", backup.Name))
+		return false, nil
+	}
+	if backup.Status.Location == "" {
+		return r.deleteAndWait(ctx, backup)
+	}
+
+	job := snapshotCleanupJobForBackup(gb, backup)
+	if err := ensureCreated(ctx, r, gb, job); err != nil {
+		return false, err
+	}
+	if err := r.Get(ctx, types.NamespacedName{Name: job.Name, Namespace: job.Namespace}, job); err != nil {
+		return false, client.IgnoreNotFound(err)
+	}
+
+	if job.Status.Succeeded > 0 {
+		return r.deleteAndWait(ctx, backup)
+	}
+
+	reason, message := "DroppingSnapshots", fmt.Sprintf("Job %s is deleting %s", job.Name, backup.Status.Location)
+	for _, c := range job.Status.Conditions {
+		if c.Type == batchv1.JobFailed && c.Status == corev1.ConditionTrue {
+			reason, message = "CleanupFailed", fmt.Sprintf("Job %s failed to delete %s: %s", job.Name, backup.Status.Location, c.Message)
+		}
+	}
+	setFinalizingCondition(gb, reason, message)
+	return false, nil
+}
+
+// snapshotCleanupJobForBackup creates the Job that deletes a backup's
+// snapshot from the object store
+func snapshotCleanupJobForBackup(gb *webappv1alpha1.GuestBook, backup *webappv1alpha1.GuestBookBackup) *batchv1.Job {
+	backoffLimit := int32(3)
+	dest := backup.Spec.Destination
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      backup.Name + "-cleanup",
+			Namespace: gb.Namespace,
+			Labels:    labelsForGuestBook(gb.Name),
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: backendLabels(gb, "snapshot-cleanup"),
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:    "cleanup",
+							Image:   objectStoreImage,
+							Command: []string{"/bin/sh", "-c", `aws s3 rm "$LOCATION"`},
+							Env:     append(objectStoreEnv(dest), corev1.EnvVar{Name: "LOCATION", Value: backup.Status.Location}),
+							EnvFrom: []corev1.EnvFromSource{
+								{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: dest.CredentialsSecretRef}},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// cleanupJobForGuestBook creates the Job that drops the guestbook's tables
+// from its external database
+func cleanupJobForGuestBook(gb *webappv1alpha1.GuestBook) *batchv1.Job {
+	driver := gb.Spec.Backend.External.Driver
+	if driver == "" {
+		driver = "postgres"
+	}
+	backoffLimit := int32(3)
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      gb.Name + "-cleanup",
+			Namespace: gb.Namespace,
+			Labels:    labelsForGuestBook(gb.Name),
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: backendLabels(gb, "cleanup"),
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:    "cleanup",
+							Image:   cleanupImages[driver],
+							Command: []string{"/bin/sh", "-c", cleanupCommands[driver]},
+							Env:     externalBackend{}.env(gb),
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// finalBackupPVCForGuestBook creates the claim the final backup is written
+// to, sized like the data volume
+func finalBackupPVCForGuestBook(gb *webappv1alpha1.GuestBook) *corev1.PersistentVolumeClaim {
+	spec := gb.Spec.Persistence
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      gb.Name + "-final-backup",
+			Namespace: gb.Namespace,
+			Labels:    labelsForGuestBook(gb.Name),
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			StorageClassName: spec.StorageClassName,
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: spec.Size,
+				},
+			},
+		},
+	}
+}
+
+// finalBackupJobForGuestBook creates the Job that archives the data volume
+// into the final backup PVC
+func finalBackupJobForGuestBook(gb *webappv1alpha1.GuestBook) *batchv1.Job {
+	backoffLimit := int32(3)
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      gb.Name + "-final-backup",
+			Namespace: gb.Namespace,
+			Labels:    labelsForGuestBook(gb.Name),
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: backendLabels(gb, "final-backup"),
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:    "backup",
+							Image:   backupImage,
+							Command: []string{"/bin/sh", "-c", `tar -czf "/backup/data-$(date -u +%Y%m%dT%H%M%SZ).tar.gz" -C /data .`},
+							VolumeMounts: []corev1.VolumeMount{
+								{Name: "data", MountPath: "/data", ReadOnly: true},
+								{Name: "backup", MountPath: "/backup"},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "data",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: gb.Name + "-data", ReadOnly: true},
+							},
+						},
+						{
+							Name: "backup",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: gb.Name + "-final-backup"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
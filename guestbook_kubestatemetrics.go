@@ -0,0 +1,187 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/yaml"
+
+	webappv1alpha1 "github.com/yourusername/guestbook-operator/api/v1alpha1"
+)
+
+const (
+	// kubeStateMetricsConfigMapName names the ConfigMap holding the
+	// kube-state-metrics configuration
+	kubeStateMetricsConfigMapName = "guestbook-operator-kube-state-metrics"
+	// kubeStateMetricsConfigKey is the configuration's file name in the
+	// ConfigMap, to pass to --custom-resource-state-config-file
+	kubeStateMetricsConfigKey = "guestbook.yaml"
+)
+
+// KubeStateMetricsPublisher writes a CustomResourceStateMetrics
+// configuration to a ConfigMap, for kube-state-metrics to mount and export
+// GuestBook metrics from on clusters that don't scrape the operator. The
+// kube-state-metrics ServiceAccount also needs list and watch on GuestBooks.
+type KubeStateMetricsPublisher struct {
+	Client client.Client
+
+	// Namespace is where the ConfigMap is written, normally the namespace
+	// kube-state-metrics runs in
+	Namespace string
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, so only the
+// leader writes the configuration
+func (p *KubeStateMetricsPublisher) NeedLeaderElection() bool {
+	return true
+}
+
+// Start applies the configuration ConfigMap once and returns
+func (p *KubeStateMetricsPublisher) Start(ctx context.Context) error {
+	config, err := KubeStateMetricsConfig()
+	if err != nil {
+		return err
+	}
+	cm := &corev1.ConfigMap{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      kubeStateMetricsConfigMapName,
+			Namespace: p.Namespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/name":       "guestbook-operator",
+				"app.kubernetes.io/managed-by": "guestbook-operator",
+			},
+		},
+		Data: map[string]string{kubeStateMetricsConfigKey: string(config)},
+	}
+	if err := p.Client.Patch(ctx, cm, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership); err != nil {
+		return fmt.Errorf("applying kube-state-metrics ConfigMap %s/%s: %w", p.Namespace, cm.Name, err)
+	}
+	log.FromContext(ctx).Info("Published kube-state-metrics configuration", "namespace", p.Namespace, "configMap", cm.Name)
+	return nil
+}
+
+// KubeStateMetricsConfig returns the CustomResourceStateMetrics
+// configuration for GuestBooks as YAML. The metrics are named
+// kube_guestbook_*, with the GuestBook's namespace and name as labels.
+func KubeStateMetricsConfig() ([]byte, error) {
+	phases := []webappv1alpha1.GuestBookPhase{
+		webappv1alpha1.PhasePending,
+		webappv1alpha1.PhaseProvisioning,
+		webappv1alpha1.PhaseReady,
+		webappv1alpha1.PhaseDegraded,
+		webappv1alpha1.PhaseTerminating,
+	}
+	config := map[string]interface{}{
+		"kind": "CustomResourceStateMetrics",
+		"spec": map[string]interface{}{
+			"resources": []interface{}{
+				map[string]interface{}{
+					// The storage version; kube-state-metrics lists GuestBooks
+					// at whichever version is named here
+					"groupVersionKind": map[string]string{
+						"group":   webappv1alpha1.GroupVersion.Group,
+						"version": "v1",
+						"kind":    "GuestBook",
+					},
+					"metricNamePrefix": "kube_guestbook",
+					"labelsFromPath": map[string][]string{
+						"namespace": {"metadata", "namespace"},
+						"name":      {"metadata", "name"},
+					},
+					"metrics": []interface{}{
+						kubeStateMetricsInfo("info", "Information about the GuestBook.", map[string][]string{
+							"image":       {"status", "image"},
+							"app_version": {"status", "version", "appVersion"},
+							"backend":     {"spec", "backend", "type"},
+						}),
+						kubeStateMetricsGauge("spec_replicas", "Number of guestbook pods the spec asks for.", "spec", "replicas"),
+						kubeStateMetricsGauge("status_replicas", "Number of guestbook pods.", "status", "replicas"),
+						kubeStateMetricsGauge("status_ready_replicas", "Number of ready guestbook pods.", "status", "readyReplicas"),
+						kubeStateMetricsGauge("status_available_replicas", "Number of available guestbook pods.", "status", "availableReplicas"),
+						kubeStateMetricsGauge("status_entries", "Number of entries in the guestbook.", "status", "entryCount"),
+						kubeStateMetricsGauge("status_pending_entries", "Number of entries awaiting moderation.", "status", "pendingEntries"),
+						kubeStateMetricsGauge("status_observed_generation", "Generation last acted on by the operator.", "status", "observedGeneration"),
+						kubeStateMetricsGauge("status_last_successful_reconcile_time", "Unix time of the last successful reconcile.", "status", "lastSuccessfulReconcileTime"),
+						map[string]interface{}{
+							"name": "status_phase",
+							"help": "The GuestBook's phase, one series per phase.",
+							"each": map[string]interface{}{
+								"type": "StateSet",
+								"stateSet": map[string]interface{}{
+									"labelName": "phase",
+									"path":      []string{"status", "phase"},
+									"list":      phases,
+								},
+							},
+						},
+						map[string]interface{}{
+							"name": "status_condition",
+							"help": "The GuestBook's conditions; 1 when True, 0 when False.",
+							"each": map[string]interface{}{
+								"type": "Gauge",
+								"gauge": map[string]interface{}{
+									"path": []string{"status", "conditions"},
+									"labelsFromPath": map[string][]string{
+										"type":   {"type"},
+										"reason": {"reason"},
+									},
+									"valueFrom": []string{"status"},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	out, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("rendering kube-state-metrics configuration: %w", err)
+	}
+	return out, nil
+}
+
+// kubeStateMetricsGauge returns a gauge read from the field at path
+func kubeStateMetricsGauge(name, help string, path ...string) map[string]interface{} {
+	return map[string]interface{}{
+		"name": name,
+		"help": help,
+		"each": map[string]interface{}{
+			"type":  "Gauge",
+			"gauge": map[string]interface{}{"path": path},
+		},
+	}
+}
+
+// kubeStateMetricsInfo returns an info metric labeled from the given fields
+func kubeStateMetricsInfo(name, help string, labels map[string][]string) map[string]interface{} {
+	return map[string]interface{}{
+		"name": name,
+		"help": help,
+		"each": map[string]interface{}{
+			"type": "Info",
+			"info": map[string]interface{}{"labelsFromPath": labels},
+		},
+	}
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"strconv"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Annotations tying an event to the reconcile that emitted it. The reconcile
+// ID is the reconcileID on the same reconcile's log lines.
+const (
+	reconcileIDAnnotation = "guestbook.example.com/reconcile-id"
+	generationAnnotation  = "guestbook.example.com/generation"
+)
+
+type reconcileInfoKey struct{}
+
+// reconcileInfo identifies one reconcile invocation
+type reconcileInfo struct {
+	id         types.UID
+	generation int64
+}
+
+// withReconcileID returns ctx carrying the reconcile's ID. controller-runtime
+// assigns one per invocation and already logs it as reconcileID, along with
+// the namespace and name; a reconcile driven from outside a controller gets a
+// fresh ID and a logger carrying the same keys.
+func withReconcileID(ctx context.Context, req ctrl.Request) (context.Context, types.UID) {
+	id := controller.ReconcileIDFromContext(ctx)
+	if id == "" {
+		id = uuid.NewUUID()
+		ctx = log.IntoContext(ctx, log.FromContext(ctx).WithValues(
+			"reconcileID", id, "namespace", req.Namespace, "name", req.Name))
+	}
+	return context.WithValue(ctx, reconcileInfoKey{}, reconcileInfo{id: id}), id
+}
+
+// withGeneration adds the fetched GuestBook's generation to ctx's logger and
+// to the events emitted through recorder
+func withGeneration(ctx context.Context, generation int64) context.Context {
+	info, _ := ctx.Value(reconcileInfoKey{}).(reconcileInfo)
+	info.generation = generation
+	ctx = context.WithValue(ctx, reconcileInfoKey{}, info)
+	return log.IntoContext(ctx, log.FromContext(ctx).WithValues("generation", generation))
+}
+
+// recorder returns the event recorder for this reconcile, which annotates
+// every event with the reconcile ID and generation carried by ctx
+func (r *GuestBookReconciler) recorder(ctx context.Context) record.EventRecorder {
+	info, ok := ctx.Value(reconcileInfoKey{}).(reconcileInfo)
+	if !ok {
+		return r.Recorder
+	}
+	annotations := map[string]string{reconcileIDAnnotation: string(info.id)}
+	if info.generation != 0 {
+		annotations[generationAnnotation] = strconv.FormatInt(info.generation, 10)
+	}
+	return &annotatedRecorder{EventRecorder: r.Recorder, annotations: annotations}
+}
+
+// annotatedRecorder adds a fixed set of annotations to every event
+type annotatedRecorder struct {
+	record.EventRecorder
+	annotations map[string]string
+}
+
+func (a *annotatedRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	a.EventRecorder.AnnotatedEventf(object, a.annotations, eventtype, reason, "%s", message)
+}
+
+func (a *annotatedRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	a.EventRecorder.AnnotatedEventf(object, a.annotations, eventtype, reason, messageFmt, args...)
+}
+
+func (a *annotatedRecorder) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+	merged := make(map[string]string, len(a.annotations)+len(annotations))
+	for k, v := range a.annotations {
+		merged[k] = v
+	}
+	for k, v := range annotations {
+		merged[k] = v
+	}
+	a.EventRecorder.AnnotatedEventf(object, merged, eventtype, reason, messageFmt, args...)
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	webappv1alpha1 "github.com/yourusername/guestbook-operator/api/v1alpha1"
+)
+
+// maintenanceWindowState reports whether a maintenance window is open at now
+// and, if not, when the next one opens
+func maintenanceWindowState(window *webappv1alpha1.MaintenanceWindow, now time.Time) (bool, time.Time, error) {
+	schedule, err := cron.ParseStandard(window.Schedule)
+	if err != nil {
+		return false, time.Time{}, fmt.Errorf("invalid maintenance window schedule %q: %w", window.Schedule, err)
+	}
+
+	// A window that opened within the last Duration is still open
+	start := schedule.Next(now.Add(-window.Duration.Duration))
+	if !start.After(now) {
+		return true, now, nil
+	}
+	return false, start, nil
+}
+
+// disruptiveChanges lists the disruptive differences between the running and
+// desired guestbook containers: image updates and backend migrations
+func disruptiveChanges(current, desired *appsv1.Deployment) []string {
+	cur := current.Spec.Template.Spec.Containers
+	want := desired.Spec.Template.Spec.Containers
+	if len(cur) == 0 || len(want) == 0 {
+		return nil
+	}
+
+	var changes []string
+	if cur[0].Image != want[0].Image {
+		changes = append(changes, "image")
+	}
+	if envValue(cur[0].Env, "GUESTBOOK_BACKEND") != envValue(want[0].Env, "GUESTBOOK_BACKEND") {
+		changes = append(changes, "backend")
+	}
+	return changes
+}
+
+// envValue returns the literal value of the named variable, or ""
+func envValue(env []corev1.EnvVar, name string) string {
+	for _, e := range env {
+		if e.Name == name {
+			return e.Value
+		}
+	}
+	return ""
+}
+
+// applyMaintenanceWindow holds disruptive pod template changes until the
+// maintenance window opens. When changes are held, the running pod template
+// is copied into desired so that non-disruptive fields such as replicas are
+// still applied, and the returned duration is the time until the window
+// opens. It also records the PendingChanges condition on the GuestBook.
+func (r *GuestBookReconciler) applyMaintenanceWindow(ctx context.Context, gb *webappv1alpha1.GuestBook, desired *appsv1.Deployment) (time.Duration, error) {
+	condition := metav1.Condition{
+		Type:               "PendingChanges",
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: gb.Generation,
+		Reason:             "NoPendingChanges",
+		Message:            "All changes are rolled out",
+	}
+	defer func() { meta.SetStatusCondition(&gb.Status.Conditions, condition) }()
+
+	window := gb.Spec.MaintenanceWindow
+	if window == nil {
+		return 0, nil
+	}
+
+	current := &appsv1.Deployment{}
+	err := r.Get(ctx, types.NamespacedName{Name: desired.Name, Namespace: desired.Namespace}, current)
+	if errors.IsNotFound(err) {
+		// Nothing running yet, so nothing to disrupt
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	changes := disruptiveChanges(current, desired)
+	if len(changes) == 0 {
+		return 0, nil
+	}
+
+	open, next, err := maintenanceWindowState(window, time.Now())
+	if err != nil {
+		r.recorder(ctx).Eventf(gb, corev1.EventTypeWarning, "InvalidMaintenanceWindow", "spec.maintenanceWindow: %v", err)
+		return 0, err
+	}
+	if open {
+		return 0, nil
+	}
+
+	desired.Spec.Template = *current.Spec.Template.DeepCopy()
+	condition.Status = metav1.ConditionTrue
+	condition.Reason = "OutsideMaintenanceWindow"
+	condition.Message = fmt.Sprintf("%s change queued until the maintenance window opens at %s",
+		strings.Join(changes, " and "), next.UTC().Format(time.RFC3339))
+	return time.Until(next), nil
+}
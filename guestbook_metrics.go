@@ -0,0 +1,159 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	webappv1alpha1 "github.com/yourusername/guestbook-operator/api/v1alpha1"
+)
+
+// metricsListTimeout bounds the cache read behind a metrics scrape
+const metricsListTimeout = 5 * time.Second
+
+var (
+	desiredReplicasDesc = prometheus.NewDesc("guestbook_desired_replicas",
+		"Number of guestbook pods the GuestBook asks for.",
+		[]string{"namespace", "name"}, nil)
+	availableReplicasDesc = prometheus.NewDesc("guestbook_available_replicas",
+		"Number of available guestbook pods.",
+		[]string{"namespace", "name"}, nil)
+	readyDesc = prometheus.NewDesc("guestbook_ready",
+		"Whether the GuestBook's Ready condition is True (1) or not (0).",
+		[]string{"namespace", "name"}, nil)
+	sinceSuccessDesc = prometheus.NewDesc("guestbook_seconds_since_last_successful_reconcile",
+		"Seconds since the GuestBook was last reconciled without error.",
+		[]string{"namespace", "name"}, nil)
+
+	// reconcileErrors counts failed GuestBook reconciles by reason
+	reconcileErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "guestbook_reconcile_errors_total",
+		Help: "Number of failed GuestBook reconciles, by reason.",
+	}, []string{"reason"})
+
+	// reconcileDuration times GuestBook reconciles by outcome
+	reconcileDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "guestbook_reconcile_duration_seconds",
+		Help:    "Time taken by GuestBook reconciles, by outcome: success, requeue, conflict or error.",
+		Buckets: []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"outcome"})
+)
+
+func init() {
+	ctrlmetrics.Registry.MustRegister(reconcileErrors, reconcileDuration)
+}
+
+// guestBookCollector reports the state of every GuestBook in the cache at
+// scrape time, so deleted GuestBooks drop out without any bookkeeping
+type guestBookCollector struct {
+	reader client.Reader
+}
+
+// registerGuestBookCollector adds the GuestBook state gauges to the
+// controller-runtime registry served on the metrics endpoint
+func registerGuestBookCollector(reader client.Reader) error {
+	return ctrlmetrics.Registry.Register(&guestBookCollector{reader: reader})
+}
+
+// Describe implements prometheus.Collector
+func (c *guestBookCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- desiredReplicasDesc
+	ch <- availableReplicasDesc
+	ch <- readyDesc
+	ch <- sinceSuccessDesc
+}
+
+// Collect implements prometheus.Collector
+func (c *guestBookCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), metricsListTimeout)
+	defer cancel()
+
+	guestbooks := &webappv1alpha1.GuestBookList{}
+	if err := c.reader.List(ctx, guestbooks); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list GuestBooks for metrics")
+		ch <- prometheus.NewInvalidMetric(desiredReplicasDesc, err)
+		return
+	}
+	for i := range guestbooks.Items {
+		gb := &guestbooks.Items[i]
+		ready := 0.0
+		if meta.IsStatusConditionTrue(gb.Status.Conditions, conditionReady) {
+			ready = 1
+		}
+		ch <- prometheus.MustNewConstMetric(desiredReplicasDesc, prometheus.GaugeValue, float64(metricsDesiredReplicas(gb)), gb.Namespace, gb.Name)
+		ch <- prometheus.MustNewConstMetric(availableReplicasDesc, prometheus.GaugeValue, float64(gb.Status.AvailableReplicas), gb.Namespace, gb.Name)
+		ch <- prometheus.MustNewConstMetric(readyDesc, prometheus.GaugeValue, ready, gb.Namespace, gb.Name)
+		if last := gb.Status.LastSuccessfulReconcileTime; last != nil {
+			ch <- prometheus.MustNewConstMetric(sinceSuccessDesc, prometheus.GaugeValue, time.Since(last.Time).Seconds(), gb.Namespace, gb.Name)
+		}
+	}
+}
+
+// metricsDesiredReplicas returns the replica count the GuestBook currently
+// asks for. Under autoscaling that is what the HorizontalPodAutoscaler last
+// chose, as reported through the scale subresource.
+func metricsDesiredReplicas(gb *webappv1alpha1.GuestBook) int32 {
+	switch {
+	case gb.Spec.Suspend && gb.Spec.ScaleToZeroWhenSuspended:
+		return 0
+	case gb.Spec.Autoscaling != nil && gb.Status.Replicas > 0:
+		return gb.Status.Replicas
+	}
+	return desiredReplicas(gb)
+}
+
+// reconcileOutcome labels a finished reconcile for the duration histogram.
+// Conflicts are told apart from other errors since they only mean the
+// cache was behind and are retried at once.
+func reconcileOutcome(result ctrl.Result, err error, timedOut bool) string {
+	switch {
+	case timedOut:
+		return "error"
+	case apierrors.IsConflict(err):
+		return "conflict"
+	case err != nil:
+		return "error"
+	case result.Requeue || result.RequeueAfter > 0:
+		return "requeue"
+	}
+	return "success"
+}
+
+// reconcileErrorReason buckets a reconcile error for the error counter,
+// keeping the label set small
+func reconcileErrorReason(err error, timedOut bool) string {
+	if timedOut || errors.Is(err, context.DeadlineExceeded) {
+		return "Timeout"
+	}
+	if reason := apierrors.ReasonForError(err); reason != "" {
+		return string(reason)
+	}
+	if errors.Is(err, errAppNotFound) {
+		return "AppNotFound"
+	}
+	return "Other"
+}
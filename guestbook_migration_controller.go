@@ -0,0 +1,281 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	webappv1alpha1 "github.com/yourusername/guestbook-operator/api/v1alpha1"
+)
+
+// migrationRetryInterval is how often a migration waiting on its GuestBook
+// is rechecked
+const migrationRetryInterval = 10 * time.Second
+
+// migrationExportKey is the ConfigMap key holding the exported entries
+const migrationExportKey = "entries.json"
+
+// BackendMigrationReconciler moves a GuestBook's entries to a new backend.
+// The GuestBook is made read-only, its entries exported into a ConfigMap,
+// its backend switched, and the entries imported once the new backend is up.
+type BackendMigrationReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+
+	// HTTPClient is used to call the guestbook admin API; a client with a
+	// short timeout is used when nil
+	HTTPClient *http.Client
+
+	// Recorder emits events on migrations; SetupWithManager fills it in
+	// from the manager when nil
+	Recorder record.EventRecorder
+}
+
+// +kubebuilder:rbac:groups=webapp.example.com,resources=guestbookbackendmigrations,verbs=get;list;watch;update;patch
+// +kubebuilder:rbac:groups=webapp.example.com,resources=guestbookbackendmigrations/status,verbs=get;update;patch
+
+// Reconcile advances a migration by at most one phase
+func (r *BackendMigrationReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	migration := &webappv1alpha1.GuestBookBackendMigration{}
+	if err := r.Get(ctx, req.NamespacedName, migration); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	phase := migration.Status.Phase
+	if phase == webappv1alpha1.MigrationSucceeded || phase == webappv1alpha1.MigrationFailed {
+		return ctrl.Result{}, nil
+	}
+	base := migration.DeepCopy()
+
+	gb := &webappv1alpha1.GuestBook{}
+	err := r.Get(ctx, types.NamespacedName{Name: migration.Spec.GuestBookName, Namespace: migration.Namespace}, gb)
+	var result ctrl.Result
+	switch {
+	case errors.IsNotFound(err):
+		r.fail(migration, "GuestBookNotFound", fmt.Sprintf("GuestBook %s not found", migration.Spec.GuestBookName))
+		err = nil
+	case err != nil:
+		return ctrl.Result{}, err
+	case phase == "" || phase == webappv1alpha1.MigrationPending:
+		result, err = r.start(ctx, migration, gb)
+	case phase == webappv1alpha1.MigrationExporting:
+		result, err = r.export(ctx, migration, gb)
+	case phase == webappv1alpha1.MigrationSwitching:
+		result, err = r.switchBackend(ctx, migration, gb)
+	case phase == webappv1alpha1.MigrationImporting:
+		result, err = r.importEntries(ctx, migration, gb)
+	}
+	if err != nil {
+		log.Error(err, "Backend migration step failed", "phase", phase)
+		return ctrl.Result{}, err
+	}
+
+	if migration.Status.Phase != phase && migration.Status.Phase != webappv1alpha1.MigrationFailed {
+		log.Info("Backend migration advanced", "from", phase, "to", migration.Status.Phase)
+		r.Recorder.Event(migration, corev1.EventTypeNormal, string(migration.Status.Phase), migration.Status.Message)
+	}
+	if err := r.Status().Patch(ctx, migration, client.MergeFrom(base)); err != nil {
+		return ctrl.Result{}, err
+	}
+	return result, nil
+}
+
+// start makes the GuestBook read-only so no entry is written after the export
+func (r *BackendMigrationReconciler) start(ctx context.Context, migration *webappv1alpha1.GuestBookBackendMigration, gb *webappv1alpha1.GuestBook) (ctrl.Result, error) {
+	if gb.Spec.Backend.Type == migration.Spec.Backend.Type {
+		r.fail(migration, "AlreadyOnBackend", fmt.Sprintf("GuestBook already uses the %s backend", gb.Spec.Backend.Type))
+		return ctrl.Result{}, nil
+	}
+
+	now := metav1.Now()
+	migration.Status.StartTime = &now
+	migration.Status.SourceBackend = gb.Spec.Backend.Type
+	migration.Status.ReadOnlyBefore = gb.Spec.ReadOnly
+
+	// Toggling readOnly restarts the pods, which would wipe an in-memory
+	// store before it is exported, so those stay writable
+	if gb.Spec.Backend.Type != webappv1alpha1.BackendInMemory && !gb.Spec.ReadOnly {
+		if err := r.patchGuestBook(ctx, gb, func(gb *webappv1alpha1.GuestBook) {
+			gb.Spec.ReadOnly = true
+		}); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	setMigrationPhase(migration, webappv1alpha1.MigrationExporting, "Exporting entries from the %s backend", gb.Spec.Backend.Type)
+	return ctrl.Result{RequeueAfter: migrationRetryInterval}, nil
+}
+
+// export copies the entries into a ConfigMap owned by the migration, once the
+// GuestBook serves the read-only configuration
+func (r *BackendMigrationReconciler) export(ctx context.Context, migration *webappv1alpha1.GuestBookBackendMigration, gb *webappv1alpha1.GuestBook) (ctrl.Result, error) {
+	if !guestBookSettled(gb) {
+		return ctrl.Result{RequeueAfter: migrationRetryInterval}, nil
+	}
+
+	app, err := newAppClient(ctx, r.Client, r.HTTPClient, gb)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	data, err := app.exportEntries(ctx)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("exporting entries: %w", err)
+	}
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      migrationExportName(migration),
+			Namespace: migration.Namespace,
+		},
+		BinaryData: map[string][]byte{migrationExportKey: data},
+	}
+	if err := controllerutil.SetControllerReference(migration, cm, r.Scheme); err != nil {
+		return ctrl.Result{}, err
+	}
+	// A retry after a failed status write finds the export already there;
+	// replace it, since the entries may have changed if the GuestBook is writable
+	err = r.Create(ctx, cm)
+	if errors.IsAlreadyExists(err) {
+		existing := &corev1.ConfigMap{}
+		if err := r.Get(ctx, client.ObjectKeyFromObject(cm), existing); err != nil {
+			return ctrl.Result{}, err
+		}
+		existing.BinaryData = cm.BinaryData
+		err = r.Update(ctx, existing)
+	}
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	setMigrationPhase(migration, webappv1alpha1.MigrationSwitching, "Exported %d bytes of entries, switching to the %s backend",
+		len(data), migration.Spec.Backend.Type)
+	return ctrl.Result{Requeue: true}, nil
+}
+
+// switchBackend points the GuestBook at the new backend. The migration
+// annotation lets the webhook accept the otherwise immutable change.
+func (r *BackendMigrationReconciler) switchBackend(ctx context.Context, migration *webappv1alpha1.GuestBookBackendMigration, gb *webappv1alpha1.GuestBook) (ctrl.Result, error) {
+	if gb.Spec.Backend.Type != migration.Spec.Backend.Type {
+		if err := r.patchGuestBook(ctx, gb, func(gb *webappv1alpha1.GuestBook) {
+			metav1.SetMetaDataAnnotation(&gb.ObjectMeta, webappv1alpha1.BackendMigrationAnnotation, migration.Name)
+			gb.Spec.Backend = *migration.Spec.Backend.DeepCopy()
+		}); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	setMigrationPhase(migration, webappv1alpha1.MigrationImporting, "Waiting for the %s backend to become ready", migration.Spec.Backend.Type)
+	return ctrl.Result{RequeueAfter: migrationRetryInterval}, nil
+}
+
+// importEntries loads the export into the new backend and gives the
+// GuestBook back its original readOnly setting
+func (r *BackendMigrationReconciler) importEntries(ctx context.Context, migration *webappv1alpha1.GuestBookBackendMigration, gb *webappv1alpha1.GuestBook) (ctrl.Result, error) {
+	if !guestBookSettled(gb) || !meta.IsStatusConditionTrue(gb.Status.Conditions, "BackendReady") {
+		return ctrl.Result{RequeueAfter: migrationRetryInterval}, nil
+	}
+
+	cm := &corev1.ConfigMap{}
+	err := r.Get(ctx, types.NamespacedName{Name: migrationExportName(migration), Namespace: migration.Namespace}, cm)
+	if errors.IsNotFound(err) {
+		r.fail(migration, "ExportNotFound", fmt.Sprintf("ConfigMap %s with the exported entries not found", migrationExportName(migration)))
+		return ctrl.Result{}, nil
+	} else if err != nil {
+		return ctrl.Result{}, err
+	}
+	app, err := newAppClient(ctx, r.Client, r.HTTPClient, gb)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := app.importEntries(ctx, cm.BinaryData[migrationExportKey]); err != nil {
+		return ctrl.Result{}, fmt.Errorf("importing entries: %w", err)
+	}
+
+	readOnly := migration.Status.ReadOnlyBefore
+	if err := r.patchGuestBook(ctx, gb, func(gb *webappv1alpha1.GuestBook) {
+		delete(gb.Annotations, webappv1alpha1.BackendMigrationAnnotation)
+		gb.Spec.ReadOnly = readOnly
+	}); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	now := metav1.Now()
+	migration.Status.CompletionTime = &now
+	setMigrationPhase(migration, webappv1alpha1.MigrationSucceeded, "Moved entries from the %s backend to the %s backend",
+		migration.Status.SourceBackend, migration.Spec.Backend.Type)
+	return ctrl.Result{}, nil
+}
+
+// fail records a migration as Failed. The GuestBook is left as it is, so an
+// operator can look at it before deciding how to recover.
+func (r *BackendMigrationReconciler) fail(migration *webappv1alpha1.GuestBookBackendMigration, reason, message string) {
+	now := metav1.Now()
+	migration.Status.CompletionTime = &now
+	setMigrationPhase(migration, webappv1alpha1.MigrationFailed, "%s", message)
+	r.Recorder.Event(migration, corev1.EventTypeWarning, reason, message)
+}
+
+// patchGuestBook applies mutate to the GuestBook, failing on a conflicting
+// write rather than overwriting it
+func (r *BackendMigrationReconciler) patchGuestBook(ctx context.Context, gb *webappv1alpha1.GuestBook, mutate func(*webappv1alpha1.GuestBook)) error {
+	base := gb.DeepCopy()
+	mutate(gb)
+	return r.Patch(ctx, gb, client.MergeFromWithOptions(base, client.MergeFromWithOptimisticLock{}))
+}
+
+// setMigrationPhase moves a migration to phase with a formatted message
+func setMigrationPhase(migration *webappv1alpha1.GuestBookBackendMigration, phase webappv1alpha1.MigrationPhase, format string, args ...interface{}) {
+	migration.Status.Phase = phase
+	migration.Status.Message = fmt.Sprintf(format, args...)
+}
+
+// guestBookSettled reports whether the GuestBook has rolled out its current
+// spec and is serving
+func guestBookSettled(gb *webappv1alpha1.GuestBook) bool {
+	return gb.Status.ObservedGeneration == gb.Generation &&
+		meta.IsStatusConditionTrue(gb.Status.Conditions, conditionReady)
+}
+
+// migrationExportName is the name of the ConfigMap holding a migration's export
+func migrationExportName(migration *webappv1alpha1.GuestBookBackendMigration) string {
+	return migration.Name + "-export"
+}
+
+// SetupWithManager sets up the controller with the Manager
+func (r *BackendMigrationReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.Recorder == nil {
+		r.Recorder = mgr.GetEventRecorderFor("backendmigration-controller")
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&webappv1alpha1.GuestBookBackendMigration{}).
+		Owns(&corev1.ConfigMap{}).
+		Complete(r)
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// BackendMigrationAnnotation names the GuestBookBackendMigration that is
+// switching a GuestBook's backend. The webhook only lets spec.backend.type
+// change while it is set.
+const BackendMigrationAnnotation = "webapp.example.com/backend-migration"
+
+// GuestBookBackendMigrationSpec defines the desired state of GuestBookBackendMigration
+type GuestBookBackendMigrationSpec struct {
+	// GuestBookName is the GuestBook in the same namespace to migrate
+	// +kubebuilder:validation:MinLength=1
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="guestBookName is immutable"
+	GuestBookName string `json:"guestBookName"`
+
+	// Backend is the backend the GuestBook's entries are moved to
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="backend is immutable"
+	Backend GuestBookBackendSpec `json:"backend"`
+}
+
+// MigrationPhase is a coarse summary of where a backend migration is
+// +kubebuilder:validation:Enum=Pending;Exporting;Switching;Importing;Succeeded;Failed
+type MigrationPhase string
+
+const (
+	// MigrationPending means the migration hasn't started
+	MigrationPending MigrationPhase = "Pending"
+
+	// MigrationExporting means the GuestBook is read-only and its entries are being exported
+	MigrationExporting MigrationPhase = "Exporting"
+
+	// MigrationSwitching means the GuestBook is being moved to the new backend
+	MigrationSwitching MigrationPhase = "Switching"
+
+	// MigrationImporting means the exported entries are being loaded into the new backend
+	MigrationImporting MigrationPhase = "Importing"
+
+	// MigrationSucceeded means the entries were moved and the GuestBook is writable again
+	MigrationSucceeded MigrationPhase = "Succeeded"
+
+	// MigrationFailed means the migration stopped; see the message for why
+	MigrationFailed MigrationPhase = "Failed"
+)
+
+// GuestBookBackendMigrationStatus defines the observed state of GuestBookBackendMigration
+type GuestBookBackendMigrationStatus struct {
+	// Phase is where the migration is
+	// +optional
+	Phase MigrationPhase `json:"phase,omitempty"`
+
+	// Message explains the phase, e.g. why the migration failed
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// SourceBackend is the backend type the GuestBook had when the migration started
+	// +optional
+	SourceBackend BackendType `json:"sourceBackend,omitempty"`
+
+	// ReadOnlyBefore is the GuestBook's spec.readOnly before the migration
+	// made it read-only, restored once the entries are imported
+	// +optional
+	ReadOnlyBefore bool `json:"readOnlyBefore,omitempty"`
+
+	// StartTime is when the migration left Pending
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// CompletionTime is when the migration succeeded or failed
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:shortName=gbmig
+// +kubebuilder:printcolumn:name="GuestBook",type=string,JSONPath=`.spec.guestBookName`
+// +kubebuilder:printcolumn:name="From",type=string,JSONPath=`.status.sourceBackend`
+// +kubebuilder:printcolumn:name="To",type=string,JSONPath=`.spec.backend.type`
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// GuestBookBackendMigration moves a GuestBook's entries to another backend.
+// spec.backend.type can't be edited on the GuestBook directly, because the
+// new backend would start empty. The entries pass through a ConfigMap, which
+// limits a migration to about 1MiB of exported data.
+type GuestBookBackendMigration struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   GuestBookBackendMigrationSpec   `json:"spec,omitempty"`
+	Status GuestBookBackendMigrationStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// GuestBookBackendMigrationList contains a list of GuestBookBackendMigration
+type GuestBookBackendMigrationList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []GuestBookBackendMigration `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&GuestBookBackendMigration{}, &GuestBookBackendMigrationList{})
+}
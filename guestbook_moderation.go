@@ -0,0 +1,193 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	webappv1alpha1 "github.com/yourusername/guestbook-operator/api/v1alpha1"
+)
+
+// moderationMountPath is where the compiled moderation policy is mounted in
+// the container. The ConfigMap is mounted as a whole directory, not with
+// subPath, so the kubelet swaps in edits and the app reloads the file.
+const moderationMountPath = "/etc/guestbook/moderation"
+
+// moderationPolicyIndex is the cache index of GuestBooks by ModerationPolicy name
+const moderationPolicyIndex = "spec.moderation.policyRef.name"
+
+// moderationConfig is the compiled policy the app reads from policy.json
+type moderationConfig struct {
+	// BlockedPattern is a case-insensitive regular expression matching any
+	// blocked word
+	BlockedPattern   string                 `json:"blockedPattern,omitempty"`
+	MaxMessageLength int32                  `json:"maxMessageLength,omitempty"`
+	Links            moderationLinks        `json:"links"`
+	AutoApprove      *moderationAutoApprove `json:"autoApprove,omitempty"`
+}
+
+// moderationLinks is the compiled link policy
+type moderationLinks struct {
+	Policy         string   `json:"policy"`
+	AllowedDomains []string `json:"allowedDomains,omitempty"`
+}
+
+// moderationAutoApprove is the compiled set of auto-approve rules
+type moderationAutoApprove struct {
+	Authors      []string `json:"authors,omitempty"`
+	WithoutLinks bool     `json:"withoutLinks,omitempty"`
+	MaxLength    int32    `json:"maxLength,omitempty"`
+}
+
+// moderationConfigMapName is the name of the ConfigMap holding the compiled policy
+func moderationConfigMapName(gb *webappv1alpha1.GuestBook) string {
+	return gb.Name + "-moderation"
+}
+
+// resolveModerationPolicy returns the ModerationPolicy the GuestBook
+// references, or nil when it references none or the policy is missing
+func (r *GuestBookReconciler) resolveModerationPolicy(ctx context.Context, gb *webappv1alpha1.GuestBook) (*webappv1alpha1.ModerationPolicySpec, error) {
+	ref := gb.Spec.Moderation.PolicyRef
+	if ref == nil {
+		meta.RemoveStatusCondition(&gb.Status.Conditions, "ModerationPolicyResolved")
+		return nil, nil
+	}
+
+	policy := &webappv1alpha1.ModerationPolicy{}
+	err := r.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: gb.Namespace}, policy)
+	if errors.IsNotFound(err) {
+		message := fmt.Sprintf("ModerationPolicy %s not found; entries are only checked by the built-in rules", ref.Name)
+		if setCondition(gb, "ModerationPolicyResolved", metav1.ConditionFalse, "PolicyNotFound", message) {
+			r.recorder(ctx).Event(gb, corev1.EventTypeWarning, "ModerationPolicyNotFound", message)
+		}
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("ModerationPolicy %q: %w", ref.Name, err)
+	}
+
+	setCondition(gb, "ModerationPolicyResolved", metav1.ConditionTrue, "PolicyFound",
+		fmt.Sprintf("Using ModerationPolicy %s (generation %d)", policy.Name, policy.Generation))
+	return &policy.Spec, nil
+}
+
+// moderationConfigMapForGuestBook creates the ConfigMap with the compiled
+// policy. It is kept out of the config hash, so edits reload in place
+// instead of rolling the Deployment.
+func (r *GuestBookReconciler) moderationConfigMapForGuestBook(gb *webappv1alpha1.GuestBook, policy *webappv1alpha1.ModerationPolicySpec) (*corev1.ConfigMap, error) {
+	data, err := json.Marshal(compileModerationPolicy(policy))
+	if err != nil {
+		return nil, err
+	}
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      moderationConfigMapName(gb),
+			Namespace: gb.Namespace,
+			Labels:    labelsForGuestBook(gb.Name),
+		},
+		Data: map[string]string{
+			"policy.json": string(data),
+		},
+	}, nil
+}
+
+// compileModerationPolicy turns a policy into the form the app evaluates,
+// normalising case and order so equal policies compile identically
+func compileModerationPolicy(policy *webappv1alpha1.ModerationPolicySpec) moderationConfig {
+	config := moderationConfig{
+		MaxMessageLength: policy.MaxMessageLength,
+		Links: moderationLinks{
+			Policy:         string(policy.LinkPolicy),
+			AllowedDomains: normalizeWords(policy.AllowedLinkDomains),
+		},
+	}
+	if config.Links.Policy == "" {
+		config.Links.Policy = string(webappv1alpha1.LinkPolicyAllow)
+	}
+
+	if words := normalizeWords(policy.BlockedWords); len(words) > 0 {
+		quoted := make([]string, len(words))
+		for i, w := range words {
+			quoted[i] = regexp.QuoteMeta(w)
+		}
+		config.BlockedPattern = `(?i)\b(` + strings.Join(quoted, "|") + `)\b`
+	}
+
+	if rules := policy.AutoApprove; rules != nil {
+		authors := append([]string(nil), rules.Authors...)
+		sort.Strings(authors)
+		config.AutoApprove = &moderationAutoApprove{
+			Authors:      authors,
+			WithoutLinks: rules.WithoutLinks,
+			MaxLength:    rules.MaxLength,
+		}
+	}
+	return config
+}
+
+// normalizeWords lowercases, trims, deduplicates and sorts a word list
+func normalizeWords(words []string) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, w := range words {
+		w = strings.ToLower(strings.TrimSpace(w))
+		if w == "" || seen[w] {
+			continue
+		}
+		seen[w] = true
+		out = append(out, w)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// moderationPolicyForGuestBook indexes a GuestBook by the ModerationPolicy
+// it references
+func moderationPolicyForGuestBook(obj client.Object) []string {
+	gb := obj.(*webappv1alpha1.GuestBook)
+	if ref := gb.Spec.Moderation.PolicyRef; ref != nil {
+		return []string{ref.Name}
+	}
+	return nil
+}
+
+// findGuestBooksForModerationPolicy maps a ModerationPolicy to the
+// GuestBooks in its namespace that use it
+func (r *GuestBookReconciler) findGuestBooksForModerationPolicy(ctx context.Context, policy client.Object) []reconcile.Request {
+	guestbooks := &webappv1alpha1.GuestBookList{}
+	err := r.List(ctx, guestbooks,
+		client.InNamespace(policy.GetNamespace()),
+		client.MatchingFields{moderationPolicyIndex: policy.GetName()})
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list GuestBooks for ModerationPolicy", "policy", policy.GetName())
+		return nil
+	}
+	return requestsForGuestBooks(guestbooks)
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// LinkPolicy is what happens to entries containing links
+// +kubebuilder:validation:Enum=Allow;Moderate;Block
+type LinkPolicy string
+
+const (
+	// LinkPolicyAllow treats links like any other text
+	LinkPolicyAllow LinkPolicy = "Allow"
+	// LinkPolicyModerate queues entries with links for review
+	LinkPolicyModerate LinkPolicy = "Moderate"
+	// LinkPolicyBlock rejects entries with links
+	LinkPolicyBlock LinkPolicy = "Block"
+)
+
+// AutoApproveRules select entries that skip the moderation queue
+type AutoApproveRules struct {
+	// Authors whose entries are approved without review
+	// +listType=set
+	// +optional
+	Authors []string `json:"authors,omitempty"`
+
+	// WithoutLinks approves entries that contain no links
+	// +optional
+	WithoutLinks bool `json:"withoutLinks,omitempty"`
+
+	// MaxLength approves entries no longer than this many characters
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxLength int32 `json:"maxLength,omitempty"`
+}
+
+// ModerationPolicySpec defines the rules new entries are checked against.
+// Entries breaking a rule are rejected; the auto-approve rules only matter
+// when the GuestBook has moderation enabled.
+type ModerationPolicySpec struct {
+	// BlockedWords reject entries containing any of them as a whole word,
+	// ignoring case
+	// +listType=set
+	// +optional
+	BlockedWords []string `json:"blockedWords,omitempty"`
+
+	// MaxMessageLength rejects longer entries
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=2000
+	// +optional
+	MaxMessageLength int32 `json:"maxMessageLength,omitempty"`
+
+	// LinkPolicy is what happens to entries containing links
+	// +kubebuilder:default=Allow
+	LinkPolicy LinkPolicy `json:"linkPolicy,omitempty"`
+
+	// AllowedLinkDomains are exempt from the link policy, subdomains
+	// included
+	// +listType=set
+	// +optional
+	AllowedLinkDomains []string `json:"allowedLinkDomains,omitempty"`
+
+	// AutoApprove selects entries that skip the moderation queue
+	// +optional
+	AutoApprove *AutoApproveRules `json:"autoApprove,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=modpol
+// +kubebuilder:printcolumn:name="Link Policy",type=string,JSONPath=`.spec.linkPolicy`
+// +kubebuilder:printcolumn:name="Max Length",type=integer,JSONPath=`.spec.maxMessageLength`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// ModerationPolicy is a set of moderation rules for the GuestBooks in its
+// namespace, referenced by spec.moderation.policyRef. Edits reach running
+// guestbooks without a restart.
+type ModerationPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ModerationPolicySpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ModerationPolicyList contains a list of ModerationPolicy
+type ModerationPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ModerationPolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ModerationPolicy{}, &ModerationPolicyList{})
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	webappv1alpha1 "github.com/yourusername/guestbook-operator/api/v1alpha1"
+)
+
+// defaultMetricsPort is the app's /metrics port when spec.monitoring.port is unset
+const defaultMetricsPort int32 = 9090
+
+// serviceMonitorGVK identifies Prometheus Operator ServiceMonitors, which are
+// handled as unstructured objects so the operator runs without those CRDs
+var serviceMonitorGVK = schema.GroupVersionKind{Group: "monitoring.coreos.com", Version: "v1", Kind: "ServiceMonitor"}
+
+// metricsPortForGuestBook returns the port the app serves /metrics on
+func metricsPortForGuestBook(gb *webappv1alpha1.GuestBook) int32 {
+	if gb.Spec.Monitoring.Port != 0 {
+		return gb.Spec.Monitoring.Port
+	}
+	return defaultMetricsPort
+}
+
+// serviceMonitorForGuestBook creates a ServiceMonitor scraping the metrics
+// port of the guestbook Service
+func (r *GuestBookReconciler) serviceMonitorForGuestBook(gb *webappv1alpha1.GuestBook) *unstructured.Unstructured {
+	labels := map[string]string{}
+	for k, v := range gb.Spec.Monitoring.Labels {
+		labels[k] = v
+	}
+	for k, v := range labelsForGuestBook(gb.Name) {
+		labels[k] = v
+	}
+
+	matchLabels := map[string]interface{}{}
+	for k, v := range selectorLabelsForGuestBook(gb.Name) {
+		matchLabels[k] = v
+	}
+	endpoint := map[string]interface{}{
+		"port": "metrics",
+		"path": "/metrics",
+	}
+	if interval := gb.Spec.Monitoring.Interval; interval != "" {
+		endpoint["interval"] = interval
+	}
+
+	serviceMonitor := &unstructured.Unstructured{}
+	serviceMonitor.SetGroupVersionKind(serviceMonitorGVK)
+	serviceMonitor.SetName(gb.Name)
+	serviceMonitor.SetNamespace(gb.Namespace)
+	serviceMonitor.SetLabels(labels)
+	serviceMonitor.Object["spec"] = map[string]interface{}{
+		"selector":  map[string]interface{}{"matchLabels": matchLabels},
+		"endpoints": []interface{}{endpoint},
+	}
+	return serviceMonitor
+}
+
+// reconcileServiceMonitor applies the ServiceMonitor and records whether
+// Prometheus will find the guestbook. Without the Prometheus Operator the
+// metrics port is still served, for scrapers configured by other means.
+func (r *GuestBookReconciler) reconcileServiceMonitor(ctx context.Context, gb *webappv1alpha1.GuestBook) error {
+	if !gb.Spec.Monitoring.Enabled {
+		meta.RemoveStatusCondition(&gb.Status.Conditions, "Monitoring")
+		return nil
+	}
+
+	err := r.apply(ctx, r.serviceMonitorForGuestBook(gb), gb)
+	if meta.IsNoMatchError(err) {
+		message := "ServiceMonitor CRD not installed; /metrics is served but nothing is configured to scrape it"
+		if setCondition(gb, "Monitoring", metav1.ConditionFalse, "PrometheusOperatorMissing", message) {
+			r.recorder(ctx).Event(gb, corev1.EventTypeWarning, "PrometheusOperatorMissing", message)
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	setCondition(gb, "Monitoring", metav1.ConditionTrue, "ServiceMonitorCreated", "ServiceMonitor "+gb.Name+" scrapes /metrics")
+	return nil
+}
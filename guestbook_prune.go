@@ -0,0 +1,109 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	webappv1alpha1 "github.com/yourusername/guestbook-operator/api/v1alpha1"
+)
+
+// prunableLists returns an empty list for every kind of child the controller
+// may create. Jobs are left out: the cleanup Job only exists during teardown.
+func prunableLists() []client.ObjectList {
+	certificates := &unstructured.UnstructuredList{}
+	certificates.SetGroupVersionKind(certificateGVK.GroupVersion().WithKind(certificateGVK.Kind + "List"))
+	serviceMonitors := &unstructured.UnstructuredList{}
+	serviceMonitors.SetGroupVersionKind(serviceMonitorGVK.GroupVersion().WithKind(serviceMonitorGVK.Kind + "List"))
+
+	return []client.ObjectList{
+		&appsv1.DeploymentList{},
+		&appsv1.StatefulSetList{},
+		&corev1.ServiceList{},
+		&corev1.ConfigMapList{},
+		&corev1.SecretList{},
+		&corev1.ServiceAccountList{},
+		&corev1.PersistentVolumeClaimList{},
+		&networkingv1.IngressList{},
+		&networkingv1.NetworkPolicyList{},
+		&autoscalingv2.HorizontalPodAutoscalerList{},
+		&policyv1.PodDisruptionBudgetList{},
+		&batchv1.CronJobList{},
+		certificates,
+		serviceMonitors,
+	}
+}
+
+// pruneChildren deletes the children this GuestBook controls that weren't
+// written during the current reconcile, such as the Ingress after ingress is
+// disabled or the Redis objects after switching backends. Like an applyset,
+// the set of live children is found by label and ownership, and anything
+// outside the desired set is removed.
+func (r *GuestBookReconciler) pruneChildren(ctx context.Context, gb *webappv1alpha1.GuestBook, state *applyState) error {
+	log := log.FromContext(ctx)
+
+	for _, list := range prunableLists() {
+		err := r.List(ctx, list, client.InNamespace(gb.Namespace), client.MatchingLabels{"guestbook": gb.Name})
+		if meta.IsNoMatchError(err) {
+			// cert-manager or the Prometheus Operator isn't installed, so
+			// there's nothing of that kind
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		err = meta.EachListItem(list, func(o runtime.Object) error {
+			obj := o.(client.Object)
+			if !metav1.IsControlledBy(obj, gb) {
+				return nil
+			}
+			gvk, err := apiutil.GVKForObject(obj, r.Scheme)
+			if err != nil {
+				return err
+			}
+			if state.desired[gvk.Kind+"/"+obj.GetName()] {
+				return nil
+			}
+
+			log.Info("Pruning resource", "kind", gvk.Kind, "name", obj.GetName())
+			err = r.Delete(ctx, obj, client.PropagationPolicy(metav1.DeletePropagationBackground))
+			if err != nil {
+				return client.IgnoreNotFound(err)
+			}
+			r.expectations.expectDelete(client.ObjectKeyFromObject(gb), obj)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
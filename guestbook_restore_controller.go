@@ -0,0 +1,309 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	webappv1alpha1 "github.com/yourusername/guestbook-operator/api/v1alpha1"
+)
+
+// restoreRetryInterval is how often a restore with failing pre-flight checks
+// is rechecked
+const restoreRetryInterval = 30 * time.Second
+
+// downloadScript fetches the snapshot and, when a checksum is known, checks
+// it before anything is imported
+const downloadScript = `set -e
+aws s3 cp "$SOURCE" ` + snapshotPath + `
+if [ -n "$CHECKSUM" ]; then
+  echo "${CHECKSUM#sha256:}  ` + snapshotPath + `" | sha256sum -c -
+fi
+`
+
+const (
+	// conditionValidated is True once the restore's pre-flight checks pass
+	conditionValidated = "Validated"
+
+	// conditionRestored is True once the snapshot is loaded
+	conditionRestored = "Restored"
+)
+
+// restoreSnapshot is a restore source resolved to the object to download
+type restoreSnapshot struct {
+	location string
+	store    webappv1alpha1.ObjectStoreLocation
+	checksum string
+}
+
+// RestoreReconciler loads GuestBookBackup snapshots back into GuestBooks
+type RestoreReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+
+	// HTTPClient is used to query the guestbook admin API; a client with a
+	// short timeout is used when nil
+	HTTPClient *http.Client
+
+	// Recorder emits events on restores; SetupWithManager fills it in from
+	// the manager when nil
+	Recorder record.EventRecorder
+}
+
+// +kubebuilder:rbac:groups=webapp.example.com,resources=guestbookrestores,verbs=get;list;watch
+// +kubebuilder:rbac:groups=webapp.example.com,resources=guestbookrestores/status,verbs=get;update;patch
+
+// Reconcile checks that a restore can run, starts its Job and records the outcome
+func (r *RestoreReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	restore := &webappv1alpha1.GuestBookRestore{}
+	if err := r.Get(ctx, req.NamespacedName, restore); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if restore.Status.Phase == webappv1alpha1.RestoreCompleted || restore.Status.Phase == webappv1alpha1.RestoreFailed {
+		return ctrl.Result{}, nil
+	}
+	base := restore.DeepCopy()
+
+	result, err := r.reconcileRestore(ctx, restore)
+	if err != nil {
+		log.Error(err, "Failed to reconcile restore")
+		return ctrl.Result{}, err
+	}
+	return result, r.Status().Patch(ctx, restore, client.MergeFrom(base))
+}
+
+// reconcileRestore advances the restore's status, starting the Job once the
+// pre-flight checks pass
+func (r *RestoreReconciler) reconcileRestore(ctx context.Context, restore *webappv1alpha1.GuestBookRestore) (ctrl.Result, error) {
+	job := &batchv1.Job{}
+	err := r.Get(ctx, types.NamespacedName{Name: restoreJobName(restore), Namespace: restore.Namespace}, job)
+	if err == nil {
+		r.trackJob(restore, job)
+		return ctrl.Result{}, nil
+	} else if !errors.IsNotFound(err) {
+		return ctrl.Result{}, err
+	}
+
+	gb, snapshot, err := r.preflight(ctx, restore)
+	if err != nil || snapshot == nil {
+		restore.Status.Phase = webappv1alpha1.RestorePending
+		return ctrl.Result{RequeueAfter: restoreRetryInterval}, err
+	}
+
+	job = restoreJob(restore, gb, snapshot)
+	if err := controllerutil.SetControllerReference(restore, job, r.Scheme); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.Create(ctx, job); err != nil && !errors.IsAlreadyExists(err) {
+		return ctrl.Result{}, err
+	}
+
+	now := metav1.Now()
+	restore.Status.JobName = job.Name
+	restore.Status.StartTime = &now
+	restore.Status.Phase = webappv1alpha1.RestoreRunning
+	r.setCondition(restore, conditionRestored, metav1.ConditionFalse, "Running",
+		fmt.Sprintf("Job %s is loading %s", job.Name, snapshot.location))
+	return ctrl.Result{}, nil
+}
+
+// preflight checks that the target GuestBook is ready, the snapshot exists
+// and, unless forced, that the GuestBook has no entries yet. It returns a nil
+// snapshot, with the Validated condition saying why, when a check fails.
+func (r *RestoreReconciler) preflight(ctx context.Context, restore *webappv1alpha1.GuestBookRestore) (*webappv1alpha1.GuestBook, *restoreSnapshot, error) {
+	notValid := func(reason, message string) (*webappv1alpha1.GuestBook, *restoreSnapshot, error) {
+		r.setCondition(restore, conditionValidated, metav1.ConditionFalse, reason, message)
+		return nil, nil, nil
+	}
+
+	gb := &webappv1alpha1.GuestBook{}
+	err := r.Get(ctx, types.NamespacedName{Name: restore.Spec.GuestBookRef.Name, Namespace: restore.Namespace}, gb)
+	if errors.IsNotFound(err) {
+		return notValid("GuestBookNotFound", fmt.Sprintf("GuestBook %s not found", restore.Spec.GuestBookRef.Name))
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if !meta.IsStatusConditionTrue(gb.Status.Conditions, conditionReady) {
+		return notValid("GuestBookNotReady", fmt.Sprintf("Waiting for GuestBook %s to become ready", gb.Name))
+	}
+
+	snapshot := &restoreSnapshot{location: restore.Spec.Source.URI, checksum: restore.Spec.Source.Checksum}
+	if ref := restore.Spec.Source.BackupRef; ref != nil {
+		backup := &webappv1alpha1.GuestBookBackup{}
+		err := r.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: restore.Namespace}, backup)
+		if errors.IsNotFound(err) {
+			return notValid("BackupNotFound", fmt.Sprintf("GuestBookBackup %s not found", ref.Name))
+		} else if err != nil {
+			return nil, nil, err
+		}
+		if backup.Status.Phase != webappv1alpha1.BackupCompleted {
+			return notValid("BackupNotCompleted", fmt.Sprintf("GuestBookBackup %s is %s, not Completed", ref.Name, backup.Status.Phase))
+		}
+		snapshot.location = backup.Status.Location
+		snapshot.store = backup.Spec.Destination
+		snapshot.checksum = backup.Status.Checksum
+	} else {
+		snapshot.store = webappv1alpha1.ObjectStoreLocation{
+			Endpoint:             restore.Spec.Source.Endpoint,
+			Region:               restore.Spec.Source.Region,
+			CredentialsSecretRef: *restore.Spec.Source.CredentialsSecretRef,
+		}
+	}
+
+	if !restore.Spec.Force {
+		app, err := newAppClient(ctx, r.Client, r.HTTPClient, gb)
+		if err != nil {
+			return nil, nil, err
+		}
+		stats, err := app.entryStats(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("counting entries of GuestBook %s: %w", gb.Name, err)
+		}
+		if stats.Count > 0 {
+			return notValid("BackendNotEmpty", fmt.Sprintf(
+				"GuestBook %s already has %d entries; set spec.force to add the snapshot's entries to them", gb.Name, stats.Count))
+		}
+	}
+
+	r.setCondition(restore, conditionValidated, metav1.ConditionTrue, "Validated", "Pre-flight checks passed")
+	return gb, snapshot, nil
+}
+
+// trackJob records the outcome of the restore Job
+func (r *RestoreReconciler) trackJob(restore *webappv1alpha1.GuestBookRestore, job *batchv1.Job) {
+	now := metav1.Now()
+	if job.Status.Succeeded > 0 {
+		restore.Status.Phase = webappv1alpha1.RestoreCompleted
+		restore.Status.CompletionTime = &now
+		r.setCondition(restore, conditionRestored, metav1.ConditionTrue, "Completed", "Snapshot loaded")
+		return
+	}
+	for _, c := range job.Status.Conditions {
+		if c.Type == batchv1.JobFailed && c.Status == corev1.ConditionTrue {
+			restore.Status.Phase = webappv1alpha1.RestoreFailed
+			restore.Status.CompletionTime = &now
+			r.setCondition(restore, conditionRestored, metav1.ConditionFalse, "JobFailed", fmt.Sprintf("Job %s failed: %s", job.Name, c.Message))
+			return
+		}
+	}
+	restore.Status.Phase = webappv1alpha1.RestoreRunning
+}
+
+// setCondition sets a condition on the restore, with an event when it changes
+func (r *RestoreReconciler) setCondition(restore *webappv1alpha1.GuestBookRestore, conditionType string, status metav1.ConditionStatus, reason, message string) {
+	changed := meta.SetStatusCondition(&restore.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: restore.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+	if !changed {
+		return
+	}
+	eventType := corev1.EventTypeNormal
+	if status == metav1.ConditionFalse && reason != "Running" {
+		eventType = corev1.EventTypeWarning
+	}
+	r.Recorder.Event(restore, eventType, reason, message)
+}
+
+// restoreJobName is the name of a restore's Job
+func restoreJobName(restore *webappv1alpha1.GuestBookRestore) string {
+	return restore.Name + "-restore"
+}
+
+// restoreJob downloads and checks the snapshot into a scratch volume, then
+// posts it to the admin API's import endpoint
+func restoreJob(restore *webappv1alpha1.GuestBookRestore, gb *webappv1alpha1.GuestBook, snapshot *restoreSnapshot) *batchv1.Job {
+	backoffLimit := int32(3)
+	env := append(objectStoreEnv(snapshot.store),
+		corev1.EnvVar{Name: "SOURCE", Value: snapshot.location},
+		corev1.EnvVar{Name: "CHECKSUM", Value: snapshot.checksum},
+	)
+
+	importContainer := adminCurlContainer(gb, "import", "-X", "POST", "-H", "Content-Type: application/json",
+		"--data-binary", "@"+snapshotPath, serviceURL(gb)+"/admin/entries/import")
+	importContainer.VolumeMounts = append(importContainer.VolumeMounts, corev1.VolumeMount{Name: "work", MountPath: path.Dir(snapshotPath), ReadOnly: true})
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      restoreJobName(restore),
+			Namespace: restore.Namespace,
+			Labels:    labelsForGuestBook(gb.Name),
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: backendLabels(gb, "restore"),
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					InitContainers: []corev1.Container{
+						{
+							Name:    "download",
+							Image:   objectStoreImage,
+							Command: []string{"/bin/sh", "-c", downloadScript},
+							Env:     env,
+							EnvFrom: []corev1.EnvFromSource{
+								{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: snapshot.store.CredentialsSecretRef}},
+							},
+							VolumeMounts: []corev1.VolumeMount{{Name: "work", MountPath: path.Dir(snapshotPath)}},
+						},
+					},
+					Containers: []corev1.Container{
+						importContainer,
+					},
+					Volumes: append(adminCurlVolumes(gb),
+						corev1.Volume{Name: "work", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+					),
+				},
+			},
+		},
+	}
+}
+
+// SetupWithManager sets up the controller with the Manager
+func (r *RestoreReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.Recorder == nil {
+		r.Recorder = mgr.GetEventRecorderFor("guestbookrestore-controller")
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&webappv1alpha1.GuestBookRestore{}).
+		Owns(&batchv1.Job{}).
+		Complete(r)
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RestoreSource is the snapshot a restore reads: a GuestBookBackup, or an
+// object in an S3-compatible store
+// +kubebuilder:validation:XValidation:rule="has(self.backupRef) != has(self.uri)",message="exactly one of backupRef or uri must be set"
+// +kubebuilder:validation:XValidation:rule="!has(self.uri) || has(self.credentialsSecretRef)",message="credentialsSecretRef is required with uri"
+type RestoreSource struct {
+	// BackupRef is a completed GuestBookBackup in the same namespace
+	// +optional
+	BackupRef *corev1.LocalObjectReference `json:"backupRef,omitempty"`
+
+	// URI is a snapshot written by a GuestBookBackup, e.g. "s3://bucket/key"
+	// +kubebuilder:validation:Pattern=`^s3://[^/]+/.+`
+	// +optional
+	URI string `json:"uri,omitempty"`
+
+	// Endpoint is the object store URL for URI, for stores other than AWS S3
+	// +optional
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// Region is the region of the bucket in URI
+	// +optional
+	Region string `json:"region,omitempty"`
+
+	// CredentialsSecretRef names a Secret with AWS_ACCESS_KEY_ID and
+	// AWS_SECRET_ACCESS_KEY for URI
+	// +optional
+	CredentialsSecretRef *corev1.LocalObjectReference `json:"credentialsSecretRef,omitempty"`
+
+	// Checksum is the expected SHA-256 of the snapshot at URI, as
+	// "sha256:<hex>"; taken from the backup with BackupRef
+	// +kubebuilder:validation:Pattern=`^sha256:[0-9a-f]{64}$`
+	// +optional
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// GuestBookRestoreSpec defines the desired state of GuestBookRestore
+type GuestBookRestoreSpec struct {
+	// GuestBookRef is the GuestBook in the same namespace to restore into
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="guestBookRef is immutable"
+	GuestBookRef corev1.LocalObjectReference `json:"guestBookRef"`
+
+	// Source is the snapshot to restore
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="source is immutable"
+	Source RestoreSource `json:"source"`
+
+	// Force restores into a GuestBook that already has entries. The
+	// snapshot's entries are added to the existing ones.
+	// +optional
+	Force bool `json:"force,omitempty"`
+}
+
+// RestorePhase is a coarse summary of where a restore is
+// +kubebuilder:validation:Enum=Pending;Running;Completed;Failed
+type RestorePhase string
+
+const (
+	// RestorePending means the restore is waiting for its checks to pass
+	RestorePending RestorePhase = "Pending"
+
+	// RestoreRunning means the restore Job is loading the snapshot
+	RestoreRunning RestorePhase = "Running"
+
+	// RestoreCompleted means the snapshot's entries are in the GuestBook
+	RestoreCompleted RestorePhase = "Completed"
+
+	// RestoreFailed means the restore Job failed; see the message for why
+	RestoreFailed RestorePhase = "Failed"
+)
+
+// GuestBookRestoreStatus defines the observed state of GuestBookRestore
+type GuestBookRestoreStatus struct {
+	// Phase is where the restore is
+	// +optional
+	Phase RestorePhase `json:"phase,omitempty"`
+
+	// JobName is the Job that loads the snapshot
+	// +optional
+	JobName string `json:"jobName,omitempty"`
+
+	// StartTime is when the restore Job was created
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// CompletionTime is when the restore completed or failed
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+
+	// Conditions report the pre-flight checks ("Validated") and the
+	// restore itself ("Restored")
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:shortName=gbr
+// +kubebuilder:printcolumn:name="GuestBook",type=string,JSONPath=`.spec.guestBookRef.name`
+// +kubebuilder:printcolumn:name="Backup",type=string,JSONPath=`.spec.source.backupRef.name`
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// GuestBookRestore loads a snapshot taken by a GuestBookBackup into a
+// GuestBook. It refuses a GuestBook that already has entries unless Force
+// is set.
+type GuestBookRestore struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   GuestBookRestoreSpec   `json:"spec,omitempty"`
+	Status GuestBookRestoreStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// GuestBookRestoreList contains a list of GuestBookRestore
+type GuestBookRestoreList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []GuestBookRestore `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&GuestBookRestore{}, &GuestBookRestoreList{})
+}
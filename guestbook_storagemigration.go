@@ -0,0 +1,178 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	webappv1alpha1 "github.com/yourusername/guestbook-operator/api/v1alpha1"
+)
+
+// customResourceDefinitionGVK identifies CRDs, which are read as
+// unstructured objects so the operator doesn't need their types
+var customResourceDefinitionGVK = schema.GroupVersionKind{Group: "apiextensions.k8s.io", Version: "v1", Kind: "CustomResourceDefinition"}
+
+// +kubebuilder:rbac:groups=apiextensions.k8s.io,resources=customresourcedefinitions/status,verbs=update;patch
+
+// StorageVersionMigrator rewrites every GuestBook still stored at an older
+// version, then drops those versions from the CRD's status.storedVersions
+// so they can later be removed from the CRD. It runs on the leader until
+// the migration is done, retrying what fails.
+type StorageVersionMigrator struct {
+	Client client.Client
+
+	// CRDName is the CustomResourceDefinition of GuestBooks
+	CRDName string
+}
+
+// storageMigrationBackoff spaces out migration attempts. Rewrites go through
+// the operator's own webhooks, which have no endpoints until this pod is
+// ready, so the first attempt right after startup may well fail.
+var storageMigrationBackoff = wait.Backoff{
+	Duration: 10 * time.Second,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    math.MaxInt32,
+	Cap:      10 * time.Minute,
+}
+
+// NeedLeaderElection makes only the leader migrate
+func (m *StorageVersionMigrator) NeedLeaderElection() bool {
+	return true
+}
+
+// Start migrates the stored GuestBooks, retrying until it succeeds or the
+// manager stops. Failures are logged rather than returned, since an error
+// from a runnable stops the whole manager.
+func (m *StorageVersionMigrator) Start(ctx context.Context) error {
+	log := log.FromContext(ctx).WithValues("crd", m.CRDName)
+
+	backoff := storageMigrationBackoff
+	migrated := map[client.ObjectKey]bool{}
+	for {
+		err := m.migrate(ctx, migrated)
+		if err == nil {
+			return nil
+		}
+		delay := backoff.Step()
+		log.Error(err, "Storage version migration incomplete, retrying", "after", delay)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+	}
+}
+
+// migrate rewrites the GuestBooks not yet in migrated and, once all of them
+// are, updates the CRD's storedVersions
+func (m *StorageVersionMigrator) migrate(ctx context.Context, migrated map[client.ObjectKey]bool) error {
+	log := log.FromContext(ctx).WithValues("crd", m.CRDName)
+
+	crd := &unstructured.Unstructured{}
+	crd.SetGroupVersionKind(customResourceDefinitionGVK)
+	if err := m.Client.Get(ctx, client.ObjectKey{Name: m.CRDName}, crd); err != nil {
+		return fmt.Errorf("reading CRD %s: %w", m.CRDName, err)
+	}
+	storage, err := storageVersion(crd)
+	if err != nil {
+		return err
+	}
+	stored, _, _ := unstructured.NestedStringSlice(crd.Object, "status", "storedVersions")
+	if len(stored) == 1 && stored[0] == storage {
+		log.V(1).Info("GuestBooks are all stored at the storage version", "version", storage)
+		return nil
+	}
+
+	log.Info("Migrating stored GuestBooks", "from", stored, "to", storage)
+	guestbooks := &webappv1alpha1.GuestBookList{}
+	if err := m.Client.List(ctx, guestbooks); err != nil {
+		return fmt.Errorf("listing GuestBooks: %w", err)
+	}
+	failed := 0
+	for i := range guestbooks.Items {
+		key := client.ObjectKeyFromObject(&guestbooks.Items[i])
+		if migrated[key] {
+			continue
+		}
+		// One GuestBook the webhook now rejects mustn't hold up the rest
+		if err := m.rewrite(ctx, key); err != nil {
+			log.Error(err, "Failed to migrate GuestBook", "guestbook", key)
+			failed++
+			continue
+		}
+		migrated[key] = true
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d GuestBooks not migrated", failed, len(guestbooks.Items))
+	}
+
+	// GuestBooks created since the list was taken are already written at
+	// the storage version
+	base := crd.DeepCopy()
+	if err := unstructured.SetNestedStringSlice(crd.Object, []string{storage}, "status", "storedVersions"); err != nil {
+		return err
+	}
+	if err := m.Client.Status().Patch(ctx, crd, client.MergeFrom(base)); err != nil {
+		return fmt.Errorf("updating storedVersions of CRD %s: %w", m.CRDName, err)
+	}
+	log.Info("Migrated stored GuestBooks", "count", len(guestbooks.Items), "version", storage)
+	return nil
+}
+
+// rewrite writes a GuestBook back unchanged. The API server encodes every
+// write at the storage version, so the stored copy is converted even though
+// nothing in it changes.
+func (m *StorageVersionMigrator) rewrite(ctx context.Context, key client.ObjectKey) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		gb := &webappv1alpha1.GuestBook{}
+		if err := m.Client.Get(ctx, key, gb); err != nil {
+			if errors.IsNotFound(err) {
+				return nil
+			}
+			return err
+		}
+		return client.IgnoreNotFound(m.Client.Update(ctx, gb))
+	})
+}
+
+// storageVersion returns the version a CRD stores its objects at
+func storageVersion(crd *unstructured.Unstructured) (string, error) {
+	versions, _, _ := unstructured.NestedSlice(crd.Object, "spec", "versions")
+	for _, v := range versions {
+		version, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if storage, _, _ := unstructured.NestedBool(version, "storage"); storage {
+			name, _, _ := unstructured.NestedString(version, "name")
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("CRD %s has no storage version", crd.GetName())
+}
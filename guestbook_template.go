@@ -0,0 +1,338 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	webappv1alpha1 "github.com/yourusername/guestbook-operator/api/v1alpha1"
+)
+
+// guestBookTemplateIndex is the cache index of GuestBooks by referenced
+// GuestBookTemplate name
+const guestBookTemplateIndex = "spec.templateRef.name"
+
+// placeholderPattern matches a ${name} placeholder in a template string
+var placeholderPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// specSchemaDefaults are the spec fields the API server defaults, laid out
+// as the spec reads in v1alpha1 and with numbers as encoding/json decodes
+// them. The storage version defaults its blocks to {}, so a stored GuestBook
+// carries every one of them filled in; a value equal to its default doesn't
+// override the template. A nested map marks a block merged field by field.
+var specSchemaDefaults = map[string]interface{}{
+	"welcomeMessage":      "Welcome to our Guestbook!",
+	"image":               "gcr.io/google-samples/gb-frontend:v4",
+	"imagePullPolicy":     "IfNotPresent",
+	"backupCleanupPolicy": "Retain",
+	"autoscaling": map[string]interface{}{
+		"minReplicas":          float64(1),
+		"targetCPUUtilization": float64(80),
+	},
+	"service": map[string]interface{}{
+		"type": "ClusterIP",
+	},
+	"persistence": map[string]interface{}{
+		"size":          "1Gi",
+		"accessModes":   []interface{}{"ReadWriteOnce"},
+		"reclaimPolicy": "Delete",
+	},
+	"theme": map[string]interface{}{
+		"colorScheme": "default",
+	},
+	"themeRef": map[string]interface{}{
+		"kind": "GuestBookTheme",
+	},
+	"retention": map[string]interface{}{
+		"schedule": "0 * * * *",
+	},
+	"tls": map[string]interface{}{
+		"issuerRef": map[string]interface{}{
+			"kind": "Issuer",
+		},
+	},
+	"backend": map[string]interface{}{
+		"type": "inMemory",
+		"external": map[string]interface{}{
+			"driver":        "postgres",
+			"cleanupPolicy": "Retain",
+		},
+	},
+	"cors": map[string]interface{}{
+		"allowedMethods": []interface{}{"GET", "POST"},
+	},
+	"logging": map[string]interface{}{
+		"level":  "info",
+		"format": "text",
+	},
+	"monitoring": map[string]interface{}{
+		"port": float64(9090),
+	},
+}
+
+// applyTemplate replaces the spec of a GuestBook that references a
+// GuestBookTemplate with the rendered template and its own fields laid on
+// top. The merged spec only lives in memory. It returns false, with the
+// conditions set, when the template can't be used and reconciling has to
+// stop.
+func (r *GuestBookReconciler) applyTemplate(ctx context.Context, gb *webappv1alpha1.GuestBook) (ok bool, err error) {
+	ref := gb.Spec.TemplateRef
+	if ref == nil {
+		meta.RemoveStatusCondition(&gb.Status.Conditions, "TemplateResolved")
+		return true, nil
+	}
+	ctx, span := tracer.Start(ctx, "render template", childAttributes("GuestBookTemplate", ref.Name))
+	defer func() { endSpan(span, err) }()
+
+	tpl := &webappv1alpha1.GuestBookTemplate{}
+	err = r.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: gb.Namespace}, tpl)
+	if errors.IsNotFound(err) {
+		r.templateFailed(ctx, gb, "TemplateNotFound", fmt.Sprintf("GuestBookTemplate %s not found", ref.Name))
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("GuestBookTemplate %q: %w", ref.Name, err)
+	}
+
+	spec, err := mergeTemplate(tpl, gb.Spec)
+	if err != nil {
+		r.templateFailed(ctx, gb, "InvalidTemplate", fmt.Sprintf("GuestBookTemplate %s: %v", ref.Name, err))
+		return false, nil
+	}
+	gb.Spec = spec
+
+	setCondition(gb, "TemplateResolved", metav1.ConditionTrue, "TemplateApplied",
+		fmt.Sprintf("Using GuestBookTemplate %s (generation %d)", tpl.Name, tpl.Generation))
+	return true, nil
+}
+
+// templateFailed records why the referenced template can't be used
+func (r *GuestBookReconciler) templateFailed(ctx context.Context, gb *webappv1alpha1.GuestBook, reason, message string) {
+	if setCondition(gb, "TemplateResolved", metav1.ConditionFalse, reason, message) {
+		r.recorder(ctx).Event(gb, corev1.EventTypeWarning, reason, message)
+	}
+	setCondition(gb, conditionReady, metav1.ConditionFalse, reason, message)
+	gb.Status.Phase = phaseForGuestBook(gb, nil)
+}
+
+// mergeTemplate renders a template with the GuestBook's parameters and
+// lays the GuestBook's own top-level fields over it
+func mergeTemplate(tpl *webappv1alpha1.GuestBookTemplate, instance webappv1alpha1.GuestBookSpec) (webappv1alpha1.GuestBookSpec, error) {
+	values, err := templateValues(tpl.Spec.Parameters, instance.TemplateRef.Parameters)
+	if err != nil {
+		return webappv1alpha1.GuestBookSpec{}, err
+	}
+
+	merged := map[string]interface{}{}
+	if len(tpl.Spec.Spec.Raw) > 0 {
+		if err := json.Unmarshal(tpl.Spec.Spec.Raw, &merged); err != nil {
+			return webappv1alpha1.GuestBookSpec{}, fmt.Errorf("spec is not an object: %w", err)
+		}
+	}
+	var undeclared []string
+	for k, v := range merged {
+		merged[k] = substitute(v, values, &undeclared)
+	}
+	if len(undeclared) > 0 {
+		sort.Strings(undeclared)
+		return webappv1alpha1.GuestBookSpec{}, fmt.Errorf("undeclared parameters %s", strings.Join(undeclared, ", "))
+	}
+
+	raw, err := json.Marshal(instance)
+	if err != nil {
+		return webappv1alpha1.GuestBookSpec{}, err
+	}
+	overrides := map[string]interface{}{}
+	if err := json.Unmarshal(raw, &overrides); err != nil {
+		return webappv1alpha1.GuestBookSpec{}, err
+	}
+	delete(overrides, "templateRef")
+	overlay(merged, overrides, specSchemaDefaults)
+
+	raw, err = json.Marshal(merged)
+	if err != nil {
+		return webappv1alpha1.GuestBookSpec{}, err
+	}
+	// Catch misspelt fields, which a GuestBook's schema would have rejected
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	var spec webappv1alpha1.GuestBookSpec
+	if err := decoder.Decode(&spec); err != nil {
+		return webappv1alpha1.GuestBookSpec{}, fmt.Errorf("rendered spec is invalid: %w", err)
+	}
+	spec.TemplateRef = instance.TemplateRef
+	return spec, nil
+}
+
+// overlay lays the GuestBook's fields over the rendered template. Empty
+// fields are skipped, and so are schema defaults the template sets; blocks
+// with defaults of their own are overlaid field by field.
+func overlay(merged, overrides, defaults map[string]interface{}) {
+	for k, v := range overrides {
+		if isEmptyJSON(v) {
+			continue
+		}
+		d := defaults[k]
+		if blockDefaults, ok := d.(map[string]interface{}); ok {
+			block, isBlock := v.(map[string]interface{})
+			if isBlock {
+				base, ok := merged[k].(map[string]interface{})
+				if !ok {
+					base = map[string]interface{}{}
+				}
+				overlay(base, block, blockDefaults)
+				merged[k] = base
+				continue
+			}
+		}
+		if _, set := merged[k]; set && d != nil && reflect.DeepEqual(v, d) {
+			continue
+		}
+		merged[k] = v
+	}
+}
+
+// templateValues resolves the value of every declared parameter
+func templateValues(params []webappv1alpha1.TemplateParameter, passed map[string]string) (map[string]string, error) {
+	values := map[string]string{}
+	var missing []string
+	for _, p := range params {
+		if v, ok := passed[p.Name]; ok {
+			values[p.Name] = v
+		} else if p.Default != "" || !p.Required {
+			values[p.Name] = p.Default
+		} else {
+			missing = append(missing, p.Name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("missing required parameters %s", strings.Join(missing, ", "))
+	}
+
+	var unknown []string
+	for name := range passed {
+		if _, ok := values[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown parameters %s", strings.Join(unknown, ", "))
+	}
+	return values, nil
+}
+
+// substitute replaces the placeholders in every string of a decoded JSON
+// value, collecting the names that aren't declared parameters
+func substitute(value interface{}, values map[string]string, undeclared *[]string) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = substitute(item, values, undeclared)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = substitute(item, values, undeclared)
+		}
+		return v
+	case string:
+		// A lone placeholder takes the JSON type of its value
+		if m := placeholderPattern.FindStringSubmatch(v); m != nil && m[0] == v {
+			s, ok := values[m[1]]
+			if !ok {
+				*undeclared = append(*undeclared, m[1])
+				return v
+			}
+			var typed interface{}
+			if err := json.Unmarshal([]byte(s), &typed); err == nil {
+				return typed
+			}
+			return s
+		}
+		return placeholderPattern.ReplaceAllStringFunc(v, func(p string) string {
+			name := p[2 : len(p)-1]
+			s, ok := values[name]
+			if !ok {
+				*undeclared = append(*undeclared, name)
+				return p
+			}
+			return s
+		})
+	default:
+		return v
+	}
+}
+
+// isEmptyJSON reports whether a decoded JSON value is empty, as unset
+// struct fields of a spec are when marshalled
+func isEmptyJSON(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case map[string]interface{}:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
+	case string:
+		return v == ""
+	case bool:
+		return !v
+	case float64:
+		return v == 0
+	}
+	return false
+}
+
+// guestBookTemplateForGuestBook indexes a GuestBook by the GuestBookTemplate
+// it references
+func guestBookTemplateForGuestBook(obj client.Object) []string {
+	gb := obj.(*webappv1alpha1.GuestBook)
+	if ref := gb.Spec.TemplateRef; ref != nil {
+		return []string{ref.Name}
+	}
+	return nil
+}
+
+// findGuestBooksForGuestBookTemplate maps a GuestBookTemplate to the
+// GuestBooks in its namespace based on it
+func (r *GuestBookReconciler) findGuestBooksForGuestBookTemplate(ctx context.Context, tpl client.Object) []reconcile.Request {
+	guestbooks := &webappv1alpha1.GuestBookList{}
+	err := r.List(ctx, guestbooks,
+		client.InNamespace(tpl.GetNamespace()),
+		client.MatchingFields{guestBookTemplateIndex: tpl.GetName()})
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list GuestBooks for GuestBookTemplate", "template", tpl.GetName())
+		return nil
+	}
+	return requestsForGuestBooks(guestbooks)
+}
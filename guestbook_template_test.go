@@ -0,0 +1,206 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/utils/ptr"
+
+	webappv1alpha1 "github.com/yourusername/guestbook-operator/api/v1alpha1"
+)
+
+// schemaDefaultedSpec returns a GuestBook spec as the API server stores it
+// after defaulting, referencing the template with params
+func schemaDefaultedSpec(params map[string]string) webappv1alpha1.GuestBookSpec {
+	return webappv1alpha1.GuestBookSpec{
+		WelcomeMessage:  "Welcome to our Guestbook!",
+		Image:           "gcr.io/google-samples/gb-frontend:v4",
+		ImagePullPolicy: "IfNotPresent",
+		TemplateRef:     &webappv1alpha1.GuestBookTemplateReference{Name: "team", Parameters: params},
+	}
+}
+
+// storedSpec returns a GuestBook spec as a controller reads it from the API
+// server: the storage version defaults every block, down to its fields
+func storedSpec(params map[string]string) webappv1alpha1.GuestBookSpec {
+	spec := schemaDefaultedSpec(params)
+	spec.Service.Type = corev1.ServiceTypeClusterIP
+	spec.Persistence = webappv1alpha1.GuestBookPersistenceSpec{
+		Size:          resource.MustParse("1Gi"),
+		AccessModes:   []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+		ReclaimPolicy: webappv1alpha1.ReclaimPolicyDelete,
+	}
+	spec.Theme.ColorScheme = "default"
+	spec.Retention.Schedule = "0 * * * *"
+	spec.Backend.Type = webappv1alpha1.BackendInMemory
+	spec.Logging = webappv1alpha1.GuestBookLoggingSpec{Level: "info", Format: "text"}
+	spec.Monitoring.Port = 9090
+	spec.BackupCleanupPolicy = webappv1alpha1.CleanupPolicyRetain
+	return spec
+}
+
+func testTemplate(spec string, params ...webappv1alpha1.TemplateParameter) *webappv1alpha1.GuestBookTemplate {
+	return &webappv1alpha1.GuestBookTemplate{
+		Spec: webappv1alpha1.GuestBookTemplateSpec{
+			Parameters: params,
+			Spec:       runtime.RawExtension{Raw: []byte(spec)},
+		},
+	}
+}
+
+func TestMergeTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		template *webappv1alpha1.GuestBookTemplate
+		instance func() webappv1alpha1.GuestBookSpec
+		check    func(*testing.T, webappv1alpha1.GuestBookSpec)
+		wantErr  string
+	}{
+		{
+			name:     "schema default does not override template",
+			template: testTemplate(`{"welcomeMessage":"Hello from the template","image":"example.com/guestbook:v2"}`),
+			instance: func() webappv1alpha1.GuestBookSpec { return schemaDefaultedSpec(nil) },
+			check: func(t *testing.T, spec webappv1alpha1.GuestBookSpec) {
+				if spec.WelcomeMessage != "Hello from the template" {
+					t.Errorf("welcomeMessage = %q, want the template's", spec.WelcomeMessage)
+				}
+				if spec.Image != "example.com/guestbook:v2" {
+					t.Errorf("image = %q, want the template's", spec.Image)
+				}
+				if spec.ImagePullPolicy != "IfNotPresent" {
+					t.Errorf("imagePullPolicy = %q, want the schema default", spec.ImagePullPolicy)
+				}
+			},
+		},
+		{
+			name: "defaulted blocks of a stored GuestBook do not override template",
+			template: testTemplate(`{"backend":{"type":"redis"},"service":{"type":"LoadBalancer"},` +
+				`"theme":{"colorScheme":"blue","darkMode":true},"logging":{"level":"debug"},"persistence":{"enabled":true,"size":"5Gi"}}`),
+			instance: func() webappv1alpha1.GuestBookSpec {
+				spec := storedSpec(nil)
+				spec.Logging.Format = "json"
+				return spec
+			},
+			check: func(t *testing.T, spec webappv1alpha1.GuestBookSpec) {
+				if spec.Backend.Type != webappv1alpha1.BackendRedis {
+					t.Errorf("backend.type = %q, want the template's redis", spec.Backend.Type)
+				}
+				if spec.Service.Type != corev1.ServiceTypeLoadBalancer {
+					t.Errorf("service.type = %q, want the template's LoadBalancer", spec.Service.Type)
+				}
+				if spec.Theme.ColorScheme != "blue" || !spec.Theme.DarkMode {
+					t.Errorf("theme = %+v, want the template's", spec.Theme)
+				}
+				if spec.Logging.Level != "debug" || spec.Logging.Format != "json" {
+					t.Errorf("logging = %+v, want the template's level and the instance's format", spec.Logging)
+				}
+				if !spec.Persistence.Enabled || spec.Persistence.Size.String() != "5Gi" {
+					t.Errorf("persistence = %+v, want the template's", spec.Persistence)
+				}
+				if spec.Persistence.ReclaimPolicy != webappv1alpha1.ReclaimPolicyDelete {
+					t.Errorf("persistence.reclaimPolicy = %q, want the default kept", spec.Persistence.ReclaimPolicy)
+				}
+				if spec.Monitoring.Port != 9090 {
+					t.Errorf("monitoring.port = %d, want the default kept", spec.Monitoring.Port)
+				}
+			},
+		},
+		{
+			name:     "instance field overrides template",
+			template: testTemplate(`{"welcomeMessage":"Hello from the template","replicas":2}`),
+			instance: func() webappv1alpha1.GuestBookSpec {
+				spec := schemaDefaultedSpec(nil)
+				spec.WelcomeMessage = "Hello from the instance"
+				spec.Replicas = ptr.To[int32](5)
+				return spec
+			},
+			check: func(t *testing.T, spec webappv1alpha1.GuestBookSpec) {
+				if spec.WelcomeMessage != "Hello from the instance" {
+					t.Errorf("welcomeMessage = %q, want the instance's", spec.WelcomeMessage)
+				}
+				if got := ptr.Deref(spec.Replicas, 0); got != 5 {
+					t.Errorf("replicas = %d, want 5", got)
+				}
+			},
+		},
+		{
+			name: "parameters are substituted with their JSON type",
+			template: testTemplate(`{"welcomeMessage":"Welcome to ${team}","replicas":"${replicas}"}`,
+				webappv1alpha1.TemplateParameter{Name: "team", Required: true},
+				webappv1alpha1.TemplateParameter{Name: "replicas", Default: "3"}),
+			instance: func() webappv1alpha1.GuestBookSpec {
+				return schemaDefaultedSpec(map[string]string{"team": "Platform"})
+			},
+			check: func(t *testing.T, spec webappv1alpha1.GuestBookSpec) {
+				if spec.WelcomeMessage != "Welcome to Platform" {
+					t.Errorf("welcomeMessage = %q, want %q", spec.WelcomeMessage, "Welcome to Platform")
+				}
+				if got := ptr.Deref(spec.Replicas, 0); got != 3 {
+					t.Errorf("replicas = %d, want the parameter default 3", got)
+				}
+				if spec.TemplateRef == nil || spec.TemplateRef.Name != "team" {
+					t.Errorf("templateRef = %+v, want it kept", spec.TemplateRef)
+				}
+			},
+		},
+		{
+			name:     "missing required parameter",
+			template: testTemplate(`{"welcomeMessage":"${team}"}`, webappv1alpha1.TemplateParameter{Name: "team", Required: true}),
+			instance: func() webappv1alpha1.GuestBookSpec { return schemaDefaultedSpec(nil) },
+			wantErr:  "missing required parameters team",
+		},
+		{
+			name:     "unknown parameter",
+			template: testTemplate(`{}`),
+			instance: func() webappv1alpha1.GuestBookSpec { return schemaDefaultedSpec(map[string]string{"team": "x"}) },
+			wantErr:  "unknown parameters team",
+		},
+		{
+			name:     "undeclared placeholder",
+			template: testTemplate(`{"welcomeMessage":"${team}"}`),
+			instance: func() webappv1alpha1.GuestBookSpec { return schemaDefaultedSpec(nil) },
+			wantErr:  "undeclared parameters team",
+		},
+		{
+			name:     "misspelt field",
+			template: testTemplate(`{"welcomeMesage":"typo"}`),
+			instance: func() webappv1alpha1.GuestBookSpec { return schemaDefaultedSpec(nil) },
+			wantErr:  "rendered spec is invalid",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, err := mergeTemplate(tt.template, tt.instance())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("mergeTemplate() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("mergeTemplate() error = %v", err)
+			}
+			tt.check(t, spec)
+		})
+	}
+}
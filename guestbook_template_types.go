@@ -0,0 +1,83 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// TemplateParameter declares a placeholder of a GuestBookTemplate
+type TemplateParameter struct {
+	// Name of the parameter, written as ${name} in the template
+	// +kubebuilder:validation:Pattern=`^[A-Za-z_][A-Za-z0-9_]*$`
+	Name string `json:"name"`
+
+	// Description tells GuestBook authors what to pass
+	// +optional
+	Description string `json:"description,omitempty"`
+
+	// Default is used when a GuestBook doesn't pass the parameter
+	// +optional
+	Default string `json:"default,omitempty"`
+
+	// Required parameters must be passed by every GuestBook using the
+	// template, unless they have a default
+	// +optional
+	Required bool `json:"required,omitempty"`
+}
+
+// GuestBookTemplateSpec defines a golden GuestBook configuration
+type GuestBookTemplateSpec struct {
+	// Parameters lists the placeholders Spec may contain
+	// +listType=map
+	// +listMapKey=name
+	// +optional
+	Parameters []TemplateParameter `json:"parameters,omitempty"`
+
+	// Spec is a GuestBook spec in which every ${name} is replaced by the
+	// parameter value. A string that is nothing but a placeholder takes the
+	// value's JSON type, so "${replicas}" can fill in a number.
+	// +kubebuilder:pruning:PreserveUnknownFields
+	Spec runtime.RawExtension `json:"spec"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=gbtpl
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// GuestBookTemplate is a golden configuration for the GuestBooks in its
+// namespace, referenced by spec.templateRef
+type GuestBookTemplate struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec GuestBookTemplateSpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// GuestBookTemplateList contains a list of GuestBookTemplate
+type GuestBookTemplateList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []GuestBookTemplate `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&GuestBookTemplate{}, &GuestBookTemplateList{})
+}
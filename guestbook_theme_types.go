@@ -0,0 +1,73 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=gbtheme
+// +kubebuilder:printcolumn:name="Color Scheme",type=string,JSONPath=`.spec.colorScheme`
+// +kubebuilder:printcolumn:name="Dark Mode",type=boolean,JSONPath=`.spec.darkMode`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// GuestBookTheme is a reusable theme for the GuestBooks in its namespace,
+// referenced by spec.themeRef
+type GuestBookTheme struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec GuestBookThemeSpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// GuestBookThemeList contains a list of GuestBookTheme
+type GuestBookThemeList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []GuestBookTheme `json:"items"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster,shortName=cgbtheme
+// +kubebuilder:printcolumn:name="Color Scheme",type=string,JSONPath=`.spec.colorScheme`
+// +kubebuilder:printcolumn:name="Dark Mode",type=boolean,JSONPath=`.spec.darkMode`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// ClusterGuestBookTheme is a theme platform teams offer to GuestBooks in
+// every namespace
+type ClusterGuestBookTheme struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec GuestBookThemeSpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ClusterGuestBookThemeList contains a list of ClusterGuestBookTheme
+type ClusterGuestBookThemeList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClusterGuestBookTheme `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&GuestBookTheme{}, &GuestBookThemeList{}, &ClusterGuestBookTheme{}, &ClusterGuestBookThemeList{})
+}
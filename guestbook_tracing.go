@@ -0,0 +1,58 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// tracer creates the reconcile spans. It uses the global provider, which is
+// a no-op unless main configured an exporter.
+var tracer = otel.Tracer("github.com/yourusername/guestbook-operator/internal/controller")
+
+// startReconcileSpan starts the root span of one GuestBook reconcile
+func startReconcileSpan(ctx context.Context, req ctrl.Request, reconcileID types.UID) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "Reconcile GuestBook", trace.WithAttributes(
+		attribute.String("guestbook.namespace", req.Namespace),
+		attribute.String("guestbook.name", req.Name),
+		attribute.String("guestbook.reconcile_id", string(reconcileID)),
+	))
+}
+
+// endSpan records err on the span, if there is one, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// childAttributes describe the child resource an apply span writes
+func childAttributes(kind, name string) trace.SpanStartOption {
+	return trace.WithAttributes(
+		attribute.String("k8s.kind", kind),
+		attribute.String("k8s.name", name),
+	)
+}
@@ -17,34 +17,747 @@ limitations under the License.
 package v1alpha1
 
 import (
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 // IMPORTANT: Run "make manifests" to regenerate code after modifying this file
 // NOTE: json tags are required. Any new fields must have json tags.
 
 // GuestBookSpec defines the desired state of GuestBook
+// +kubebuilder:validation:XValidation:rule="!has(self.autoscaling) || !has(self.replicas)",message="replicas must not be set together with autoscaling"
+// +kubebuilder:validation:XValidation:rule="!has(self.port) || self.port >= 1024 || self.allowPrivilegedPorts",message="port below 1024 requires allowPrivilegedPorts"
+// +kubebuilder:validation:XValidation:rule="!has(self.targetPort) || self.targetPort >= 1024 || self.allowPrivilegedPorts",message="targetPort below 1024 requires allowPrivilegedPorts"
 type GuestBookSpec struct {
-	// Replicas is the number of guestbook instances
+	// Replicas is the number of guestbook instances. It defaults to 1 and
+	// must be left unset when Autoscaling is used. `kubectl scale gb` and
+	// autoscalers targeting the scale subresource write this field.
 	// +kubebuilder:validation:Minimum=1
 	// +kubebuilder:validation:Maximum=10
-	// +kubebuilder:default=1
-	Replicas int32 `json:"replicas,omitempty"`
+	Replicas *int32 `json:"replicas,omitempty"`
+
+	// Autoscaling lets a HorizontalPodAutoscaler manage the replica count
+	Autoscaling *AutoscalingSpec `json:"autoscaling,omitempty"`
 
 	// WelcomeMessage is displayed on the guestbook page
 	// +kubebuilder:validation:MinLength=1
 	// +kubebuilder:default="Welcome to our Guestbook!"
 	WelcomeMessage string `json:"welcomeMessage,omitempty"`
+
+	// WelcomeMessages holds translations of the welcome message keyed by
+	// language code (e.g. "en", "pt-BR"). WelcomeMessage is shown for any
+	// language without an entry.
+	// +kubebuilder:validation:XValidation:rule="self.all(k, k.matches('^[a-z]{2,3}(-[A-Za-z0-9]{2,8})*$'))",message="keys must be language codes such as en or pt-BR"
+	WelcomeMessages map[string]string `json:"welcomeMessages,omitempty"`
+
+	// Image is the container image for the guestbook frontend
+	// +kubebuilder:validation:MinLength=1
+	// +kubebuilder:default="gcr.io/google-samples/gb-frontend:v4"
+	Image string `json:"image,omitempty"`
+
+	// ImagePullPolicy controls when the kubelet pulls the image
+	// +kubebuilder:validation:Enum=Always;Never;IfNotPresent
+	// +kubebuilder:default=IfNotPresent
+	ImagePullPolicy corev1.PullPolicy `json:"imagePullPolicy,omitempty"`
+
+	// Port is the port exposed by the guestbook Service (80 when unset)
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	Port int32 `json:"port,omitempty"`
+
+	// TargetPort is the port the guestbook container listens on (80 when unset)
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	TargetPort int32 `json:"targetPort,omitempty"`
+
+	// AllowPrivilegedPorts permits setting port or targetPort below 1024
+	AllowPrivilegedPorts bool `json:"allowPrivilegedPorts,omitempty"`
+
+	// Resources are the compute requests and limits for the guestbook container
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	// Size is a preset for resources.requests, filled in when the GuestBook
+	// is admitted without any. The requests follow later size changes until
+	// they are edited by hand.
+	Size GuestBookSize `json:"size,omitempty"`
+
+	// NodeSelector restricts guestbook pods to nodes with matching labels
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+
+	// Tolerations allow guestbook pods to schedule onto tainted nodes
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+
+	// Affinity holds node and pod affinity rules for guestbook pods
+	Affinity *corev1.Affinity `json:"affinity,omitempty"`
+
+	// ExtraEnv adds environment variables to the guestbook container
+	ExtraEnv []corev1.EnvVar `json:"extraEnv,omitempty"`
+
+	// EnvFrom populates the guestbook container environment from ConfigMaps or Secrets
+	EnvFrom []corev1.EnvFromSource `json:"envFrom,omitempty"`
+
+	// Service configures the Service that exposes the guestbook
+	Service GuestBookServiceSpec `json:"service,omitempty"`
+
+	// Ingress configures an optional Ingress in front of the Service
+	Ingress GuestBookIngressSpec `json:"ingress,omitempty"`
+
+	// Persistence configures a PersistentVolumeClaim for guestbook entries
+	Persistence GuestBookPersistenceSpec `json:"persistence,omitempty"`
+
+	// Theme controls the look of the guestbook page
+	Theme GuestBookThemeSpec `json:"theme,omitempty"`
+
+	// ThemeRef points at a shared GuestBookTheme or ClusterGuestBookTheme,
+	// which replaces Theme. Editing the theme rolls the Deployment.
+	// +optional
+	ThemeRef *ThemeReference `json:"themeRef,omitempty"`
+
+	// TemplateRef bases the GuestBook on a GuestBookTemplate in its namespace.
+	// Top-level fields set here replace the template's; fields left at
+	// their schema default don't.
+	// +optional
+	TemplateRef *GuestBookTemplateReference `json:"templateRef,omitempty"`
+
+	// TemplateConfigMapRef names a ConfigMap in the same namespace whose keys
+	// are HTML templates overriding the built-in pages. Editing the ConfigMap
+	// rolls the Deployment.
+	// +optional
+	TemplateConfigMapRef *corev1.LocalObjectReference `json:"templateConfigMapRef,omitempty"`
+
+	// Retention prunes old guestbook entries on a schedule
+	Retention GuestBookRetentionSpec `json:"retention,omitempty"`
+
+	// Moderation holds new entries for approval before they are shown
+	Moderation GuestBookModerationSpec `json:"moderation,omitempty"`
+
+	// Auth protects the guestbook admin UI
+	Auth GuestBookAuthSpec `json:"auth,omitempty"`
+
+	// TLS makes the guestbook serve HTTPS itself
+	TLS GuestBookTLSSpec `json:"tls,omitempty"`
+
+	// Probes overrides the timing of the container health probes
+	Probes GuestBookProbesSpec `json:"probes,omitempty"`
+
+	// PodSecurityContext is merged over the controller's pod-level defaults
+	PodSecurityContext *corev1.PodSecurityContext `json:"podSecurityContext,omitempty"`
+
+	// ContainerSecurityContext is merged over the controller's defaults for
+	// the guestbook container
+	ContainerSecurityContext *corev1.SecurityContext `json:"containerSecurityContext,omitempty"`
+
+	// ServiceAccountName runs the pods as an existing ServiceAccount; when
+	// unset the controller creates a dedicated one for the GuestBook
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+
+	// ImagePullSecrets are Secrets in the GuestBook's namespace used to pull
+	// images from private registries
+	// +optional
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+
+	// PriorityClassName sets the scheduling priority of the guestbook pods
+	PriorityClassName string `json:"priorityClassName,omitempty"`
+
+	// TopologySpreadConstraints control how pods spread across the cluster.
+	// When unset and Replicas > 1, pods are spread across zones.
+	TopologySpreadConstraints []corev1.TopologySpreadConstraint `json:"topologySpreadConstraints,omitempty"`
+
+	// PodTemplateMetadata adds labels and annotations to the guestbook pods
+	PodTemplateMetadata PodTemplateMetadata `json:"podTemplateMetadata,omitempty"`
+
+	// Sidecars are extra containers run next to the guestbook container,
+	// in the order given
+	// +listType=map
+	// +listMapKey=name
+	// +kubebuilder:validation:XValidation:rule="self.all(c, c.name != 'guestbook')",message="sidecar name 'guestbook' is reserved"
+	Sidecars []corev1.Container `json:"sidecars,omitempty"`
+
+	// InitContainers run to completion, in order, before the guestbook starts
+	// +listType=map
+	// +listMapKey=name
+	InitContainers []corev1.Container `json:"initContainers,omitempty"`
+
+	// Suspend stops the controller from reconciling the GuestBook. Child
+	// resources are left in place.
+	Suspend bool `json:"suspend,omitempty"`
+
+	// ScaleToZeroWhenSuspended scales the Deployment to zero replicas while
+	// Suspend is set. With autoscaling, the HorizontalPodAutoscaler is removed
+	// while suspended and recreated on resume.
+	ScaleToZeroWhenSuspended bool `json:"scaleToZeroWhenSuspended,omitempty"`
+
+	// Backend selects the data store for guestbook entries
+	Backend GuestBookBackendSpec `json:"backend,omitempty"`
+
+	// MaintenanceWindow restricts image updates and backend migrations to
+	// a recurring window; they roll out at any time when unset
+	MaintenanceWindow *MaintenanceWindow `json:"maintenanceWindow,omitempty"`
+
+	// UpdateStrategy is the Deployment strategy used to replace pods:
+	// RollingUpdate with optional maxSurge/maxUnavailable, or Recreate
+	// +kubebuilder:validation:XValidation:rule="!has(self.type) || self.type != 'Recreate' || !has(self.rollingUpdate)",message="rollingUpdate must not be set when type is Recreate"
+	UpdateStrategy appsv1.DeploymentStrategy `json:"updateStrategy,omitempty"`
+
+	// PodDisruptionBudget limits voluntary disruptions of guestbook pods.
+	// A budget is only created while the GuestBook runs more than one replica.
+	PodDisruptionBudget *PodDisruptionBudgetSpec `json:"podDisruptionBudget,omitempty"`
+
+	// NetworkPolicy restricts inbound traffic to the guestbook pods
+	NetworkPolicy GuestBookNetworkPolicySpec `json:"networkPolicy,omitempty"`
+
+	// Logging configures the guestbook application logs
+	Logging GuestBookLoggingSpec `json:"logging,omitempty"`
+
+	// ReadOnly disables submission of new entries, e.g. for archived guestbooks
+	ReadOnly bool `json:"readOnly,omitempty"`
+
+	// RateLimit throttles requests per client IP; unlimited when unset
+	RateLimit *RateLimitSpec `json:"rateLimit,omitempty"`
+
+	// CORS lets external sites call the guestbook API from the browser
+	CORS *CORSSpec `json:"cors,omitempty"`
+
+	// DNS publishes an external DNS record for the guestbook through external-dns
+	DNS GuestBookDNSSpec `json:"dns,omitempty"`
+
+	// Monitoring configures Prometheus scraping of the guestbook
+	Monitoring GuestBookMonitoringSpec `json:"monitoring,omitempty"`
+
+	// BackupCleanupPolicy decides what happens to the object store snapshots
+	// of the guestbook's GuestBookBackups when the GuestBook is deleted
+	// +kubebuilder:default=Retain
+	BackupCleanupPolicy CleanupPolicy `json:"backupCleanupPolicy,omitempty"`
+}
+
+// GuestBookSize is a preset amount of compute for the guestbook container
+// +kubebuilder:validation:Enum=small;medium;large
+type GuestBookSize string
+
+const (
+	// SizeSmall requests 50m CPU and 64Mi of memory
+	SizeSmall GuestBookSize = "small"
+
+	// SizeMedium requests 100m CPU and 128Mi of memory
+	SizeMedium GuestBookSize = "medium"
+
+	// SizeLarge requests 250m CPU and 256Mi of memory
+	SizeLarge GuestBookSize = "large"
+)
+
+// GuestBookMonitoringSpec configures Prometheus scraping of the guestbook
+type GuestBookMonitoringSpec struct {
+	// Enabled serves the app's /metrics on a dedicated port and, when the
+	// Prometheus Operator is installed, creates a ServiceMonitor for it
+	Enabled bool `json:"enabled,omitempty"`
+
+	// Port the app serves /metrics on. With a NetworkPolicy, Prometheus
+	// must be among its allowed peers to reach it.
+	// +kubebuilder:validation:Minimum=1024
+	// +kubebuilder:validation:Maximum=65535
+	// +kubebuilder:default=9090
+	Port int32 `json:"port,omitempty"`
+
+	// Interval between scrapes; Prometheus' own default applies when unset
+	// +kubebuilder:validation:Pattern=`^([0-9]+(ms|s|m|h))+$`
+	Interval string `json:"interval,omitempty"`
+
+	// Labels are added to the ServiceMonitor, e.g. to match the
+	// serviceMonitorSelector of a Prometheus
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// GuestBookDNSSpec configures the external DNS record for a GuestBook
+type GuestBookDNSSpec struct {
+	// Hostname is the fully qualified name external-dns should publish. It is
+	// set on the Ingress when enabled, otherwise on the Service, and shows up
+	// in status.url once it resolves.
+	Hostname string `json:"hostname,omitempty"`
+}
+
+// CORSSpec configures cross-origin resource sharing for the guestbook API
+type CORSSpec struct {
+	// AllowedOrigins are the origins allowed to call the API; "*" allows any
+	// +kubebuilder:validation:MinItems=1
+	AllowedOrigins []string `json:"allowedOrigins"`
+
+	// AllowedMethods are the HTTP methods allowed for cross-origin requests
+	// +kubebuilder:default={"GET","POST"}
+	AllowedMethods []string `json:"allowedMethods,omitempty"`
+}
+
+// RateLimitSpec configures per-client request throttling
+type RateLimitSpec struct {
+	// RequestsPerMinute is the sustained request rate allowed per client IP
+	// +kubebuilder:validation:Minimum=1
+	RequestsPerMinute int32 `json:"requestsPerMinute"`
+
+	// Burst is the number of requests a client may make above the sustained
+	// rate before being throttled
+	// +kubebuilder:validation:Minimum=0
+	Burst int32 `json:"burst,omitempty"`
+}
+
+// PodDisruptionBudgetSpec configures the PodDisruptionBudget for a GuestBook.
+// Set at most one of MinAvailable and MaxUnavailable; MaxUnavailable=1 is
+// used when neither is set.
+// +kubebuilder:validation:XValidation:rule="!(has(self.minAvailable) && has(self.maxUnavailable))",message="only one of minAvailable or maxUnavailable may be set"
+// +kubebuilder:validation:XValidation:rule="!has(self.maxUnavailable) || !(string(self.maxUnavailable) in ['0', '0%'])",message="maxUnavailable must be greater than zero, otherwise no pod can be evicted"
+// +kubebuilder:validation:XValidation:rule="!has(self.minAvailable) || string(self.minAvailable) != '100%'",message="minAvailable must be below 100%, otherwise no pod can be evicted"
+type PodDisruptionBudgetSpec struct {
+	// MinAvailable is the number or percentage of pods that must stay available
+	MinAvailable *intstr.IntOrString `json:"minAvailable,omitempty"`
+
+	// MaxUnavailable is the number or percentage of pods that may be unavailable
+	MaxUnavailable *intstr.IntOrString `json:"maxUnavailable,omitempty"`
+}
+
+// MaintenanceWindow is a recurring period in which disruptive changes may
+// be rolled out
+type MaintenanceWindow struct {
+	// Schedule is a standard cron expression for when the window opens
+	// +kubebuilder:validation:MinLength=1
+	Schedule string `json:"schedule"`
+
+	// Duration is how long the window stays open, e.g. "2h"
+	Duration metav1.Duration `json:"duration"`
+}
+
+// AutoscalingSpec configures the HorizontalPodAutoscaler for a GuestBook
+// +kubebuilder:validation:XValidation:rule="!has(self.minReplicas) || self.minReplicas <= self.maxReplicas",message="minReplicas must not be greater than maxReplicas"
+type AutoscalingSpec struct {
+	// MinReplicas is the lower replica bound
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=10
+	// +kubebuilder:default=1
+	MinReplicas *int32 `json:"minReplicas,omitempty"`
+
+	// MaxReplicas is the upper replica bound
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=10
+	MaxReplicas int32 `json:"maxReplicas"`
+
+	// TargetCPUUtilization is the average CPU utilization, as a percentage
+	// of the requested CPU, the autoscaler aims for
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	// +kubebuilder:default=80
+	TargetCPUUtilization *int32 `json:"targetCPUUtilization,omitempty"`
+}
+
+// PodTemplateMetadata holds extra metadata for the pods the controller creates.
+// Labels and annotations the controller manages itself take precedence.
+type PodTemplateMetadata struct {
+	// Labels are added to the guestbook pods
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Annotations are added to the guestbook pods
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// GuestBookServiceSpec configures the Service created for a GuestBook
+// +kubebuilder:validation:XValidation:rule="!has(self.loadBalancerSourceRanges) || self.type == 'LoadBalancer'",message="loadBalancerSourceRanges only applies when type is LoadBalancer"
+type GuestBookServiceSpec struct {
+	// Type is the Service type used to expose the guestbook
+	// +kubebuilder:validation:Enum=ClusterIP;NodePort;LoadBalancer
+	// +kubebuilder:default=ClusterIP
+	Type corev1.ServiceType `json:"type,omitempty"`
+
+	// LoadBalancerSourceRanges limits client IPs when Type is LoadBalancer
+	LoadBalancerSourceRanges []string `json:"loadBalancerSourceRanges,omitempty"`
+
+	// Annotations are added to the Service, e.g. for cloud load balancer settings
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// GuestBookIngressSpec configures the Ingress created for a GuestBook
+// +kubebuilder:validation:XValidation:rule="(has(self.enabled) && self.enabled) || !has(self.host)",message="host requires enabled"
+// +kubebuilder:validation:XValidation:rule="(has(self.enabled) && self.enabled) || !has(self.tlsSecretName)",message="tlsSecretName requires enabled"
+// +kubebuilder:validation:XValidation:rule="has(self.host) || !has(self.tlsSecretName)",message="tlsSecretName requires host"
+type GuestBookIngressSpec struct {
+	// Enabled turns on creation of the Ingress
+	Enabled bool `json:"enabled,omitempty"`
+
+	// Host is the external hostname routed to the guestbook
+	Host string `json:"host,omitempty"`
+
+	// IngressClassName selects the ingress controller that serves the Ingress
+	IngressClassName *string `json:"ingressClassName,omitempty"`
+
+	// TLSSecretName is the Secret holding the certificate for Host; TLS is
+	// disabled when empty
+	TLSSecretName string `json:"tlsSecretName,omitempty"`
+
+	// Annotations are added to the Ingress
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// GuestBookPersistenceSpec configures storage for guestbook entries
+// +kubebuilder:validation:XValidation:rule="!has(self.finalBackup) || !self.finalBackup || (has(self.enabled) && self.enabled)",message="finalBackup requires enabled"
+type GuestBookPersistenceSpec struct {
+	// Enabled creates a PVC and mounts it into the guestbook pods
+	Enabled bool `json:"enabled,omitempty"`
+
+	// Size is the requested storage size; it can grow but not shrink
+	// +kubebuilder:default="1Gi"
+	Size resource.Quantity `json:"size,omitempty"`
+
+	// StorageClassName selects the StorageClass; the cluster default is used when unset
+	StorageClassName *string `json:"storageClassName,omitempty"`
+
+	// AccessModes for the PVC; ReadWriteMany is needed for more than one replica
+	// across nodes
+	// +kubebuilder:default={"ReadWriteOnce"}
+	AccessModes []corev1.PersistentVolumeAccessMode `json:"accessModes,omitempty"`
+
+	// ReclaimPolicy decides whether the PVC is deleted with the GuestBook
+	// +kubebuilder:default=Delete
+	ReclaimPolicy ReclaimPolicy `json:"reclaimPolicy,omitempty"`
+
+	// FinalBackup archives the data volume into a separate PVC named
+	// <name>-final-backup before the GuestBook is deleted. That PVC outlives
+	// the GuestBook and is removed by hand.
+	FinalBackup bool `json:"finalBackup,omitempty"`
+}
+
+// ReclaimPolicy says whether a GuestBook's PVC outlives it
+// +kubebuilder:validation:Enum=Delete;Retain
+type ReclaimPolicy string
+
+const (
+	// ReclaimPolicyDelete deletes the PVC with the GuestBook
+	ReclaimPolicyDelete ReclaimPolicy = "Delete"
+
+	// ReclaimPolicyRetain releases the PVC from the GuestBook so it is kept
+	ReclaimPolicyRetain ReclaimPolicy = "Retain"
+)
+
+// GuestBookThemeSpec configures the appearance of the guestbook frontend
+type GuestBookThemeSpec struct {
+	// ColorScheme names the color palette used by the frontend
+	// +kubebuilder:default="default"
+	ColorScheme string `json:"colorScheme,omitempty"`
+
+	// BannerImage is the URL of an image shown at the top of the page
+	BannerImage string `json:"bannerImage,omitempty"`
+
+	// DarkMode switches the frontend to its dark variant
+	DarkMode bool `json:"darkMode,omitempty"`
+}
+
+// GuestBookRetentionSpec configures pruning of old guestbook entries.
+// Pruning is enabled when MaxEntries or TTL is set.
+type GuestBookRetentionSpec struct {
+	// MaxEntries is the number of most recent entries to keep
+	// +kubebuilder:validation:Minimum=1
+	MaxEntries *int32 `json:"maxEntries,omitempty"`
+
+	// TTL is how long an entry is kept before it is pruned, e.g. "720h"
+	TTL *metav1.Duration `json:"ttl,omitempty"`
+
+	// Schedule is the cron schedule for the prune job
+	// +kubebuilder:default="0 * * * *"
+	Schedule string `json:"schedule,omitempty"`
+}
+
+// GuestBookModerationSpec configures moderation of new entries
+type GuestBookModerationSpec struct {
+	// Enabled puts new entries in a moderation queue until approved
+	Enabled bool `json:"enabled,omitempty"`
+
+	// PolicyRef names a ModerationPolicy in the same namespace
+	// +optional
+	PolicyRef *corev1.LocalObjectReference `json:"policyRef,omitempty"`
+}
+
+// GuestBookAuthSpec configures authentication for the admin UI
+type GuestBookAuthSpec struct {
+	// BasicAuthSecretRef names a Secret in the same namespace with
+	// "username" and "password" keys; the admin UI is open when unset
+	BasicAuthSecretRef *corev1.LocalObjectReference `json:"basicAuthSecretRef,omitempty"`
+}
+
+// GuestBookTLSSpec configures HTTPS serving by the guestbook container.
+// TLS is enabled when either SecretRef or IssuerRef is set. The certificate
+// must be valid for the in-cluster Service name, which the controller uses
+// to reach the admin API, and the Secret's ca.crt must hold the CA that
+// issued it. cert-manager writes ca.crt for CA and self-signed issuers.
+// +kubebuilder:validation:XValidation:rule="!(has(self.secretRef) && has(self.issuerRef))",message="only one of secretRef or issuerRef may be set"
+type GuestBookTLSSpec struct {
+	// SecretRef names an existing kubernetes.io/tls Secret
+	SecretRef *corev1.LocalObjectReference `json:"secretRef,omitempty"`
+
+	// IssuerRef requests a certificate from cert-manager
+	IssuerRef *IssuerReference `json:"issuerRef,omitempty"`
+}
+
+// IssuerReference points at a cert-manager Issuer or ClusterIssuer
+type IssuerReference struct {
+	// Name of the issuer
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+
+	// Kind of the issuer
+	// +kubebuilder:validation:Enum=Issuer;ClusterIssuer
+	// +kubebuilder:default=Issuer
+	Kind string `json:"kind,omitempty"`
+}
+
+// ThemeReference points at a GuestBookTheme or ClusterGuestBookTheme
+type ThemeReference struct {
+	// Name of the theme
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+
+	// Kind of the theme
+	// +kubebuilder:validation:Enum=GuestBookTheme;ClusterGuestBookTheme
+	// +kubebuilder:default=GuestBookTheme
+	Kind string `json:"kind,omitempty"`
+}
+
+// GuestBookTemplateReference points at a GuestBookTemplate and passes its
+// parameters
+type GuestBookTemplateReference struct {
+	// Name of the GuestBookTemplate
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+
+	// Parameters are the values substituted for the template's placeholders
+	// +optional
+	Parameters map[string]string `json:"parameters,omitempty"`
+}
+
+// GuestBookProbesSpec overrides the default liveness, readiness and startup
+// probe settings
+type GuestBookProbesSpec struct {
+	// Liveness overrides the liveness probe settings
+	Liveness *ProbeSettings `json:"liveness,omitempty"`
+
+	// Readiness overrides the readiness probe settings
+	Readiness *ProbeSettings `json:"readiness,omitempty"`
+
+	// Startup overrides the startup probe settings
+	Startup *ProbeSettings `json:"startup,omitempty"`
+}
+
+// ProbeSettings holds probe timing overrides; unset fields keep the
+// controller defaults
+type ProbeSettings struct {
+	// InitialDelaySeconds is the delay before the first probe
+	// +kubebuilder:validation:Minimum=0
+	InitialDelaySeconds *int32 `json:"initialDelaySeconds,omitempty"`
+
+	// PeriodSeconds is how often the probe runs
+	// +kubebuilder:validation:Minimum=1
+	PeriodSeconds *int32 `json:"periodSeconds,omitempty"`
+
+	// FailureThreshold is the number of consecutive failures before the
+	// probe is considered failed
+	// +kubebuilder:validation:Minimum=1
+	FailureThreshold *int32 `json:"failureThreshold,omitempty"`
+}
+
+// BackendType names a data store for guestbook entries
+// +kubebuilder:validation:Enum=inMemory;redis;postgres;external
+type BackendType string
+
+const (
+	// BackendInMemory keeps entries in the guestbook process; they are lost on restart
+	BackendInMemory BackendType = "inMemory"
+
+	// BackendRedis stores entries in a Redis instance managed by the operator
+	BackendRedis BackendType = "redis"
+
+	// BackendPostgres stores entries in a PostgreSQL instance managed by the operator
+	BackendPostgres BackendType = "postgres"
+
+	// BackendExternal stores entries in an existing database outside the operator's control
+	BackendExternal BackendType = "external"
+)
+
+// GuestBookBackendSpec configures the data store for guestbook entries
+// +kubebuilder:validation:XValidation:rule="self.type != 'external' || has(self.external)",message="external is required when type is external"
+type GuestBookBackendSpec struct {
+	// Type is the kind of data store the controller provisions. It can't be
+	// changed in place; a GuestBookBackendMigration moves the entries over.
+	// +kubebuilder:default=inMemory
+	Type BackendType `json:"type,omitempty"`
+
+	// External points at an existing database when Type is external
+	External *ExternalBackendSpec `json:"external,omitempty"`
+}
+
+// ExternalBackendSpec describes an existing database used as the data store
+type ExternalBackendSpec struct {
+	// Driver is the database engine
+	// +kubebuilder:validation:Enum=postgres;mysql
+	// +kubebuilder:default=postgres
+	Driver string `json:"driver,omitempty"`
+
+	// ConnectionSecretRef names a Secret in the same namespace with "host",
+	// "port", "username", "password" and "database" keys
+	ConnectionSecretRef corev1.LocalObjectReference `json:"connectionSecretRef"`
+
+	// CleanupPolicy decides what happens to the guestbook's tables when the
+	// GuestBook is deleted
+	// +kubebuilder:default=Retain
+	CleanupPolicy CleanupPolicy `json:"cleanupPolicy,omitempty"`
+}
+
+// ExternalConnectionSecretKeys must all be set in an external backend's
+// connection Secret
+var ExternalConnectionSecretKeys = []string{"host", "port", "username", "password", "database"}
+
+// CleanupPolicy says whether data outside the cluster outlives its GuestBook
+// +kubebuilder:validation:Enum=Retain;Drop
+type CleanupPolicy string
+
+const (
+	// CleanupPolicyRetain leaves the data in place
+	CleanupPolicyRetain CleanupPolicy = "Retain"
+
+	// CleanupPolicyDrop deletes the data before the GuestBook is removed
+	CleanupPolicyDrop CleanupPolicy = "Drop"
+)
+
+// GuestBookNetworkPolicySpec configures the NetworkPolicy for a GuestBook
+type GuestBookNetworkPolicySpec struct {
+	// Enabled creates a NetworkPolicy that denies all inbound traffic to the
+	// guestbook pods except to the guestbook port
+	Enabled bool `json:"enabled,omitempty"`
+
+	// From lists the sources allowed to reach the guestbook port; any source
+	// is allowed when empty. Pods belonging to the GuestBook, such as the
+	// prune job, are always allowed. Add the operator's namespace here for
+	// status fields that query the app, like pendingEntries.
+	From []networkingv1.NetworkPolicyPeer `json:"from,omitempty"`
+}
+
+// GuestBookLoggingSpec configures application logging
+type GuestBookLoggingSpec struct {
+	// Level is the minimum severity that is logged
+	// +kubebuilder:validation:Enum=debug;info;warn;error
+	// +kubebuilder:default=info
+	Level string `json:"level,omitempty"`
+
+	// Format is the log line format
+	// +kubebuilder:validation:Enum=text;json
+	// +kubebuilder:default=text
+	Format string `json:"format,omitempty"`
+}
+
+// GuestBookVersionStatus identifies a running guestbook build
+type GuestBookVersionStatus struct {
+	// ImageDigest is the digest the container runtime resolved status.image to
+	ImageDigest string `json:"imageDigest,omitempty"`
+
+	// AppVersion is the version string reported by the guestbook itself
+	AppVersion string `json:"appVersion,omitempty"`
 }
 
+// GuestBookPhase is a coarse lifecycle state derived from the conditions
+// +kubebuilder:validation:Enum=Pending;Provisioning;Ready;Degraded;Terminating
+type GuestBookPhase string
+
+const (
+	// PhasePending means the guestbook is waiting on a dependency, such as its
+	// backend or image pull Secrets, before any replica can serve
+	PhasePending GuestBookPhase = "Pending"
+
+	// PhaseProvisioning means a rollout of the current spec is in progress
+	PhaseProvisioning GuestBookPhase = "Provisioning"
+
+	// PhaseReady means every desired replica is available
+	PhaseReady GuestBookPhase = "Ready"
+
+	// PhaseDegraded means the guestbook is rolled out but some replicas or
+	// dependencies are unavailable
+	PhaseDegraded GuestBookPhase = "Degraded"
+
+	// PhaseTerminating means the GuestBook is being deleted
+	PhaseTerminating GuestBookPhase = "Terminating"
+)
+
 // GuestBookStatus defines the observed state of GuestBook
 type GuestBookStatus struct {
+	// ObservedGeneration is the .metadata.generation the status was last
+	// computed for; status is stale while it lags behind
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Phase summarizes the GuestBook's health in one word
+	// +optional
+	Phase GuestBookPhase `json:"phase,omitempty"`
+
 	// AvailableReplicas is the number of running replicas
 	AvailableReplicas int32 `json:"availableReplicas"`
 
-	// URL is the service endpoint
+	// Replicas is the number of guestbook pods, in any state
+	Replicas int32 `json:"replicas,omitempty"`
+
+	// Selector is the label selector of the guestbook pods, for the scale
+	// subresource
+	Selector string `json:"selector,omitempty"`
+
+	// ReadyReplicas is the number of guestbook pods passing their readiness probe
+	ReadyReplicas int32 `json:"readyReplicas,omitempty"`
+
+	// UpdatedReplicas is the number of pods running the latest pod template
+	UpdatedReplicas int32 `json:"updatedReplicas,omitempty"`
+
+	// UnavailableReplicas is the number of pods still needed before the
+	// Deployment is fully available
+	UnavailableReplicas int32 `json:"unavailableReplicas,omitempty"`
+
+	// URL is where clients reach the guestbook: its DNS name, Ingress or
+	// load balancer address, or else the in-cluster Service endpoint
 	URL string `json:"url,omitempty"`
 
+	// ServiceURL is the in-cluster endpoint of the managed Service
+	ServiceURL string `json:"serviceURL,omitempty"`
+
+	// Image is the container image currently running on all replicas
+	Image string `json:"image,omitempty"`
+
+	// Version identifies the guestbook build the replicas are running
+	// +optional
+	Version *GuestBookVersionStatus `json:"version,omitempty"`
+
+	// LastPruneTime is when the retention job last completed successfully
+	LastPruneTime *metav1.Time `json:"lastPruneTime,omitempty"`
+
+	// PendingEntries is the number of entries awaiting moderation. It and
+	// the entry stats below are polled from the guestbook every five minutes,
+	// so they may lag behind.
+	PendingEntries int32 `json:"pendingEntries,omitempty"`
+
+	// EntryCount is the number of entries stored in the guestbook
+	EntryCount int64 `json:"entryCount,omitempty"`
+
+	// LastEntryTime is when the newest entry was written
+	LastEntryTime *metav1.Time `json:"lastEntryTime,omitempty"`
+
+	// ConfigHash is a hash of the configuration the guestbook should run
+	// with. It differs from the pods' webapp.example.com/config-hash
+	// annotation while a change has yet to roll out.
+	ConfigHash string `json:"configHash,omitempty"`
+
+	// LastReconcileTime is when the controller last finished reconciling the
+	// GuestBook, successfully or not
+	LastReconcileTime *metav1.Time `json:"lastReconcileTime,omitempty"`
+
+	// LastSuccessfulReconcileTime is when the controller last reconciled the
+	// GuestBook without error
+	LastSuccessfulReconcileTime *metav1.Time `json:"lastSuccessfulReconcileTime,omitempty"`
+
+	// LastReconcileError summarizes why the last reconcile failed; empty
+	// after a successful one
+	LastReconcileError string `json:"lastReconcileError,omitempty"`
+
 	// Conditions represent the latest observations of the GuestBook state
 	// +patchMergeKey=type
 	// +patchStrategy=merge
@@ -55,13 +768,21 @@ type GuestBookStatus struct {
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
+// +kubebuilder:subresource:scale:specpath=.spec.replicas,statuspath=.status.replicas,selectorpath=.status.selector
 // +kubebuilder:resource:shortName=gb
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
 // +kubebuilder:printcolumn:name="Replicas",type=integer,JSONPath=`.spec.replicas`
+// +kubebuilder:printcolumn:name="Ready",type=integer,JSONPath=`.status.readyReplicas`
+// +kubebuilder:printcolumn:name="Up-to-date",type=integer,JSONPath=`.status.updatedReplicas`
 // +kubebuilder:printcolumn:name="Available",type=integer,JSONPath=`.status.availableReplicas`
+// +kubebuilder:printcolumn:name="Entries",type=integer,JSONPath=`.status.entryCount`
 // +kubebuilder:printcolumn:name="Message",type=string,JSONPath=`.spec.welcomeMessage`
+// +kubebuilder:printcolumn:name="Image",type=string,JSONPath=`.status.image`,priority=1
 // +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
-// GuestBook is the Schema for the guestbooks API
+// GuestBook is the Schema for the guestbooks API. Deleting a GuestBook
+// leaves its GuestBookBackups and their object store snapshots in place
+// unless backupCleanupPolicy is Drop.
 type GuestBook struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
@@ -0,0 +1,279 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	webappv1alpha1 "github.com/yourusername/guestbook-operator/api/v1alpha1"
+)
+
+// userFinalizer holds a deleted GuestBookUser until its account is removed
+// from the guestbook
+const userFinalizer = "guestbook.example.com/user"
+
+// userGuestBookIndex is the cache index of GuestBookUsers by GuestBook name
+const userGuestBookIndex = "spec.guestBookRef.name"
+
+// userSecretIndex is the cache index of GuestBookUsers by password Secret name
+const userSecretIndex = "spec.passwordSecretRef.name"
+
+// userResyncInterval is how often a synced account is written again, which
+// restores it after the guestbook lost its accounts, e.g. an inMemory restart
+const userResyncInterval = 10 * time.Minute
+
+// userRetryInterval is how often an account waiting on its GuestBook or on a
+// username conflict is rechecked
+const userRetryInterval = 30 * time.Second
+
+// UserReconciler keeps GuestBookUsers in their guestbook's auth backend
+type UserReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+
+	// HTTPClient is used to call the guestbook admin API; a client with a
+	// short timeout is used when nil
+	HTTPClient *http.Client
+
+	// Recorder emits events on users; SetupWithManager fills it in from
+	// the manager when nil
+	Recorder record.EventRecorder
+}
+
+// +kubebuilder:rbac:groups=webapp.example.com,resources=guestbookusers,verbs=get;list;watch;update;patch
+// +kubebuilder:rbac:groups=webapp.example.com,resources=guestbookusers/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=webapp.example.com,resources=guestbookusers/finalizers,verbs=update
+
+// Reconcile writes the account to its guestbook, or removes it once deleted
+func (r *UserReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	user := &webappv1alpha1.GuestBookUser{}
+	if err := r.Get(ctx, req.NamespacedName, user); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	gb := &webappv1alpha1.GuestBook{}
+	err := r.Get(ctx, types.NamespacedName{Name: user.Spec.GuestBookRef.Name, Namespace: user.Namespace}, gb)
+	if errors.IsNotFound(err) {
+		gb = nil
+	} else if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if !user.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, r.reconcileDelete(ctx, user, gb)
+	}
+	if controllerutil.AddFinalizer(user, userFinalizer) {
+		if err := r.Update(ctx, user); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	base := user.DeepCopy()
+	result := ctrl.Result{RequeueAfter: userResyncInterval}
+	owner, err := r.usernameOwner(ctx, user)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	switch {
+	case owner != user.Name:
+		setUserCondition(user, metav1.ConditionFalse, "UsernameConflict",
+			fmt.Sprintf("GuestBookUser %s already manages username %s", owner, user.Spec.Username))
+		result = ctrl.Result{RequeueAfter: userRetryInterval}
+	case gb == nil:
+		setUserCondition(user, metav1.ConditionFalse, "GuestBookNotFound",
+			fmt.Sprintf("GuestBook %s not found", user.Spec.GuestBookRef.Name))
+		result = ctrl.Result{}
+	case !meta.IsStatusConditionTrue(gb.Status.Conditions, conditionReady):
+		setUserCondition(user, metav1.ConditionFalse, "GuestBookNotReady",
+			fmt.Sprintf("Waiting for GuestBook %s to become ready", gb.Name))
+		result = ctrl.Result{RequeueAfter: userRetryInterval}
+	default:
+		if err := r.sync(ctx, user, gb); err != nil {
+			log.Error(err, "Failed to sync user", "guestbook", gb.Name)
+			if setUserCondition(user, metav1.ConditionFalse, "SyncFailed", err.Error()) {
+				r.Recorder.Eventf(user, corev1.EventTypeWarning, "SyncFailed", "Failed to write account to GuestBook %s: %v", gb.Name, err)
+			}
+			if patchErr := r.Status().Patch(ctx, user, client.MergeFrom(base)); patchErr != nil {
+				log.Error(patchErr, "Failed to update GuestBookUser status")
+			}
+			return ctrl.Result{}, err
+		}
+	}
+
+	if err := r.Status().Patch(ctx, user, client.MergeFrom(base)); err != nil {
+		return ctrl.Result{}, err
+	}
+	return result, nil
+}
+
+// sync writes the account with the current password from its Secret
+func (r *UserReconciler) sync(ctx context.Context, user *webappv1alpha1.GuestBookUser, gb *webappv1alpha1.GuestBook) error {
+	secret := &corev1.Secret{}
+	if err := r.Get(ctx, types.NamespacedName{Name: user.Spec.PasswordSecretRef.Name, Namespace: user.Namespace}, secret); err != nil {
+		return fmt.Errorf("password Secret %s: %w", user.Spec.PasswordSecretRef.Name, err)
+	}
+	password := secret.Data["password"]
+	if len(password) == 0 {
+		return fmt.Errorf("password Secret %s has no \"password\" key", secret.Name)
+	}
+
+	role := user.Spec.Role
+	if role == "" {
+		role = webappv1alpha1.UserRoleModerator
+	}
+	app, err := newAppClient(ctx, r.Client, r.HTTPClient, gb)
+	if err != nil {
+		return err
+	}
+	if err := app.putUser(ctx, user.Spec.Username, appUser{
+		Role:     string(role),
+		Password: string(password),
+	}); err != nil {
+		return err
+	}
+
+	now := metav1.Now()
+	user.Status.Username = user.Spec.Username
+	user.Status.PasswordSecretVersion = secret.ResourceVersion
+	user.Status.LastSyncTime = &now
+	user.Status.ObservedGeneration = user.Generation
+	if setUserCondition(user, metav1.ConditionTrue, "Synced", fmt.Sprintf("Account %s exists in GuestBook %s", user.Spec.Username, gb.Name)) {
+		r.Recorder.Eventf(user, corev1.EventTypeNormal, "Synced", "Wrote account %s to GuestBook %s", user.Spec.Username, gb.Name)
+	}
+	return nil
+}
+
+// usernameOwner returns which GuestBookUser of the GuestBook manages the
+// username. The oldest one wins, so a duplicate can't take over an account.
+func (r *UserReconciler) usernameOwner(ctx context.Context, user *webappv1alpha1.GuestBookUser) (string, error) {
+	users := &webappv1alpha1.GuestBookUserList{}
+	if err := r.List(ctx, users, client.InNamespace(user.Namespace), client.MatchingFields{userGuestBookIndex: user.Spec.GuestBookRef.Name}); err != nil {
+		return "", err
+	}
+	owner := user
+	for i := range users.Items {
+		other := &users.Items[i]
+		if other.Spec.Username != user.Spec.Username || !other.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if other.CreationTimestamp.Before(&owner.CreationTimestamp) ||
+			(other.CreationTimestamp.Equal(&owner.CreationTimestamp) && other.Name < owner.Name) {
+			owner = other
+		}
+	}
+	return owner.Name, nil
+}
+
+// reconcileDelete removes the account from its guestbook before letting the
+// GuestBookUser go. Nothing is left to remove once the GuestBook is gone,
+// and a duplicate never wrote the account it conflicted over.
+func (r *UserReconciler) reconcileDelete(ctx context.Context, user *webappv1alpha1.GuestBookUser, gb *webappv1alpha1.GuestBook) error {
+	if !controllerutil.ContainsFinalizer(user, userFinalizer) {
+		return nil
+	}
+	if gb != nil && gb.DeletionTimestamp.IsZero() && user.Status.LastSyncTime != nil {
+		app, err := newAppClient(ctx, r.Client, r.HTTPClient, gb)
+		if err != nil {
+			return err
+		}
+		if err := app.deleteUser(ctx, user.Spec.Username); err != nil {
+			return fmt.Errorf("removing account from GuestBook %s: %w", gb.Name, err)
+		}
+	}
+	controllerutil.RemoveFinalizer(user, userFinalizer)
+	return r.Update(ctx, user)
+}
+
+// setUserCondition sets the Synced condition and reports whether it changed
+func setUserCondition(user *webappv1alpha1.GuestBookUser, status metav1.ConditionStatus, reason, message string) bool {
+	return meta.SetStatusCondition(&user.Status.Conditions, metav1.Condition{
+		Type:               conditionSynced,
+		Status:             status,
+		ObservedGeneration: user.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// findUsersForGuestBook maps a GuestBook to its accounts, so they are
+// written as soon as it becomes ready
+func (r *UserReconciler) findUsersForGuestBook(ctx context.Context, obj client.Object) []reconcile.Request {
+	return r.findUsers(ctx, obj, userGuestBookIndex)
+}
+
+// findUsersForSecret maps a password Secret to the accounts using it, so a
+// rotated password is written straight away
+func (r *UserReconciler) findUsersForSecret(ctx context.Context, obj client.Object) []reconcile.Request {
+	return r.findUsers(ctx, obj, userSecretIndex)
+}
+
+// findUsers lists the GuestBookUsers in obj's namespace whose index value
+// is obj's name
+func (r *UserReconciler) findUsers(ctx context.Context, obj client.Object, index string) []reconcile.Request {
+	users := &webappv1alpha1.GuestBookUserList{}
+	if err := r.List(ctx, users, client.InNamespace(obj.GetNamespace()), client.MatchingFields{index: obj.GetName()}); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list GuestBookUsers", "index", index, "name", obj.GetName())
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(users.Items))
+	for _, user := range users.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&user)})
+	}
+	return requests
+}
+
+// SetupWithManager sets up the controller with the Manager
+func (r *UserReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.Recorder == nil {
+		r.Recorder = mgr.GetEventRecorderFor("guestbookuser-controller")
+	}
+	indexer := mgr.GetFieldIndexer()
+	if err := indexer.IndexField(context.Background(), &webappv1alpha1.GuestBookUser{}, userGuestBookIndex, func(obj client.Object) []string {
+		return []string{obj.(*webappv1alpha1.GuestBookUser).Spec.GuestBookRef.Name}
+	}); err != nil {
+		return err
+	}
+	if err := indexer.IndexField(context.Background(), &webappv1alpha1.GuestBookUser{}, userSecretIndex, func(obj client.Object) []string {
+		return []string{obj.(*webappv1alpha1.GuestBookUser).Spec.PasswordSecretRef.Name}
+	}); err != nil {
+		return err
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&webappv1alpha1.GuestBookUser{}).
+		Watches(&webappv1alpha1.GuestBook{}, handler.EnqueueRequestsFromMapFunc(r.findUsersForGuestBook)).
+		Watches(&corev1.Secret{}, handler.EnqueueRequestsFromMapFunc(r.findUsersForSecret)).
+		Complete(r)
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// UserRole is what a GuestBookUser may do in the admin UI
+// +kubebuilder:validation:Enum=admin;moderator
+type UserRole string
+
+const (
+	// UserRoleAdmin has full access to the admin UI
+	UserRoleAdmin UserRole = "admin"
+	// UserRoleModerator may only approve and reject entries
+	UserRoleModerator UserRole = "moderator"
+)
+
+// GuestBookUserSpec defines the desired state of GuestBookUser
+type GuestBookUserSpec struct {
+	// GuestBookRef is the GuestBook in the same namespace the account belongs to
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="guestBookRef is immutable"
+	GuestBookRef corev1.LocalObjectReference `json:"guestBookRef"`
+
+	// Username is the login name of the account
+	// +kubebuilder:validation:Pattern=`^[a-z0-9][a-z0-9._-]{0,62}$`
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="username is immutable"
+	Username string `json:"username"`
+
+	// Role of the account
+	// +kubebuilder:default=moderator
+	Role UserRole `json:"role,omitempty"`
+
+	// PasswordSecretRef names a Secret in the same namespace with a
+	// "password" key. Changing the password in the Secret updates the account.
+	PasswordSecretRef corev1.LocalObjectReference `json:"passwordSecretRef"`
+}
+
+// GuestBookUserStatus defines the observed state of GuestBookUser
+type GuestBookUserStatus struct {
+	// ObservedGeneration is the generation last written to the guestbook
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Username is the account last written to the guestbook
+	// +optional
+	Username string `json:"username,omitempty"`
+
+	// PasswordSecretVersion is the resourceVersion of the password Secret
+	// last written to the guestbook
+	// +optional
+	PasswordSecretVersion string `json:"passwordSecretVersion,omitempty"`
+
+	// LastSyncTime is when the account was last written to the guestbook
+	// +optional
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+
+	// Conditions report whether the account exists in the guestbook ("Synced")
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:shortName=gbu
+// +kubebuilder:printcolumn:name="GuestBook",type=string,JSONPath=`.spec.guestBookRef.name`
+// +kubebuilder:printcolumn:name="Username",type=string,JSONPath=`.spec.username`
+// +kubebuilder:printcolumn:name="Role",type=string,JSONPath=`.spec.role`
+// +kubebuilder:printcolumn:name="Synced",type=string,JSONPath=`.status.conditions[?(@.type=="Synced")].status`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// GuestBookUser is an admin UI account of a GuestBook. The controller keeps
+// it in the guestbook's auth backend and removes it when the GuestBookUser
+// is deleted.
+type GuestBookUser struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   GuestBookUserSpec   `json:"spec,omitempty"`
+	Status GuestBookUserStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// GuestBookUserList contains a list of GuestBookUser
+type GuestBookUserList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []GuestBookUser `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&GuestBookUser{}, &GuestBookUserList{})
+}
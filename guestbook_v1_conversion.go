@@ -0,0 +1,337 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"fmt"
+
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+
+	"github.com/yourusername/guestbook-operator/api/v1alpha1"
+)
+
+// The conversions below name every field, so that a field added to one
+// version but not the other stands out in review. Blocks whose layout is the
+// same in both versions are converted with Go type conversions, which stop
+// compiling as soon as the layouts diverge.
+//
+// v1 keeps the v1beta1 layout, so this file is a line-for-line copy of the
+// v1beta1 conversion with the package swapped. The helpers can't be shared:
+// each version's nested blocks are distinct named types, which Go won't
+// convert between. A change to one file must be made to the other.
+
+var _ conversion.Convertible = &GuestBook{}
+
+// ConvertTo converts this GuestBook to the v1alpha1 hub version
+func (src *GuestBook) ConvertTo(dstRaw conversion.Hub) error {
+	dst, ok := dstRaw.(*v1alpha1.GuestBook)
+	if !ok {
+		return fmt.Errorf("expected a v1alpha1 GuestBook but got %T", dstRaw)
+	}
+	dst.ObjectMeta = src.ObjectMeta
+	dst.Spec = specToHub(src.Spec)
+	dst.Status = statusToHub(src.Status)
+	return nil
+}
+
+// ConvertFrom converts the v1alpha1 hub version to this GuestBook
+func (dst *GuestBook) ConvertFrom(srcRaw conversion.Hub) error {
+	src, ok := srcRaw.(*v1alpha1.GuestBook)
+	if !ok {
+		return fmt.Errorf("expected a v1alpha1 GuestBook but got %T", srcRaw)
+	}
+	dst.ObjectMeta = src.ObjectMeta
+	dst.Spec = specFromHub(src.Spec)
+	dst.Status = statusFromHub(src.Status)
+	return nil
+}
+
+// specToHub converts a v1 spec to v1alpha1
+func specToHub(in GuestBookSpec) v1alpha1.GuestBookSpec {
+	out := v1alpha1.GuestBookSpec{
+		Replicas:        in.Replicas,
+		Autoscaling:     (*v1alpha1.AutoscalingSpec)(in.Autoscaling),
+		WelcomeMessage:  in.WelcomeMessage,
+		WelcomeMessages: in.WelcomeMessages,
+		Image:           in.Image,
+		ImagePullPolicy: in.ImagePullPolicy,
+
+		Port:                 in.Service.Port,
+		TargetPort:           in.Service.TargetPort,
+		AllowPrivilegedPorts: in.Service.AllowPrivilegedPorts,
+
+		Resources:    in.Resources,
+		Size:         v1alpha1.GuestBookSize(in.Size),
+		NodeSelector: in.NodeSelector,
+		Tolerations:  in.Tolerations,
+		Affinity:     in.Affinity,
+		ExtraEnv:     in.ExtraEnv,
+		EnvFrom:      in.EnvFrom,
+
+		Service: v1alpha1.GuestBookServiceSpec{
+			Type:                     in.Service.Type,
+			LoadBalancerSourceRanges: in.Service.LoadBalancerSourceRanges,
+			Annotations:              in.Service.Annotations,
+		},
+		Ingress: v1alpha1.GuestBookIngressSpec{
+			Enabled:          in.Ingress.Enabled,
+			Host:             in.Ingress.Host,
+			IngressClassName: in.Ingress.IngressClassName,
+			Annotations:      in.Ingress.Annotations,
+		},
+		Persistence: persistenceToHub(in.Backend.Persistence),
+
+		Theme:                     v1alpha1.GuestBookThemeSpec(in.Theme),
+		ThemeRef:                  (*v1alpha1.ThemeReference)(in.ThemeRef),
+		TemplateRef:               (*v1alpha1.GuestBookTemplateReference)(in.TemplateRef),
+		TemplateConfigMapRef:      in.TemplateConfigMapRef,
+		Retention:                 v1alpha1.GuestBookRetentionSpec(in.Retention),
+		Moderation:                v1alpha1.GuestBookModerationSpec(in.Moderation),
+		Auth:                      v1alpha1.GuestBookAuthSpec(in.Auth),
+		TLS:                       v1alpha1.GuestBookTLSSpec{SecretRef: in.TLS.SecretRef, IssuerRef: (*v1alpha1.IssuerReference)(in.TLS.IssuerRef)},
+		Probes:                    probesToHub(in.Probes),
+		PodSecurityContext:        in.PodSecurityContext,
+		ContainerSecurityContext:  in.ContainerSecurityContext,
+		ServiceAccountName:        in.ServiceAccountName,
+		ImagePullSecrets:          in.ImagePullSecrets,
+		PriorityClassName:         in.PriorityClassName,
+		TopologySpreadConstraints: in.TopologySpreadConstraints,
+		PodTemplateMetadata:       v1alpha1.PodTemplateMetadata(in.PodTemplateMetadata),
+		Sidecars:                  in.Sidecars,
+		InitContainers:            in.InitContainers,
+		Suspend:                   in.Suspend,
+		ScaleToZeroWhenSuspended:  in.ScaleToZeroWhenSuspended,
+
+		Backend: v1alpha1.GuestBookBackendSpec{
+			Type:     v1alpha1.BackendType(in.Backend.Type),
+			External: externalBackendToHub(in.Backend.External),
+		},
+
+		MaintenanceWindow:   (*v1alpha1.MaintenanceWindow)(in.MaintenanceWindow),
+		UpdateStrategy:      in.UpdateStrategy,
+		PodDisruptionBudget: (*v1alpha1.PodDisruptionBudgetSpec)(in.PodDisruptionBudget),
+		NetworkPolicy:       v1alpha1.GuestBookNetworkPolicySpec(in.NetworkPolicy),
+		Logging:             v1alpha1.GuestBookLoggingSpec(in.Logging),
+		ReadOnly:            in.ReadOnly,
+		RateLimit:           (*v1alpha1.RateLimitSpec)(in.RateLimit),
+		CORS:                (*v1alpha1.CORSSpec)(in.CORS),
+		DNS:                 v1alpha1.GuestBookDNSSpec(in.DNS),
+		Monitoring:          v1alpha1.GuestBookMonitoringSpec(in.Monitoring),
+		BackupCleanupPolicy: v1alpha1.CleanupPolicy(in.BackupCleanupPolicy),
+	}
+	if in.Ingress.TLS != nil {
+		out.Ingress.TLSSecretName = in.Ingress.TLS.SecretName
+	}
+	return out
+}
+
+// specFromHub converts a v1alpha1 spec to v1
+func specFromHub(in v1alpha1.GuestBookSpec) GuestBookSpec {
+	out := GuestBookSpec{
+		Replicas:        in.Replicas,
+		Autoscaling:     (*AutoscalingSpec)(in.Autoscaling),
+		WelcomeMessage:  in.WelcomeMessage,
+		WelcomeMessages: in.WelcomeMessages,
+		Image:           in.Image,
+		ImagePullPolicy: in.ImagePullPolicy,
+		Resources:       in.Resources,
+		Size:            GuestBookSize(in.Size),
+		NodeSelector:    in.NodeSelector,
+		Tolerations:     in.Tolerations,
+		Affinity:        in.Affinity,
+		ExtraEnv:        in.ExtraEnv,
+		EnvFrom:         in.EnvFrom,
+
+		Service: GuestBookServiceSpec{
+			Port:                     in.Port,
+			TargetPort:               in.TargetPort,
+			AllowPrivilegedPorts:     in.AllowPrivilegedPorts,
+			Type:                     in.Service.Type,
+			LoadBalancerSourceRanges: in.Service.LoadBalancerSourceRanges,
+			Annotations:              in.Service.Annotations,
+		},
+		Ingress: GuestBookIngressSpec{
+			Enabled:          in.Ingress.Enabled,
+			Host:             in.Ingress.Host,
+			IngressClassName: in.Ingress.IngressClassName,
+			Annotations:      in.Ingress.Annotations,
+		},
+
+		Theme:                     GuestBookThemeSpec(in.Theme),
+		ThemeRef:                  (*ThemeReference)(in.ThemeRef),
+		TemplateRef:               (*GuestBookTemplateReference)(in.TemplateRef),
+		TemplateConfigMapRef:      in.TemplateConfigMapRef,
+		Retention:                 GuestBookRetentionSpec(in.Retention),
+		Moderation:                GuestBookModerationSpec(in.Moderation),
+		Auth:                      GuestBookAuthSpec(in.Auth),
+		TLS:                       GuestBookTLSSpec{SecretRef: in.TLS.SecretRef, IssuerRef: (*IssuerReference)(in.TLS.IssuerRef)},
+		Probes:                    probesFromHub(in.Probes),
+		PodSecurityContext:        in.PodSecurityContext,
+		ContainerSecurityContext:  in.ContainerSecurityContext,
+		ServiceAccountName:        in.ServiceAccountName,
+		ImagePullSecrets:          in.ImagePullSecrets,
+		PriorityClassName:         in.PriorityClassName,
+		TopologySpreadConstraints: in.TopologySpreadConstraints,
+		PodTemplateMetadata:       PodTemplateMetadata(in.PodTemplateMetadata),
+		Sidecars:                  in.Sidecars,
+		InitContainers:            in.InitContainers,
+		Suspend:                   in.Suspend,
+		ScaleToZeroWhenSuspended:  in.ScaleToZeroWhenSuspended,
+
+		Backend: GuestBookBackendSpec{
+			Type:        BackendType(in.Backend.Type),
+			External:    externalBackendFromHub(in.Backend.External),
+			Persistence: persistenceFromHub(in.Persistence),
+		},
+
+		MaintenanceWindow:   (*MaintenanceWindow)(in.MaintenanceWindow),
+		UpdateStrategy:      in.UpdateStrategy,
+		PodDisruptionBudget: (*PodDisruptionBudgetSpec)(in.PodDisruptionBudget),
+		NetworkPolicy:       GuestBookNetworkPolicySpec(in.NetworkPolicy),
+		Logging:             GuestBookLoggingSpec(in.Logging),
+		ReadOnly:            in.ReadOnly,
+		RateLimit:           (*RateLimitSpec)(in.RateLimit),
+		CORS:                (*CORSSpec)(in.CORS),
+		DNS:                 GuestBookDNSSpec(in.DNS),
+		Monitoring:          GuestBookMonitoringSpec(in.Monitoring),
+		BackupCleanupPolicy: CleanupPolicy(in.BackupCleanupPolicy),
+	}
+	if in.Ingress.TLSSecretName != "" {
+		out.Ingress.TLS = &GuestBookIngressTLSSpec{SecretName: in.Ingress.TLSSecretName}
+	}
+	return out
+}
+
+// persistenceToHub converts the v1 persistence block to v1alpha1
+func persistenceToHub(in GuestBookPersistenceSpec) v1alpha1.GuestBookPersistenceSpec {
+	return v1alpha1.GuestBookPersistenceSpec{
+		Enabled:          in.Enabled,
+		Size:             in.Size,
+		StorageClassName: in.StorageClassName,
+		AccessModes:      in.AccessModes,
+		ReclaimPolicy:    v1alpha1.ReclaimPolicy(in.ReclaimPolicy),
+		FinalBackup:      in.FinalBackup,
+	}
+}
+
+// persistenceFromHub converts the v1alpha1 persistence block to v1
+func persistenceFromHub(in v1alpha1.GuestBookPersistenceSpec) GuestBookPersistenceSpec {
+	return GuestBookPersistenceSpec{
+		Enabled:          in.Enabled,
+		Size:             in.Size,
+		StorageClassName: in.StorageClassName,
+		AccessModes:      in.AccessModes,
+		ReclaimPolicy:    ReclaimPolicy(in.ReclaimPolicy),
+		FinalBackup:      in.FinalBackup,
+	}
+}
+
+// externalBackendToHub converts the v1 external backend to v1alpha1
+func externalBackendToHub(in *ExternalBackendSpec) *v1alpha1.ExternalBackendSpec {
+	if in == nil {
+		return nil
+	}
+	return &v1alpha1.ExternalBackendSpec{
+		Driver:              in.Driver,
+		ConnectionSecretRef: in.ConnectionSecretRef,
+		CleanupPolicy:       v1alpha1.CleanupPolicy(in.CleanupPolicy),
+	}
+}
+
+// externalBackendFromHub converts the v1alpha1 external backend to v1
+func externalBackendFromHub(in *v1alpha1.ExternalBackendSpec) *ExternalBackendSpec {
+	if in == nil {
+		return nil
+	}
+	return &ExternalBackendSpec{
+		Driver:              in.Driver,
+		ConnectionSecretRef: in.ConnectionSecretRef,
+		CleanupPolicy:       CleanupPolicy(in.CleanupPolicy),
+	}
+}
+
+// probesToHub converts the v1 probe overrides to v1alpha1
+func probesToHub(in GuestBookProbesSpec) v1alpha1.GuestBookProbesSpec {
+	return v1alpha1.GuestBookProbesSpec{
+		Liveness:  (*v1alpha1.ProbeSettings)(in.Liveness),
+		Readiness: (*v1alpha1.ProbeSettings)(in.Readiness),
+		Startup:   (*v1alpha1.ProbeSettings)(in.Startup),
+	}
+}
+
+// probesFromHub converts the v1alpha1 probe overrides to v1
+func probesFromHub(in v1alpha1.GuestBookProbesSpec) GuestBookProbesSpec {
+	return GuestBookProbesSpec{
+		Liveness:  (*ProbeSettings)(in.Liveness),
+		Readiness: (*ProbeSettings)(in.Readiness),
+		Startup:   (*ProbeSettings)(in.Startup),
+	}
+}
+
+// statusToHub converts a v1 status to v1alpha1
+func statusToHub(in GuestBookStatus) v1alpha1.GuestBookStatus {
+	return v1alpha1.GuestBookStatus{
+		ObservedGeneration:          in.ObservedGeneration,
+		Phase:                       v1alpha1.GuestBookPhase(in.Phase),
+		AvailableReplicas:           in.AvailableReplicas,
+		Replicas:                    in.Replicas,
+		Selector:                    in.Selector,
+		ReadyReplicas:               in.ReadyReplicas,
+		UpdatedReplicas:             in.UpdatedReplicas,
+		UnavailableReplicas:         in.UnavailableReplicas,
+		URL:                         in.URL,
+		ServiceURL:                  in.ServiceURL,
+		Image:                       in.Image,
+		Version:                     (*v1alpha1.GuestBookVersionStatus)(in.Version),
+		LastPruneTime:               in.LastPruneTime,
+		PendingEntries:              in.PendingEntries,
+		EntryCount:                  in.EntryCount,
+		LastEntryTime:               in.LastEntryTime,
+		ConfigHash:                  in.ConfigHash,
+		LastReconcileTime:           in.LastReconcileTime,
+		LastSuccessfulReconcileTime: in.LastSuccessfulReconcileTime,
+		LastReconcileError:          in.LastReconcileError,
+		Conditions:                  in.Conditions,
+	}
+}
+
+// statusFromHub converts a v1alpha1 status to v1
+func statusFromHub(in v1alpha1.GuestBookStatus) GuestBookStatus {
+	return GuestBookStatus{
+		ObservedGeneration:          in.ObservedGeneration,
+		Phase:                       GuestBookPhase(in.Phase),
+		AvailableReplicas:           in.AvailableReplicas,
+		Replicas:                    in.Replicas,
+		Selector:                    in.Selector,
+		ReadyReplicas:               in.ReadyReplicas,
+		UpdatedReplicas:             in.UpdatedReplicas,
+		UnavailableReplicas:         in.UnavailableReplicas,
+		URL:                         in.URL,
+		ServiceURL:                  in.ServiceURL,
+		Image:                       in.Image,
+		Version:                     (*GuestBookVersionStatus)(in.Version),
+		LastPruneTime:               in.LastPruneTime,
+		PendingEntries:              in.PendingEntries,
+		EntryCount:                  in.EntryCount,
+		LastEntryTime:               in.LastEntryTime,
+		ConfigHash:                  in.ConfigHash,
+		LastReconcileTime:           in.LastReconcileTime,
+		LastSuccessfulReconcileTime: in.LastSuccessfulReconcileTime,
+		LastReconcileError:          in.LastReconcileError,
+		Conditions:                  in.Conditions,
+	}
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"testing"
+
+	fuzz "github.com/google/gofuzz"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/yourusername/guestbook-operator/api/v1alpha1"
+)
+
+const fuzzIterations = 200
+
+// newFuzzer fills GuestBooks with random values the API server would accept
+func newFuzzer(seed int64) *fuzz.Fuzzer {
+	return fuzz.NewWithSeed(seed).NilChance(0.3).NumElements(1, 3).Funcs(
+		// Quantities and times keep their value in unexported fields, which
+		// the fuzzer leaves alone
+		func(q *resource.Quantity, c fuzz.Continue) {
+			*q = *resource.NewQuantity(c.Int63n(1<<20), resource.BinarySI)
+		},
+		func(t *metav1.Time, c fuzz.Continue) {
+			*t = metav1.Unix(c.Int63n(1<<32), 0)
+		},
+		// The conversions leave apiVersion and kind to the caller
+		func(tm *metav1.TypeMeta, c fuzz.Continue) {
+			*tm = metav1.TypeMeta{}
+		},
+		// A set ingress.tls has a non-empty secretName (MinLength=1)
+		func(tls *GuestBookIngressTLSSpec, c fuzz.Continue) {
+			tls.SecretName = "tls-" + c.RandString()
+		},
+	)
+}
+
+func TestFuzzRoundTripFromV1(t *testing.T) {
+	f := newFuzzer(1)
+	for i := 0; i < fuzzIterations; i++ {
+		original := &GuestBook{}
+		f.Fuzz(original)
+
+		hub := &v1alpha1.GuestBook{}
+		if err := original.DeepCopy().ConvertTo(hub); err != nil {
+			t.Fatalf("ConvertTo() error = %v", err)
+		}
+		back := &GuestBook{}
+		if err := back.ConvertFrom(hub); err != nil {
+			t.Fatalf("ConvertFrom() error = %v", err)
+		}
+		if !equality.Semantic.DeepEqual(original, back) {
+			t.Fatalf("v1 -> v1alpha1 -> v1 is lossy:\nwant %+v\ngot  %+v", original, back)
+		}
+	}
+}
+
+func TestFuzzRoundTripFromHub(t *testing.T) {
+	f := newFuzzer(2)
+	for i := 0; i < fuzzIterations; i++ {
+		original := &v1alpha1.GuestBook{}
+		f.Fuzz(original)
+
+		spoke := &GuestBook{}
+		if err := spoke.ConvertFrom(original.DeepCopy()); err != nil {
+			t.Fatalf("ConvertFrom() error = %v", err)
+		}
+		back := &v1alpha1.GuestBook{}
+		if err := spoke.ConvertTo(back); err != nil {
+			t.Fatalf("ConvertTo() error = %v", err)
+		}
+		if !equality.Semantic.DeepEqual(original, back) {
+			t.Fatalf("v1alpha1 -> v1 -> v1alpha1 is lossy:\nwant %+v\ngot  %+v", original, back)
+		}
+	}
+}
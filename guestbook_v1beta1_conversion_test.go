@@ -0,0 +1,249 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/utils/ptr"
+
+	"github.com/yourusername/guestbook-operator/api/v1alpha1"
+)
+
+// populatedGuestBook returns a GuestBook with every field set, so that a
+// field the conversions drop fails the round trip
+func populatedGuestBook() *GuestBook {
+	now := metav1.NewTime(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	probe := func(n int32) *ProbeSettings {
+		return &ProbeSettings{InitialDelaySeconds: ptr.To(n), PeriodSeconds: ptr.To(n + 1), FailureThreshold: ptr.To(n + 2)}
+	}
+	return &GuestBook{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "guestbook",
+			Namespace:   "default",
+			Labels:      map[string]string{"team": "platform"},
+			Annotations: map[string]string{"note": "round trip"},
+			Generation:  7,
+		},
+		Spec: GuestBookSpec{
+			Replicas:        ptr.To[int32](3),
+			Autoscaling:     &AutoscalingSpec{MinReplicas: ptr.To[int32](2), MaxReplicas: 6, TargetCPUUtilization: ptr.To[int32](70)},
+			WelcomeMessage:  "Hello",
+			WelcomeMessages: map[string]string{"fr": "Bonjour"},
+			Image:           "example.com/guestbook:v2",
+			ImagePullPolicy: corev1.PullAlways,
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m")},
+				Limits:   corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("256Mi")},
+			},
+			Size:         SizeMedium,
+			NodeSelector: map[string]string{"disk": "ssd"},
+			Tolerations:  []corev1.Toleration{{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "guestbook", Effect: corev1.TaintEffectNoSchedule}},
+			Affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+					MatchExpressions: []corev1.NodeSelectorRequirement{{Key: "zone", Operator: corev1.NodeSelectorOpIn, Values: []string{"a"}}},
+				}}},
+			}},
+			ExtraEnv: []corev1.EnvVar{{Name: "DEBUG", Value: "1"}},
+			EnvFrom:  []corev1.EnvFromSource{{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "env"}}}},
+			Service: GuestBookServiceSpec{
+				Port:                     8080,
+				TargetPort:               3000,
+				AllowPrivilegedPorts:     true,
+				Type:                     corev1.ServiceTypeLoadBalancer,
+				LoadBalancerSourceRanges: []string{"10.0.0.0/8"},
+				Annotations:              map[string]string{"lb": "internal"},
+			},
+			Ingress: GuestBookIngressSpec{
+				Enabled:          true,
+				Host:             "guestbook.example.com",
+				IngressClassName: ptr.To("nginx"),
+				TLS:              &GuestBookIngressTLSSpec{SecretName: "guestbook-ingress-tls"},
+				Annotations:      map[string]string{"ingress": "yes"},
+			},
+			Theme:                GuestBookThemeSpec{ColorScheme: "blue", BannerImage: "banner.png", DarkMode: true},
+			ThemeRef:             &ThemeReference{Name: "corporate", Kind: "ClusterGuestBookTheme"},
+			TemplateRef:          &GuestBookTemplateReference{Name: "team", Parameters: map[string]string{"team": "platform"}},
+			TemplateConfigMapRef: &corev1.LocalObjectReference{Name: "templates"},
+			Retention:            GuestBookRetentionSpec{MaxEntries: ptr.To[int32](100), TTL: &metav1.Duration{Duration: time.Hour}, Schedule: "@daily"},
+			Moderation:           GuestBookModerationSpec{Enabled: true, PolicyRef: &corev1.LocalObjectReference{Name: "strict"}},
+			Auth:                 GuestBookAuthSpec{BasicAuthSecretRef: &corev1.LocalObjectReference{Name: "admin"}},
+			TLS: GuestBookTLSSpec{
+				SecretRef: &corev1.LocalObjectReference{Name: "guestbook-tls"},
+				IssuerRef: &IssuerReference{Name: "ca", Kind: "ClusterIssuer"},
+			},
+			Probes:                    GuestBookProbesSpec{Liveness: probe(1), Readiness: probe(10), Startup: probe(20)},
+			PodSecurityContext:        &corev1.PodSecurityContext{RunAsNonRoot: ptr.To(true)},
+			ContainerSecurityContext:  &corev1.SecurityContext{ReadOnlyRootFilesystem: ptr.To(true)},
+			ServiceAccountName:        "guestbook",
+			ImagePullSecrets:          []corev1.LocalObjectReference{{Name: "registry"}},
+			PriorityClassName:         "high",
+			TopologySpreadConstraints: []corev1.TopologySpreadConstraint{{MaxSkew: 1, TopologyKey: "zone", WhenUnsatisfiable: corev1.ScheduleAnyway}},
+			PodTemplateMetadata:       PodTemplateMetadata{Labels: map[string]string{"pod": "label"}, Annotations: map[string]string{"pod": "annotation"}},
+			Sidecars:                  []corev1.Container{{Name: "proxy", Image: "example.com/proxy"}},
+			InitContainers:            []corev1.Container{{Name: "migrate", Image: "example.com/migrate"}},
+			Suspend:                   true,
+			ScaleToZeroWhenSuspended:  true,
+			Backend: GuestBookBackendSpec{
+				Type: BackendExternal,
+				External: &ExternalBackendSpec{
+					Driver:              "mysql",
+					ConnectionSecretRef: corev1.LocalObjectReference{Name: "db"},
+					CleanupPolicy:       CleanupPolicyDrop,
+				},
+				Persistence: GuestBookPersistenceSpec{
+					Enabled:          true,
+					Size:             resource.MustParse("5Gi"),
+					StorageClassName: ptr.To("fast"),
+					AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+					ReclaimPolicy:    ReclaimPolicyRetain,
+					FinalBackup:      true,
+				},
+			},
+			MaintenanceWindow:   &MaintenanceWindow{Schedule: "0 2 * * *", Duration: metav1.Duration{Duration: 2 * time.Hour}},
+			UpdateStrategy:      appsv1.DeploymentStrategy{Type: appsv1.RecreateDeploymentStrategyType},
+			PodDisruptionBudget: &PodDisruptionBudgetSpec{MinAvailable: ptr.To(intstr.FromString("50%"))},
+			NetworkPolicy: GuestBookNetworkPolicySpec{
+				Enabled: true,
+				From:    []networkingv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "client"}}}},
+			},
+			Logging:    GuestBookLoggingSpec{Level: "debug", Format: "json"},
+			ReadOnly:   true,
+			RateLimit:  &RateLimitSpec{RequestsPerMinute: 60, Burst: 10},
+			CORS:       &CORSSpec{AllowedOrigins: []string{"https://example.com"}, AllowedMethods: []string{"GET"}},
+			DNS:        GuestBookDNSSpec{Hostname: "guestbook.example.com"},
+			Monitoring: GuestBookMonitoringSpec{Enabled: true, Port: 9090, Interval: "30s", Labels: map[string]string{"release": "prometheus"}},
+
+			BackupCleanupPolicy: CleanupPolicyDrop,
+		},
+		Status: GuestBookStatus{
+			ObservedGeneration:          7,
+			Phase:                       PhaseDegraded,
+			AvailableReplicas:           2,
+			Replicas:                    3,
+			Selector:                    "app=guestbook",
+			ReadyReplicas:               2,
+			UpdatedReplicas:             3,
+			UnavailableReplicas:         1,
+			URL:                         "https://guestbook.example.com",
+			ServiceURL:                  "https://guestbook.default.svc:8080",
+			Image:                       "example.com/guestbook:v2",
+			Version:                     &GuestBookVersionStatus{ImageDigest: "sha256:abc", AppVersion: "2.0.0"},
+			LastPruneTime:               &now,
+			PendingEntries:              4,
+			EntryCount:                  42,
+			LastEntryTime:               &now,
+			ConfigHash:                  "deadbeef",
+			LastReconcileTime:           &now,
+			LastSuccessfulReconcileTime: &now,
+			LastReconcileError:          "backend unavailable",
+			Conditions: []metav1.Condition{{
+				Type: "Ready", Status: metav1.ConditionFalse, Reason: "BackendUnavailable", Message: "backend unavailable",
+				ObservedGeneration: 7, LastTransitionTime: now,
+			}},
+		},
+	}
+}
+
+func TestConversionRoundTrip(t *testing.T) {
+	original := populatedGuestBook()
+
+	hub := &v1alpha1.GuestBook{}
+	if err := original.DeepCopy().ConvertTo(hub); err != nil {
+		t.Fatalf("ConvertTo() error = %v", err)
+	}
+	back := &GuestBook{}
+	if err := back.ConvertFrom(hub); err != nil {
+		t.Fatalf("ConvertFrom() error = %v", err)
+	}
+	if !equality.Semantic.DeepEqual(original, back) {
+		t.Errorf("v1beta1 -> v1alpha1 -> v1beta1 is lossy:\nwant %+v\ngot  %+v", original, back)
+	}
+
+	// The hub converted from a fully populated v1beta1 has every field set too
+	spoke := &GuestBook{}
+	if err := spoke.ConvertFrom(hub.DeepCopy()); err != nil {
+		t.Fatalf("ConvertFrom() error = %v", err)
+	}
+	hubBack := &v1alpha1.GuestBook{}
+	if err := spoke.ConvertTo(hubBack); err != nil {
+		t.Fatalf("ConvertTo() error = %v", err)
+	}
+	if !equality.Semantic.DeepEqual(hub, hubBack) {
+		t.Errorf("v1alpha1 -> v1beta1 -> v1alpha1 is lossy:\nwant %+v\ngot  %+v", hub, hubBack)
+	}
+}
+
+func TestConvertToMovesFields(t *testing.T) {
+	src := populatedGuestBook()
+	hub := &v1alpha1.GuestBook{}
+	if err := src.ConvertTo(hub); err != nil {
+		t.Fatalf("ConvertTo() error = %v", err)
+	}
+
+	if hub.Spec.Port != src.Spec.Service.Port || hub.Spec.TargetPort != src.Spec.Service.TargetPort ||
+		hub.Spec.AllowPrivilegedPorts != src.Spec.Service.AllowPrivilegedPorts {
+		t.Errorf("ports = %d/%d/%t, want service.port/targetPort/allowPrivilegedPorts %d/%d/%t",
+			hub.Spec.Port, hub.Spec.TargetPort, hub.Spec.AllowPrivilegedPorts,
+			src.Spec.Service.Port, src.Spec.Service.TargetPort, src.Spec.Service.AllowPrivilegedPorts)
+	}
+	if want := persistenceToHub(src.Spec.Backend.Persistence); !equality.Semantic.DeepEqual(hub.Spec.Persistence, want) {
+		t.Errorf("persistence = %+v, want backend.persistence %+v", hub.Spec.Persistence, want)
+	}
+	if hub.Spec.Ingress.TLSSecretName != src.Spec.Ingress.TLS.SecretName {
+		t.Errorf("ingress.tlsSecretName = %q, want ingress.tls.secretName %q", hub.Spec.Ingress.TLSSecretName, src.Spec.Ingress.TLS.SecretName)
+	}
+}
+
+func TestIngressTLSConversion(t *testing.T) {
+	tests := []struct {
+		name          string
+		tls           *GuestBookIngressTLSSpec
+		tlsSecretName string
+	}{
+		{name: "unset", tls: nil, tlsSecretName: ""},
+		{name: "set", tls: &GuestBookIngressTLSSpec{SecretName: "ingress-tls"}, tlsSecretName: "ingress-tls"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := &GuestBook{Spec: GuestBookSpec{Ingress: GuestBookIngressSpec{Enabled: true, TLS: tt.tls}}}
+			hub := &v1alpha1.GuestBook{}
+			if err := src.ConvertTo(hub); err != nil {
+				t.Fatalf("ConvertTo() error = %v", err)
+			}
+			if hub.Spec.Ingress.TLSSecretName != tt.tlsSecretName {
+				t.Errorf("tlsSecretName = %q, want %q", hub.Spec.Ingress.TLSSecretName, tt.tlsSecretName)
+			}
+
+			dst := &GuestBook{}
+			if err := dst.ConvertFrom(hub); err != nil {
+				t.Fatalf("ConvertFrom() error = %v", err)
+			}
+			if !equality.Semantic.DeepEqual(dst.Spec.Ingress.TLS, tt.tls) {
+				t.Errorf("tls = %+v, want %+v", dst.Spec.Ingress.TLS, tt.tls)
+			}
+		})
+	}
+}
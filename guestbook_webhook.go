@@ -0,0 +1,403 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// SetupWebhookWithManager registers the GuestBook webhooks with the manager
+func (r *GuestBook) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		WithDefaulter(&GuestBookCustomDefaulter{}).
+		WithValidator(&GuestBookCustomValidator{Client: mgr.GetClient()}).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/mutate-webapp-example-com-v1alpha1-guestbook,mutating=true,failurePolicy=fail,sideEffects=None,groups=webapp.example.com,resources=guestbooks,verbs=create;update,versions=v1alpha1,name=mguestbook.kb.io,admissionReviewVersions=v1
+
+// GuestBookCustomDefaulter fills in defaults derived from other fields, which
+// the CRD schema's static defaults can't express
+type GuestBookCustomDefaulter struct{}
+
+var _ webhook.CustomDefaulter = &GuestBookCustomDefaulter{}
+
+// sizeRequests are the resource requests behind each GuestBookSize
+var sizeRequests = map[GuestBookSize]corev1.ResourceList{
+	SizeSmall: {
+		corev1.ResourceCPU:    resource.MustParse("50m"),
+		corev1.ResourceMemory: resource.MustParse("64Mi"),
+	},
+	SizeMedium: {
+		corev1.ResourceCPU:    resource.MustParse("100m"),
+		corev1.ResourceMemory: resource.MustParse("128Mi"),
+	},
+	SizeLarge: {
+		corev1.ResourceCPU:    resource.MustParse("250m"),
+		corev1.ResourceMemory: resource.MustParse("256Mi"),
+	},
+}
+
+// appliedSizeAnnotation records the size whose requests the defaulter last
+// filled in, so they can be told apart from requests set by hand
+const appliedSizeAnnotation = "webapp.example.com/applied-size"
+
+// imagePorts are the ports well-known guestbook images listen on, keyed by
+// repository without registry or tag
+var imagePorts = map[string]int32{
+	"google-samples/gb-frontend":  80,
+	"nginxinc/nginx-unprivileged": 8080,
+	"bitnami/nginx":               8080,
+}
+
+// Default implements webhook.CustomDefaulter
+func (d *GuestBookCustomDefaulter) Default(ctx context.Context, obj runtime.Object) error {
+	gb, ok := obj.(*GuestBook)
+	if !ok {
+		return fmt.Errorf("expected a GuestBook but got %T", obj)
+	}
+
+	// Standard labels, so GuestBooks can be selected like other apps. The
+	// name is still empty here when generateName is used.
+	labels := gb.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	if _, ok := labels["app.kubernetes.io/name"]; !ok {
+		labels["app.kubernetes.io/name"] = "guestbook"
+	}
+	if _, ok := labels["app.kubernetes.io/instance"]; !ok && gb.Name != "" {
+		labels["app.kubernetes.io/instance"] = gb.Name
+	}
+	gb.SetLabels(labels)
+
+	// Only fill in a port the privileged port rule would accept
+	if gb.Spec.TargetPort == 0 {
+		if port, ok := imagePorts[imageRepository(gb.Spec.Image)]; ok && (port >= 1024 || gb.Spec.AllowPrivilegedPorts) {
+			gb.Spec.TargetPort = port
+		}
+	}
+
+	if requests, ok := sizeRequests[gb.Spec.Size]; ok && sizeDerived(gb) {
+		gb.Spec.Resources.Requests = requests.DeepCopy()
+		annotations := gb.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[appliedSizeAnnotation] = string(gb.Spec.Size)
+		gb.SetAnnotations(annotations)
+	}
+	return nil
+}
+
+// sizeDerived reports whether the requests may be replaced with the size's:
+// they are empty, or still hold the values of the size last applied. Without
+// the annotation, as on GuestBooks admitted before it was recorded, requests
+// matching any size are taken to come from it.
+func sizeDerived(gb *GuestBook) bool {
+	requests := gb.Spec.Resources.Requests
+	if len(requests) == 0 {
+		return true
+	}
+	if applied, ok := gb.GetAnnotations()[appliedSizeAnnotation]; ok {
+		return equality.Semantic.DeepEqual(requests, sizeRequests[GuestBookSize(applied)])
+	}
+	for _, preset := range sizeRequests {
+		if equality.Semantic.DeepEqual(requests, preset) {
+			return true
+		}
+	}
+	return false
+}
+
+// imageRepository strips the registry host, tag and digest from an image
+// reference, e.g. "gcr.io/google-samples/gb-frontend:v4" becomes
+// "google-samples/gb-frontend"
+func imageRepository(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	// The first component is a registry when it looks like a host
+	if first, rest, ok := strings.Cut(image, "/"); ok && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		image = rest
+	}
+	return image
+}
+
+// +kubebuilder:webhook:path=/validate-webapp-example-com-v1alpha1-guestbook,mutating=false,failurePolicy=fail,sideEffects=None,groups=webapp.example.com,resources=guestbooks,verbs=create;update,versions=v1alpha1,name=vguestbook.kb.io,admissionReviewVersions=v1
+
+// GuestBookCustomValidator validates GuestBooks beyond what the CRD schema can express
+type GuestBookCustomValidator struct {
+	// Client reads the Secrets a GuestBook references; they aren't checked
+	// when nil
+	Client client.Reader
+}
+
+var _ webhook.CustomValidator = &GuestBookCustomValidator{}
+
+// ValidateCreate implements webhook.CustomValidator
+func (v *GuestBookCustomValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	gb, ok := obj.(*GuestBook)
+	if !ok {
+		return nil, fmt.Errorf("expected a GuestBook but got %T", obj)
+	}
+	return warningsForGuestBook(ctx, gb), v.validate(ctx, gb)
+}
+
+// ValidateUpdate implements webhook.CustomValidator
+func (v *GuestBookCustomValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	gb, ok := newObj.(*GuestBook)
+	if !ok {
+		return nil, fmt.Errorf("expected a GuestBook but got %T", newObj)
+	}
+	old, ok := oldObj.(*GuestBook)
+	if !ok {
+		return nil, fmt.Errorf("expected a GuestBook but got %T", oldObj)
+	}
+
+	if old.Spec.Backend.Type != gb.Spec.Backend.Type {
+		allowed, err := v.backendChangeAllowed(ctx, gb)
+		if err != nil {
+			return nil, apierrors.NewInternalError(err)
+		}
+		if !allowed {
+			return warningsForGuestBook(ctx, gb), apierrors.NewInvalid(GroupVersion.WithKind("GuestBook").GroupKind(), gb.Name, field.ErrorList{
+				field.Forbidden(field.NewPath("spec", "backend", "type"),
+					"is immutable, since the new backend would start without the existing entries; create a GuestBookBackendMigration instead"),
+			})
+		}
+	}
+	return warningsForGuestBook(ctx, gb), v.validate(ctx, gb)
+}
+
+// backendChangeAllowed reports whether a GuestBookBackendMigration is
+// switching the GuestBook to its new backend type
+func (v *GuestBookCustomValidator) backendChangeAllowed(ctx context.Context, gb *GuestBook) (bool, error) {
+	name := gb.Annotations[BackendMigrationAnnotation]
+	if v.Client == nil || name == "" {
+		return false, nil
+	}
+
+	migration := &GuestBookBackendMigration{}
+	err := v.Client.Get(ctx, types.NamespacedName{Name: name, Namespace: gb.Namespace}, migration)
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return migration.Spec.GuestBookName == gb.Name &&
+		migration.Spec.Backend.Type == gb.Spec.Backend.Type &&
+		migration.Status.Phase == MigrationSwitching, nil
+}
+
+// ValidateDelete implements webhook.CustomValidator
+func (v *GuestBookCustomValidator) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+// legacyImage is the original default image. It is served from Container
+// Registry, which Google has shut down in favour of Artifact Registry.
+const legacyImage = "gcr.io/google-samples/gb-frontend:v4"
+
+// legacyIngressClassAnnotation selected the ingress controller before
+// IngressClassName existed
+const legacyIngressClassAnnotation = "kubernetes.io/ingress.class"
+
+// warningsForGuestBook returns migration guidance for fields that still work
+// but are on their way out. kubectl prints these at apply time.
+func warningsForGuestBook(ctx context.Context, gb *GuestBook) admission.Warnings {
+	var warnings admission.Warnings
+
+	// Requests for v1beta1 and v1 are converted before they reach the webhook, so
+	// only mention the v1alpha1 field layout to those who used it
+	if req, err := admission.RequestFromContext(ctx); err == nil && req.RequestKind != nil && req.RequestKind.Version == GroupVersion.Version {
+		if gb.Spec.Port != 0 || gb.Spec.TargetPort != 0 || gb.Spec.AllowPrivilegedPorts {
+			warnings = append(warnings, "spec.port, spec.targetPort and spec.allowPrivilegedPorts move to spec.service in webapp.example.com/v1")
+		}
+		if gb.Spec.Ingress.TLSSecretName != "" {
+			warnings = append(warnings, "spec.ingress.tlsSecretName becomes spec.ingress.tls.secretName in webapp.example.com/v1")
+		}
+		if gb.Spec.Persistence.Enabled {
+			warnings = append(warnings, "spec.persistence moves to spec.backend.persistence in webapp.example.com/v1")
+		}
+	}
+
+	if gb.Spec.Image == legacyImage {
+		warnings = append(warnings, fmt.Sprintf("spec.image %s is hosted on the retired Container Registry and may stop pulling; "+
+			"set spec.image to us-docker.pkg.dev/google-samples/containers/gke/gb-frontend:v5 instead", legacyImage))
+	}
+	if _, ok := gb.Spec.Ingress.Annotations[legacyIngressClassAnnotation]; ok {
+		warnings = append(warnings, fmt.Sprintf("spec.ingress.annotations[%s] is deprecated; set spec.ingress.ingressClassName instead",
+			legacyIngressClassAnnotation))
+	}
+	return warnings
+}
+
+// validate returns an Invalid error listing every problem with the spec and
+// the objects it references
+func (v *GuestBookCustomValidator) validate(ctx context.Context, gb *GuestBook) error {
+	allErrs := validateGuestBookSpec(gb)
+
+	refErrs, err := v.validateReferences(ctx, gb)
+	if err != nil {
+		return apierrors.NewInternalError(err)
+	}
+	allErrs = append(allErrs, refErrs...)
+
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("GuestBook").GroupKind(), gb.Name, allErrs)
+}
+
+// validateGuestBookSpec checks combinations of spec fields. Most of these are
+// also CEL rules on the CRD, which hold when the webhook isn't running; the
+// disruption budget's comparison with the replica count is only checked here.
+// Changes belong in the controller's admission policy too, which carries
+// these checks to clusters where webhooks can't run.
+func validateGuestBookSpec(gb *GuestBook) field.ErrorList {
+	var allErrs field.ErrorList
+	specPath := field.NewPath("spec")
+
+	if a := gb.Spec.Autoscaling; a != nil {
+		if gb.Spec.Replicas != nil {
+			allErrs = append(allErrs, field.Forbidden(specPath.Child("replicas"),
+				"must not be set together with spec.autoscaling; the HorizontalPodAutoscaler manages the replica count. "+
+					"Remove spec.replicas, or remove spec.autoscaling to run a fixed number of replicas"))
+		}
+		if a.MinReplicas != nil && *a.MinReplicas > a.MaxReplicas {
+			allErrs = append(allErrs, field.Invalid(specPath.Child("autoscaling", "minReplicas"), *a.MinReplicas,
+				fmt.Sprintf("must not be greater than spec.autoscaling.maxReplicas (%d)", a.MaxReplicas)))
+		}
+	}
+
+	allErrs = append(allErrs, validatePodDisruptionBudget(gb, specPath.Child("podDisruptionBudget"))...)
+
+	ingressPath := specPath.Child("ingress")
+	if !gb.Spec.Ingress.Enabled {
+		if gb.Spec.Ingress.Host != "" {
+			allErrs = append(allErrs, field.Forbidden(ingressPath.Child("host"), "requires spec.ingress.enabled"))
+		}
+		if gb.Spec.Ingress.TLSSecretName != "" {
+			allErrs = append(allErrs, field.Forbidden(ingressPath.Child("tlsSecretName"), "requires spec.ingress.enabled"))
+		}
+	}
+	if gb.Spec.Ingress.TLSSecretName != "" && gb.Spec.Ingress.Host == "" {
+		allErrs = append(allErrs, field.Required(ingressPath.Child("host"), "required when spec.ingress.tlsSecretName is set"))
+	}
+
+	if gb.Spec.Service.Type != corev1.ServiceTypeLoadBalancer && len(gb.Spec.Service.LoadBalancerSourceRanges) > 0 {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("service", "loadBalancerSourceRanges"),
+			"only applies when spec.service.type is LoadBalancer"))
+	}
+
+	if gb.Spec.Persistence.FinalBackup && !gb.Spec.Persistence.Enabled {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("persistence", "finalBackup"),
+			"requires spec.persistence.enabled"))
+	}
+
+	return allErrs
+}
+
+// validatePodDisruptionBudget rejects budgets that would never let a pod be
+// evicted, which blocks node drains
+func validatePodDisruptionBudget(gb *GuestBook, path *field.Path) field.ErrorList {
+	pdb := gb.Spec.PodDisruptionBudget
+	if pdb == nil {
+		return nil
+	}
+
+	// The fewest replicas the GuestBook may run
+	replicas, source := int32(1), "spec.replicas"
+	if gb.Spec.Replicas != nil {
+		replicas, source = *gb.Spec.Replicas, "spec.replicas"
+	}
+	if a := gb.Spec.Autoscaling; a != nil {
+		replicas, source = 1, "spec.autoscaling.minReplicas"
+		if a.MinReplicas != nil {
+			replicas, source = *a.MinReplicas, "spec.autoscaling.minReplicas"
+		}
+	}
+
+	var allErrs field.ErrorList
+	if minAvailable := pdb.MinAvailable; minAvailable != nil {
+		// The disruption controller rounds percentages up
+		required, err := intstr.GetScaledValueFromIntOrPercent(minAvailable, int(replicas), true)
+		if err == nil && required >= int(replicas) {
+			allErrs = append(allErrs, field.Invalid(path.Child("minAvailable"), minAvailable.String(),
+				fmt.Sprintf("requires %d of %d replicas (%s) to stay available, so no pod could ever be evicted and node drains would hang. "+
+					"Lower minAvailable, raise %s, or use maxUnavailable instead", required, replicas, source, source)))
+		}
+	}
+	if maxUnavailable := pdb.MaxUnavailable; maxUnavailable != nil {
+		if maxUnavailable.String() == "0" || maxUnavailable.String() == "0%" {
+			allErrs = append(allErrs, field.Invalid(path.Child("maxUnavailable"), maxUnavailable.String(),
+				"must be greater than zero, otherwise no pod can be evicted and node drains would hang"))
+		}
+	}
+	return allErrs
+}
+
+// validateReferences checks the Secrets the spec names. A Secret that doesn't
+// exist yet is accepted, since it is often created after the GuestBook, but
+// one that exists must hold the keys the guestbook needs.
+func (v *GuestBookCustomValidator) validateReferences(ctx context.Context, gb *GuestBook) (field.ErrorList, error) {
+	ext := gb.Spec.Backend.External
+	if v.Client == nil || gb.Spec.Backend.Type != BackendExternal || ext == nil {
+		return nil, nil
+	}
+
+	secret := &corev1.Secret{}
+	err := v.Client.Get(ctx, types.NamespacedName{Name: ext.ConnectionSecretRef.Name, Namespace: gb.Namespace}, secret)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for _, key := range ExternalConnectionSecretKeys {
+		if len(secret.Data[key]) == 0 {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) == 0 {
+		return nil, nil
+	}
+	path := field.NewPath("spec", "backend", "external", "connectionSecretRef", "name")
+	return field.ErrorList{field.Invalid(path, secret.Name,
+		fmt.Sprintf("Secret is missing keys: %s", strings.Join(missing, ", ")))}, nil
+}
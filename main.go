@@ -0,0 +1,850 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"golang.org/x/time/rate"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	batchv1 "k8s.io/api/batch/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/certwatcher"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/metrics/filters"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/yaml"
+
+	webappv1 "github.com/yourusername/guestbook-operator/api/v1"
+	webappv1alpha1 "github.com/yourusername/guestbook-operator/api/v1alpha1"
+	webappv1beta1 "github.com/yourusername/guestbook-operator/api/v1beta1"
+	"github.com/yourusername/guestbook-operator/internal/controller"
+)
+
+var (
+	scheme   = runtime.NewScheme()
+	setupLog = ctrl.Log.WithName("setup")
+)
+
+func init() {
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(webappv1alpha1.AddToScheme(scheme))
+	utilruntime.Must(webappv1beta1.AddToScheme(scheme))
+	utilruntime.Must(webappv1.AddToScheme(scheme))
+}
+
+// operatorConfig is the optional configuration file passed with --config.
+// Flags given on the command line take precedence over it.
+type operatorConfig struct {
+	GuestBook guestBookControllerConfig `json:"guestbook"`
+}
+
+// guestBookControllerConfig tunes the GuestBook controller
+type guestBookControllerConfig struct {
+	// MaxConcurrentReconciles is how many GuestBooks are reconciled in parallel
+	MaxConcurrentReconciles int `json:"maxConcurrentReconciles,omitempty"`
+}
+
+// loadOperatorConfig reads the configuration file at path
+func loadOperatorConfig(path string) (*operatorConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &operatorConfig{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// cacheNamespaces turns the --watch-namespaces value into the cache's
+// namespace set; nil, meaning all namespaces, when the list is empty
+func cacheNamespaces(list string) map[string]cache.Config {
+	namespaces := map[string]cache.Config{}
+	for _, ns := range strings.Split(list, ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			namespaces[ns] = cache.Config{}
+		}
+	}
+	if len(namespaces) == 0 {
+		return nil
+	}
+	return namespaces
+}
+
+// guestBookCRDName is the CRD whose conversion webhook needs a CA bundle
+const guestBookCRDName = "guestbooks.webapp.example.com"
+
+// leaderElectionID names the leader election lease
+const leaderElectionID = "guestbook-operator.webapp.example.com"
+
+// crdGVK identifies CustomResourceDefinitions, read as unstructured objects
+// so the operator doesn't need the apiextensions types in its scheme
+var crdGVK = schema.GroupVersionKind{Group: "apiextensions.k8s.io", Version: "v1", Kind: "CustomResourceDefinition"}
+
+// newCertWatcher watches the tls.crt and tls.key that cert-manager writes
+// into a mounted Secret, so renewed certificates are served without a
+// restart. It returns nothing when dir is empty.
+func newCertWatcher(dir string) (*certwatcher.CertWatcher, []func(*tls.Config), error) {
+	if dir == "" {
+		return nil, nil, nil
+	}
+	watcher, err := certwatcher.New(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return watcher, []func(*tls.Config){func(c *tls.Config) { c.GetCertificate = watcher.GetCertificate }}, nil
+}
+
+// setupTracing exports spans over OTLP/gRPC to endpoint and returns a
+// function that flushes them on exit. Tracing stays off, with the global
+// no-op provider, when endpoint is empty. OTEL_SERVICE_NAME and
+// OTEL_RESOURCE_ATTRIBUTES override the resource attributes set here.
+func setupTracing(ctx context.Context, endpoint string, insecure bool, sampleRatio float64) (func(context.Context) error, error) {
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+	if insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "guestbook-operator")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Follow the caller's sampling decision when there is one, e.g. for
+	// spans started inside a sampled webhook request
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// +kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=validatingwebhookconfigurations;mutatingwebhookconfigurations,verbs=get
+// +kubebuilder:rbac:groups=apiextensions.k8s.io,resources=customresourcedefinitions,verbs=get
+
+// caInjectedCheck reports ready once cert-manager's CA injector has filled in
+// the CA bundle of every webhook, so the API server can trust the serving
+// certificate. Until then admission and conversion calls would fail with TLS
+// errors, so the pod is kept out of the Service.
+func caInjectedCheck(reader client.Reader, configPrefix string) healthz.Checker {
+	var injected atomic.Bool
+	return func(req *http.Request) error {
+		// Once injected the bundle is only ever replaced, never removed
+		if injected.Load() {
+			return nil
+		}
+		ctx := req.Context()
+
+		validating := &admissionregistrationv1.ValidatingWebhookConfiguration{}
+		if err := reader.Get(ctx, types.NamespacedName{Name: configPrefix + "validating-webhook-configuration"}, validating); err != nil {
+			return err
+		}
+		for _, w := range validating.Webhooks {
+			if len(w.ClientConfig.CABundle) == 0 {
+				return fmt.Errorf("validating webhook %s has no CA bundle yet", w.Name)
+			}
+		}
+
+		mutating := &admissionregistrationv1.MutatingWebhookConfiguration{}
+		if err := reader.Get(ctx, types.NamespacedName{Name: configPrefix + "mutating-webhook-configuration"}, mutating); err != nil {
+			return err
+		}
+		for _, w := range mutating.Webhooks {
+			if len(w.ClientConfig.CABundle) == 0 {
+				return fmt.Errorf("mutating webhook %s has no CA bundle yet", w.Name)
+			}
+		}
+
+		crd := &unstructured.Unstructured{}
+		crd.SetGroupVersionKind(crdGVK)
+		if err := reader.Get(ctx, types.NamespacedName{Name: guestBookCRDName}, crd); err != nil {
+			return err
+		}
+		if bundle, _, _ := unstructured.NestedString(crd.Object, "spec", "conversion", "webhook", "clientConfig", "caBundle"); bundle == "" {
+			return fmt.Errorf("conversion webhook of %s has no CA bundle yet", guestBookCRDName)
+		}
+
+		injected.Store(true)
+		return nil
+	}
+}
+
+// cacheSyncCheckTimeout bounds how long a probe waits on the informer caches
+const cacheSyncCheckTimeout = time.Second
+
+// cacheSyncedCheck reports ready once every informer the controllers started
+// has synced, so the pod doesn't take webhook traffic or report progress
+// while it still acts on a partial view of the cluster
+func cacheSyncedCheck(c cache.Cache) healthz.Checker {
+	return func(req *http.Request) error {
+		ctx, cancel := context.WithTimeout(req.Context(), cacheSyncCheckTimeout)
+		defer cancel()
+		if !c.WaitForCacheSync(ctx) {
+			return errors.New("informer caches have not synced")
+		}
+		return nil
+	}
+}
+
+// servedCertificate returns the leaf certificate watcher currently serves
+func servedCertificate(watcher *certwatcher.CertWatcher) (*x509.Certificate, error) {
+	cert, err := watcher.GetCertificate(nil)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf != nil {
+		return cert.Leaf, nil
+	}
+	return x509.ParseCertificate(cert.Certificate[0])
+}
+
+// certificateValid returns an error unless cert is valid now
+func certificateValid(cert *x509.Certificate, now time.Time) error {
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("certificate is not valid until %s", cert.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("certificate expired at %s", cert.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// certificateReadyCheck keeps the pod out of the webhook Service while the
+// serving certificate is expired or not yet valid, since the API server
+// would reject every TLS handshake
+func certificateReadyCheck(watcher *certwatcher.CertWatcher) healthz.Checker {
+	return func(_ *http.Request) error {
+		cert, err := servedCertificate(watcher)
+		if err != nil {
+			return err
+		}
+		return certificateValid(cert, time.Now())
+	}
+}
+
+// certificateLiveCheck fails when the served certificate is no longer valid
+// but a valid one has been written to certFile, meaning the watcher missed
+// the renewal and a restart would pick it up. An expired certificate on disk
+// too is left to the ready check, as restarting can't fix it.
+func certificateLiveCheck(watcher *certwatcher.CertWatcher, certFile string) healthz.Checker {
+	return func(_ *http.Request) error {
+		now := time.Now()
+		served, err := servedCertificate(watcher)
+		if err != nil || certificateValid(served, now) == nil {
+			return nil
+		}
+		data, err := os.ReadFile(certFile)
+		if err != nil {
+			return nil
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil
+		}
+		onDisk, err := x509.ParseCertificate(block.Bytes)
+		if err != nil || certificateValid(onDisk, now) != nil {
+			return nil
+		}
+		return fmt.Errorf("serving a certificate that expired at %s although %s holds a renewed one",
+			served.NotAfter.Format(time.RFC3339), certFile)
+	}
+}
+
+// +kubebuilder:rbac:groups=coordination.k8s.io,resources=leases,verbs=get
+
+// leaderLeaseCheck fails when this manager acts as leader but the lease
+// shows it no longer is, either held by another pod or not renewed for
+// twice its duration. The leader election loop should have stopped the
+// manager by then, so it is wedged. API errors pass, so an API server
+// outage doesn't restart every replica.
+func leaderLeaseCheck(reader client.Reader, elected <-chan struct{}, lease types.NamespacedName, leaseDuration time.Duration) healthz.Checker {
+	// controller-runtime identifies the holder as <hostname>_<uuid>
+	hostname, _ := os.Hostname()
+	return func(req *http.Request) error {
+		select {
+		case <-elected:
+		default:
+			return nil
+		}
+		current := &coordinationv1.Lease{}
+		if err := reader.Get(req.Context(), lease, current); err != nil {
+			return nil
+		}
+		if holder := ptr.Deref(current.Spec.HolderIdentity, ""); !strings.HasPrefix(holder, hostname+"_") {
+			return fmt.Errorf("acting as leader, but lease %s is held by %q", lease, holder)
+		}
+		if renewed := current.Spec.RenewTime; renewed != nil && time.Since(renewed.Time) > 2*leaseDuration {
+			return fmt.Errorf("acting as leader, but lease %s was last renewed at %s", lease, renewed.Format(time.RFC3339))
+		}
+		return nil
+	}
+}
+
+// inClusterNamespace returns the namespace of the pod's ServiceAccount,
+// which controller-runtime also defaults the leader election namespace to
+func inClusterNamespace() (string, error) {
+	data, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// backlogCheck fails when a controller's work queue holds more than
+// maxDepth items and the controller hasn't finished a reconcile for
+// stallTimeout. A deep queue that drains is only busy; one that doesn't
+// move means the workers are stuck.
+func backlogCheck(gatherer prometheus.Gatherer, maxDepth int, stallTimeout time.Duration) healthz.Checker {
+	var mu sync.Mutex
+	completed := map[string]float64{}
+	progressed := map[string]time.Time{}
+	return func(_ *http.Request) error {
+		families, err := gatherer.Gather()
+		if err != nil {
+			return nil
+		}
+		depths := map[string]float64{}
+		totals := map[string]float64{}
+		for _, family := range families {
+			switch family.GetName() {
+			case "workqueue_depth":
+				for _, m := range family.GetMetric() {
+					depths[metricLabel(m, "name")] += m.GetGauge().GetValue()
+				}
+			case "controller_runtime_reconcile_total":
+				for _, m := range family.GetMetric() {
+					totals[metricLabel(m, "controller")] += m.GetCounter().GetValue()
+				}
+			}
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		now := time.Now()
+		var stalled []string
+		for name, depth := range depths {
+			if total, seen := completed[name]; !seen || totals[name] != total {
+				completed[name] = totals[name]
+				progressed[name] = now
+			}
+			if depth > float64(maxDepth) && now.Sub(progressed[name]) > stallTimeout {
+				stalled = append(stalled, fmt.Sprintf("%s (%d queued)", name, int(depth)))
+			}
+		}
+		if len(stalled) > 0 {
+			sort.Strings(stalled)
+			return fmt.Errorf("no reconciles finished in %s despite a backlog: %s", stallTimeout, strings.Join(stalled, ", "))
+		}
+		return nil
+	}
+}
+
+// metricLabel returns the value of the named label of m
+func metricLabel(m *dto.Metric, name string) string {
+	for _, label := range m.GetLabel() {
+		if label.GetName() == name {
+			return label.GetValue()
+		}
+	}
+	return ""
+}
+
+func main() {
+	var configFile string
+	var metricsAddr string
+	var probeAddr string
+	var enableLeaderElection bool
+	var leaseDuration time.Duration
+	var renewDeadline time.Duration
+	var retryPeriod time.Duration
+	var leaderElectionNamespace string
+	var requeueBaseDelay time.Duration
+	var requeueMaxDelay time.Duration
+	var rateLimitQPS float64
+	var rateLimitBurst int
+	var maxConcurrentReconciles int
+	var reconcileTimeout time.Duration
+	var watchNamespaces string
+	var usePriorityQueue bool
+	var webhookCertPath string
+	var metricsCertPath string
+	var secureMetrics bool
+	var waitForCAInjection bool
+	var webhookConfigPrefix string
+	var installAdmissionPolicy bool
+	var migrateStorageVersion bool
+	var otlpEndpoint string
+	var otlpInsecure bool
+	var traceSampleRatio float64
+	var logFormat string
+	var grafanaDashboardNamespace string
+	var kubeStateMetricsNamespace string
+	var maxQueueDepth int
+	var cacheManagedOnly bool
+	var queueStallTimeout time.Duration
+	var printKubeStateMetricsConfig bool
+
+	// Parse command-line flags
+	flag.StringVar(&configFile, "config", "",
+		"Path to an optional configuration file; command-line flags override it.")
+	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080",
+		"The address the metric endpoint binds to.")
+	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081",
+		"The address the probe endpoint binds to.")
+	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
+		"Enable leader election for controller manager. Leave it off for a single replica during development.")
+	flag.DurationVar(&leaseDuration, "leader-elect-lease-duration", 15*time.Second,
+		"How long a standby replica waits before taking over an unrenewed lease.")
+	flag.DurationVar(&renewDeadline, "leader-elect-renew-deadline", 10*time.Second,
+		"How long the leader keeps retrying to renew its lease before giving it up.")
+	flag.DurationVar(&retryPeriod, "leader-elect-retry-period", 2*time.Second,
+		"How often leader election clients retry acquiring or renewing the lease.")
+	flag.StringVar(&leaderElectionNamespace, "leader-elect-namespace", "",
+		"Namespace of the leader election lease; defaults to the namespace the operator runs in.")
+	flag.DurationVar(&requeueBaseDelay, "requeue-base-delay", 5*time.Millisecond,
+		"Delay before the first retry of a failed reconcile; it doubles with every further failure.")
+	flag.DurationVar(&requeueMaxDelay, "requeue-max-delay", 1000*time.Second,
+		"Upper bound on the per-GuestBook retry delay.")
+	flag.Float64Var(&rateLimitQPS, "rate-limit-qps", 10,
+		"Overall rate at which GuestBooks are requeued, across all of them.")
+	flag.IntVar(&rateLimitBurst, "rate-limit-burst", 100,
+		"Burst allowed above rate-limit-qps.")
+	flag.IntVar(&maxConcurrentReconciles, "max-concurrent-reconciles", 1,
+		"How many GuestBooks are reconciled in parallel.")
+	flag.DurationVar(&reconcileTimeout, "reconcile-timeout", 2*time.Minute,
+		"Deadline for a single GuestBook reconcile; one that runs over is requeued.")
+	flag.StringVar(&watchNamespaces, "watch-namespaces", "",
+		"Comma-separated namespaces to watch; all namespaces when empty. "+
+			"Restricting them lets the operator run with namespaced Roles instead of a ClusterRole; "+
+			"ClusterGuestBooks then skip the namespaces not listed.")
+	flag.BoolVar(&usePriorityQueue, "priority-queue", true,
+		"Reconcile newly created and changed GuestBooks ahead of the startup backlog and routine resyncs.")
+	flag.StringVar(&webhookCertPath, "webhook-cert-path", "",
+		"Directory holding the webhook server's tls.crt and tls.key, e.g. a mounted cert-manager Secret. "+
+			"Renewed certificates are picked up without a restart.")
+	flag.StringVar(&metricsCertPath, "metrics-cert-path", "",
+		"Directory holding the metrics server's tls.crt and tls.key; a self-signed certificate is used when empty.")
+	flag.BoolVar(&secureMetrics, "metrics-secure", false,
+		"Serve metrics over HTTPS and require an authenticated, authorized client.")
+	flag.BoolVar(&waitForCAInjection, "wait-for-ca-injection", false,
+		"Report not ready until cert-manager has injected the CA bundle into the webhook configurations and the GuestBook CRD.")
+	flag.StringVar(&webhookConfigPrefix, "webhook-configuration-prefix", "guestbook-operator-",
+		"Name prefix of the validating and mutating webhook configurations checked by --wait-for-ca-injection.")
+	flag.BoolVar(&installAdmissionPolicy, "install-admission-policy", false,
+		"Install a ValidatingAdmissionPolicy enforcing the validating webhook's spec checks in the API server. "+
+			"Together with ENABLE_WEBHOOKS=false it replaces the admission webhooks, "+
+			"without checking connection Secrets and trusting the backend migration annotation alone. "+
+			"The conversion webhook is still served and must be reachable from the API server.")
+	flag.BoolVar(&migrateStorageVersion, "migrate-storage-version", true,
+		"Rewrite GuestBooks stored at an older API version and record the migration in the CRD's status.storedVersions. "+
+			"Needs every namespace in view, so it is skipped with --watch-namespaces.")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "",
+		"host:port of an OTLP/gRPC collector to send reconcile traces to; tracing is off when empty.")
+	flag.BoolVar(&otlpInsecure, "otlp-insecure", false,
+		"Send traces to the collector without TLS, e.g. to a sidecar or node-local agent.")
+	flag.Float64Var(&traceSampleRatio, "trace-sample-ratio", 1,
+		"Fraction of reconciles traced, between 0 and 1.")
+	flag.StringVar(&grafanaDashboardNamespace, "grafana-dashboard-namespace", "",
+		"Publish a Grafana dashboard of the GuestBook metrics as a ConfigMap labeled grafana_dashboard=1 in this namespace, "+
+			"for the Grafana sidecar to load; no dashboard is published when empty.")
+	flag.StringVar(&kubeStateMetricsNamespace, "kube-state-metrics-namespace", "",
+		"Write a kube-state-metrics CustomResourceStateMetrics configuration exporting GuestBook fields "+
+			"to a ConfigMap in this namespace; none is written when empty.")
+	flag.BoolVar(&printKubeStateMetricsConfig, "print-kube-state-metrics-config", false,
+		"Print the kube-state-metrics configuration for GuestBooks and exit.")
+	flag.BoolVar(&cacheManagedOnly, "cache-managed-only", true,
+		"Cache only the Deployments, Services and Pods labeled managed-by=guestbook-operator, "+
+			"instead of every one in the watched namespaces.")
+	flag.IntVar(&maxQueueDepth, "healthz-max-queue-depth", 500,
+		"Fail the liveness probe when a controller's work queue holds more items than this "+
+			"and no reconcile has finished for --healthz-queue-stall-timeout; 0 disables the check.")
+	flag.DurationVar(&queueStallTimeout, "healthz-queue-stall-timeout", 5*time.Minute,
+		"How long a backlogged work queue may go without a finished reconcile before the manager counts as stuck.")
+	flag.StringVar(&logFormat, "log-format", "json",
+		"Log encoding, json or text. Overrides --zap-encoder.")
+	opts := zap.Options{}
+	opts.BindFlags(flag.CommandLine)
+	flag.Parse()
+
+	if printKubeStateMetricsConfig {
+		config, err := controller.KubeStateMetricsConfig()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Stdout.Write(config)
+		return
+	}
+
+	switch logFormat {
+	case "json":
+		zap.JSONEncoder()(&opts)
+	case "text":
+		zap.ConsoleEncoder()(&opts)
+	default:
+		fmt.Fprintf(os.Stderr, "invalid --log-format %q: must be json or text\n", logFormat)
+		os.Exit(1)
+	}
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+
+	if configFile != "" {
+		config, err := loadOperatorConfig(configFile)
+		if err != nil {
+			setupLog.Error(err, "unable to load config file")
+			os.Exit(1)
+		}
+		set := map[string]bool{}
+		flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		if n := config.GuestBook.MaxConcurrentReconciles; n > 0 && !set["max-concurrent-reconciles"] {
+			maxConcurrentReconciles = n
+		}
+	}
+
+	ctx := ctrl.SetupSignalHandler()
+	shutdownTracing, err := setupTracing(ctx, otlpEndpoint, otlpInsecure, traceSampleRatio)
+	if err != nil {
+		setupLog.Error(err, "unable to set up tracing")
+		os.Exit(1)
+	}
+
+	// Trace the API requests of each reconcile as child spans. They carry
+	// the trace context, so an API server with tracing enabled adds its own
+	// spans to the same trace.
+	restConfig := ctrl.GetConfigOrDie()
+	if otlpEndpoint != "" {
+		restConfig.Wrap(func(rt http.RoundTripper) http.RoundTripper { return otelhttp.NewTransport(rt) })
+	}
+
+	// Create the controller manager
+	namespaces := cacheNamespaces(watchNamespaces)
+	if namespaces != nil {
+		setupLog.Info("watching selected namespaces", "namespaces", watchNamespaces)
+	}
+	webhookCertWatcher, webhookTLSOpts, err := newCertWatcher(webhookCertPath)
+	if err != nil {
+		setupLog.Error(err, "unable to load webhook certificate")
+		os.Exit(1)
+	}
+	metricsCertWatcher, metricsTLSOpts, err := newCertWatcher(metricsCertPath)
+	if err != nil {
+		setupLog.Error(err, "unable to load metrics certificate")
+		os.Exit(1)
+	}
+	metricsOptions := metricsserver.Options{
+		BindAddress:   metricsAddr,
+		SecureServing: secureMetrics,
+		TLSOpts:       metricsTLSOpts,
+	}
+	if secureMetrics {
+		metricsOptions.FilterProvider = filters.WithAuthenticationAndAuthorization
+	}
+
+	// Deployments, Services and Pods abound in big clusters; caching only the
+	// operator's own keeps memory proportional to the GuestBooks. ConfigMaps
+	// stay unfiltered, since the template ConfigMaps users reference are
+	// watched too and carry no operator label.
+	var managed labels.Selector
+	if cacheManagedOnly {
+		managed = controller.ManagedObjectsSelector()
+	}
+	// Children written only with server-side apply, and Secrets, which are
+	// only read, can also lose kubectl's last-applied copy in the cache.
+	// GuestBooks and the other objects the controllers update keep it.
+	trim := controller.StripManagedFieldsAndLastApplied
+	cacheOptions := cache.Options{
+		DefaultNamespaces: namespaces,
+		DefaultTransform:  controller.StripManagedFields,
+		ByObject: map[client.Object]cache.ByObject{
+			&appsv1.Deployment{}:                     {Label: managed, Transform: trim},
+			&corev1.Service{}:                        {Label: managed, Transform: trim},
+			&corev1.Pod{}:                            {Label: managed},
+			&corev1.ConfigMap{}:                      {Transform: trim},
+			&appsv1.StatefulSet{}:                    {Transform: trim},
+			&corev1.Secret{}:                         {Transform: trim},
+			&corev1.ServiceAccount{}:                 {Transform: trim},
+			&networkingv1.Ingress{}:                  {Transform: trim},
+			&networkingv1.NetworkPolicy{}:            {Transform: trim},
+			&autoscalingv2.HorizontalPodAutoscaler{}: {Transform: trim},
+			&policyv1.PodDisruptionBudget{}:          {Transform: trim},
+			&batchv1.CronJob{}:                       {Transform: trim},
+			&batchv1.Job{}:                           {Transform: trim},
+		},
+	}
+
+	mgr, err := ctrl.NewManager(restConfig, ctrl.Options{
+		Scheme:                  scheme,
+		Cache:                   cacheOptions,
+		Metrics:                 metricsOptions,
+		WebhookServer:           webhook.NewServer(webhook.Options{TLSOpts: webhookTLSOpts}),
+		HealthProbeBindAddress:  probeAddr,
+		LeaderElection:          enableLeaderElection,
+		LeaderElectionID:        leaderElectionID,
+		LeaderElectionNamespace: leaderElectionNamespace,
+		LeaseDuration:           &leaseDuration,
+		RenewDeadline:           &renewDeadline,
+		RetryPeriod:             &retryPeriod,
+	})
+	if err != nil {
+		setupLog.Error(err, "unable to create manager")
+		os.Exit(1)
+	}
+	for _, watcher := range []*certwatcher.CertWatcher{webhookCertWatcher, metricsCertWatcher} {
+		if watcher == nil {
+			continue
+		}
+		if err := mgr.Add(watcher); err != nil {
+			setupLog.Error(err, "unable to add certificate watcher")
+			os.Exit(1)
+		}
+	}
+
+	// Failed GuestBooks back off individually, and the bucket caps how fast
+	// the queue as a whole hands out retries
+	rateLimiter := workqueue.NewTypedMaxOfRateLimiter(
+		workqueue.NewTypedItemExponentialFailureRateLimiter[reconcile.Request](requeueBaseDelay, requeueMaxDelay),
+		&workqueue.TypedBucketRateLimiter[reconcile.Request]{Limiter: rate.NewLimiter(rate.Limit(rateLimitQPS), rateLimitBurst)},
+	)
+
+	if err := (&controller.GuestBookReconciler{
+		Client:                  mgr.GetClient(),
+		Scheme:                  mgr.GetScheme(),
+		RateLimiter:             rateLimiter,
+		MaxConcurrentReconciles: maxConcurrentReconciles,
+		ReconcileTimeout:        reconcileTimeout,
+		UsePriorityQueue:        usePriorityQueue,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "GuestBook")
+		os.Exit(1)
+	}
+	if err := (&controller.BackendMigrationReconciler{
+		Client: mgr.GetClient(),
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "GuestBookBackendMigration")
+		os.Exit(1)
+	}
+	if err := (&controller.EntryReconciler{
+		Client: mgr.GetClient(),
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "GuestBookEntry")
+		os.Exit(1)
+	}
+	if err := (&controller.BackupReconciler{
+		Client: mgr.GetClient(),
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "GuestBookBackup")
+		os.Exit(1)
+	}
+	if err := (&controller.RestoreReconciler{
+		Client: mgr.GetClient(),
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "GuestBookRestore")
+		os.Exit(1)
+	}
+	var watched map[string]bool
+	if namespaces != nil {
+		watched = map[string]bool{}
+		for ns := range namespaces {
+			watched[ns] = true
+		}
+	}
+	if err := (&controller.ClusterGuestBookReconciler{
+		Client:          mgr.GetClient(),
+		Scheme:          mgr.GetScheme(),
+		WatchNamespaces: watched,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "ClusterGuestBook")
+		os.Exit(1)
+	}
+	if err := (&controller.UserReconciler{
+		Client: mgr.GetClient(),
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "GuestBookUser")
+		os.Exit(1)
+	}
+
+	if installAdmissionPolicy {
+		if err := mgr.Add(&controller.AdmissionPolicyInstaller{Client: mgr.GetClient()}); err != nil {
+			setupLog.Error(err, "unable to set up admission policy installer")
+			os.Exit(1)
+		}
+	}
+
+	if grafanaDashboardNamespace != "" {
+		if err := mgr.Add(&controller.DashboardPublisher{Client: mgr.GetClient(), Namespace: grafanaDashboardNamespace}); err != nil {
+			setupLog.Error(err, "unable to set up Grafana dashboard publisher")
+			os.Exit(1)
+		}
+	}
+
+	if kubeStateMetricsNamespace != "" {
+		if err := mgr.Add(&controller.KubeStateMetricsPublisher{Client: mgr.GetClient(), Namespace: kubeStateMetricsNamespace}); err != nil {
+			setupLog.Error(err, "unable to set up kube-state-metrics configuration publisher")
+			os.Exit(1)
+		}
+	}
+
+	if migrateStorageVersion && watchNamespaces == "" {
+		if err := mgr.Add(&controller.StorageVersionMigrator{Client: mgr.GetClient(), CRDName: guestBookCRDName}); err != nil {
+			setupLog.Error(err, "unable to set up storage version migrator")
+			os.Exit(1)
+		}
+	}
+
+	// ENABLE_WEBHOOKS=false only turns off admission. GuestBooks are stored
+	// at v1 while the controllers read v1alpha1, so /convert is always served.
+	enableWebhooks := os.Getenv("ENABLE_WEBHOOKS") != "false"
+	if enableWebhooks {
+		if err := (&webappv1alpha1.GuestBook{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "GuestBook")
+			os.Exit(1)
+		}
+	} else if err := ctrl.NewWebhookManagedBy(mgr).For(&webappv1alpha1.GuestBook{}).Complete(); err != nil {
+		setupLog.Error(err, "unable to create conversion webhook", "webhook", "GuestBook")
+		os.Exit(1)
+	}
+
+	// Liveness checks only fail when a restart would help; readiness checks
+	// also cover conditions the pod recovers from by itself
+	if err := mgr.AddReadyzCheck("informers", cacheSyncedCheck(mgr.GetCache())); err != nil {
+		setupLog.Error(err, "unable to set up informer ready check")
+		os.Exit(1)
+	}
+	if maxQueueDepth > 0 {
+		if err := mgr.AddHealthzCheck("backlog", backlogCheck(ctrlmetrics.Registry, maxQueueDepth, queueStallTimeout)); err != nil {
+			setupLog.Error(err, "unable to set up backlog health check")
+			os.Exit(1)
+		}
+	}
+	if enableLeaderElection {
+		namespace := leaderElectionNamespace
+		var nsErr error
+		if namespace == "" {
+			namespace, nsErr = inClusterNamespace()
+		}
+		if nsErr != nil {
+			setupLog.Info("skipping leader lease health check outside a cluster", "reason", nsErr.Error())
+		} else {
+			lease := types.NamespacedName{Namespace: namespace, Name: leaderElectionID}
+			if err := mgr.AddHealthzCheck("leader-lease", leaderLeaseCheck(mgr.GetAPIReader(), mgr.Elected(), lease, leaseDuration)); err != nil {
+				setupLog.Error(err, "unable to set up leader lease health check")
+				os.Exit(1)
+			}
+		}
+	}
+	if err := mgr.AddReadyzCheck("webhook", mgr.GetWebhookServer().StartedChecker()); err != nil {
+		setupLog.Error(err, "unable to set up webhook ready check")
+		os.Exit(1)
+	}
+	if webhookCertWatcher != nil {
+		if err := mgr.AddReadyzCheck("webhook-certificate", certificateReadyCheck(webhookCertWatcher)); err != nil {
+			setupLog.Error(err, "unable to set up webhook certificate ready check")
+			os.Exit(1)
+		}
+		certFile := filepath.Join(webhookCertPath, "tls.crt")
+		if err := mgr.AddHealthzCheck("webhook-certificate", certificateLiveCheck(webhookCertWatcher, certFile)); err != nil {
+			setupLog.Error(err, "unable to set up webhook certificate health check")
+			os.Exit(1)
+		}
+	}
+	if enableWebhooks && waitForCAInjection {
+		if err := mgr.AddReadyzCheck("ca-injection", caInjectedCheck(mgr.GetAPIReader(), webhookConfigPrefix)); err != nil {
+			setupLog.Error(err, "unable to set up CA injection ready check")
+			os.Exit(1)
+		}
+	}
+
+	// Start the manager
+	setupLog.Info("starting manager")
+	err = mgr.Start(ctx)
+
+	// ctx is done by now, so flush the remaining spans on a fresh deadline
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if shutdownErr := shutdownTracing(flushCtx); shutdownErr != nil {
+		setupLog.Error(shutdownErr, "unable to flush traces")
+	}
+	if err != nil {
+		setupLog.Error(err, "problem running manager")
+		os.Exit(1)
+	}
+}